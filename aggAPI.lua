@@ -411,14 +411,166 @@ end
 -- See the License for the specific language governing permissions and
 -- limitations under the License.
 
-local function apply_filter_record(rec, filter_func)
+-----------------------------------------------------------------
+-- time helpers, timestamps are epoch milliseconds (UTC)
+-----------------------------------------------------------------
+local MS_PER_UNIT = {
+  ms = 1,
+  s = 1000, sec = 1000, second = 1000,
+  m = 60000, min = 60000, minute = 60000,
+  h = 3600000, hour = 3600000,
+  d = 86400000, day = 86400000,
+  w = 604800000, week = 604800000,
+}
+
+local MS_PER_DAY = 86400000
+
+-- 1970-01-01 was a Thursday, weeks start on Monday
+local WEEK_OFFSET = 4 * MS_PER_DAY
+
+local function parse_interval(interval)
+  local size
+  if type(interval) == "number" then
+    size = interval
+  else
+    local n, unit = string.match(tostring(interval), "^%s*(%d*)%s*(%a+)%s*$")
+    size = unit and MS_PER_UNIT[string.lower(unit)]
+    if size == nil then
+      error("Invalid interval: "..tostring(interval))
+    end
+
+    if n ~= nil and #n > 0 then
+      size = size * tonumber(n)
+    end
+  end
+
+  if size <= 0 then
+    error("Invalid interval: "..tostring(interval))
+  end
+
+  return size
+end
+
+-- days since epoch for a civil date, see http://howardhinnant.github.io/date_algorithms.html
+local function days_from_civil(y, m, d)
+  if m <= 2 then y = y - 1 end
+  local era = math.floor(y / 400)
+  local yoe = y - era * 400
+  local mp = m > 2 and m - 3 or m + 9
+  local doy = math.floor((153 * mp + 2) / 5) + d - 1
+  local doe = yoe * 365 + math.floor(yoe / 4) - math.floor(yoe / 100) + doy
+  return era * 146097 + doe - 719468
+end
+
+local function civil_from_days(z)
+  z = z + 719468
+  local era = math.floor(z / 146097)
+  local doe = z - era * 146097
+  local yoe = math.floor((doe - math.floor(doe / 1460) + math.floor(doe / 36524) - math.floor(doe / 146096)) / 365)
+  local doy = doe - (365 * yoe + math.floor(yoe / 4) - math.floor(yoe / 100))
+  local mp = math.floor((5 * doy + 2) / 153)
+  local d = doy - math.floor((153 * mp + 2) / 5) + 1
+  local m = mp < 10 and mp + 3 or mp - 9
+  local y = yoe + era * 400
+  if m <= 2 then y = y + 1 end
+  return y, m, d
+end
+
+-- floor_to rounds `ts` down to a multiple of `size`, before the epoch too;
+-- not with %, as some Lua VMs return `size` for negative multiples of it
+local function floor_to(ts, size)
+  return math.floor(ts / size) * size
+end
+
+-- time_bucket returns the start of the fixed size bucket `ts` falls in.
+-- `interval` is either milliseconds, or a string like '15s', '5m', '1h', '1d'
+local function time_bucket(ts, interval)
+  if ts == nil then
+    return nil
+  end
+
+  local size = parse_interval(interval)
+  return floor_to(ts, size)
+end
+
+-- date_trunc truncates `ts` to the start of its second, minute, hour, day,
+-- week (starting Monday), month or year
+local function date_trunc(unit, ts)
+  if ts == nil then
+    return nil
+  end
+
+  unit = string.lower(unit)
+  if unit == "month" or unit == "year" then
+    local y, m = civil_from_days(math.floor(ts / MS_PER_DAY))
+    if unit == "year" then m = 1 end
+    return days_from_civil(y, m, 1) * MS_PER_DAY
+  elseif unit == "week" then
+    return floor_to(ts - WEEK_OFFSET, MS_PER_UNIT.week) + WEEK_OFFSET
+  end
+
+  local size = MS_PER_UNIT[unit]
+  if size == nil then
+    error("Invalid date_trunc unit: "..unit)
+  end
+  return floor_to(ts, size)
+end
+
+-- sandbox returns the environment expressions and filters are evaluated in
+local function sandbox(rec, dim)
+  return {
+    rec = rec,
+    dim = dim,
+    result = nil,
+    string = string,
+    math = math,
+    time_bucket = time_bucket,
+    date_trunc = date_trunc,
+  }
+end
+
+-- column the grouping id of a tuple is returned in, when grouping sets are used
+local GROUPING_ID = "__grouping_id"
+
+-- groups over max_groups are accumulated into a tuple tagged with OTHERS,
+-- or replaced by the single tuple MAX_GROUPS, keyed and tagged with it, of
+-- the limit
+local OTHERS = "__others"
+local MAX_GROUPS = "__max_groups"
+
+-- a record looked up in a join with no such key: its bins are all nil
+local NO_RECORD = {}
+
+local NO_RECORD_META = {__index = function() return NO_RECORD end}
+
+-- load_dims converts the lookup maps of the joins of the payload, by name,
+-- into tables returning NO_RECORD for the keys they do not have, so that
+-- dim['dept'][rec['dept_id']]['name'] is nil like in a left join
+local function load_dims(dims)
+  if dims == nil then
+    return nil
+  end
+
+  local res = {}
+  for name, records in map.pairs(dims) do
+    local t = {}
+    for k, v in map.pairs(records) do
+      t[k] = v
+    end
+    res[name] = setmetatable(t, NO_RECORD_META)
+  end
+  return res
+end
+
+local function apply_filter_record(rec, filter_func, dim)
   -- if there is no filter, or filter failed to compile: select NO records
   if filter_func == nil then
     return false
   end
 
   -- if there was a filter specified, and was successfully compiled
-  local context = {rec = rec, select_rec = false, string = string}
+  local context = sandbox(rec, dim)
+  context.select_rec = false
 
   -- sandbox the function
   setfenv(filter_func, context)
@@ -427,14 +579,22 @@ local function apply_filter_record(rec, filter_func)
   return context.select_rec
 end
 
------------------------------------------------------------------
--- select_agg_records will return aggregated data
--- the final reduction happens on the client itself
------------------------------------------------------------------
-function select_agg_records(stream, args)
+-- compile parses the payload of an aggregation into its filter, map and
+-- reduce functions
+-- less orders the values of min and max like SQL: numbers before strings
+local function less(a, b)
+  local ta, tb = type(a), type(b)
+  if ta == tb then
+    return a < b
+  end
+  return ta == "number"
+end
+
+local function compile(args)
   local aggregate_fields = args["fields"]
   local filter_func_str = args["filter"]
   local group_by_fields = args["group_by_fields"]
+  local dim = load_dims(args["dims"])
 
   local filter_func = nil
   if filter_func_str ~= nil and #filter_func_str > 0 then
@@ -452,6 +612,7 @@ function select_agg_records(stream, args)
 
   local raw_fields = nil
   local aggregate_field_funcs = nil
+  local aggregate_filter_funcs = nil
   if aggregate_fields ~= nil then
     local eval = loadstring or load
 
@@ -464,6 +625,16 @@ function select_agg_records(stream, args)
         if err ~= nil then
           error("Error Parsing Expr: "..err)
         end
+
+        -- per aggregate filter, the equivalent of `FILTER (WHERE ...)`
+        local field_filter = defs.filter
+        if field_filter ~= nil and #field_filter > 0 then
+          if aggregate_filter_funcs == nil then aggregate_filter_funcs = {} end
+          aggregate_filter_funcs[alias], err = eval("if ("..field_filter..") then select_rec = true end")
+          if err ~= nil then
+            error("Error Parsing Filter for field `"..alias.."`: "..err)
+          end
+        end
       else
         if raw_fields == nil then raw_fields = {} end
         raw_fields[alias] = defs
@@ -473,6 +644,104 @@ function select_agg_records(stream, args)
     error("No fields specified to return")
   end
 
+  -- group by entries are either a field alias / bin name, or a map of
+  -- {"alias": ..., "expr": ...} to group by a computed value
+  local group_by_keys = nil
+  local group_by_exprs = nil
+  if group_by_fields ~= nil then
+    local eval = loadstring or load
+
+    group_by_keys = {}
+    for v in list.iterator(group_by_fields) do
+      if getmetatable(v) == mapmetadata then
+        local f, err = eval("result = "..v.expr)
+        if err ~= nil then
+          error("Error Parsing Group By Expr: "..err)
+        end
+
+        if group_by_exprs == nil then group_by_exprs = {} end
+        group_by_exprs[v.alias] = v.expr
+        table.insert(group_by_keys, {alias = v.alias, func = f})
+      else
+        table.insert(group_by_keys, {alias = v})
+      end
+    end
+  end
+
+  -- grouping sets aggregate the same records over several subsets of the
+  -- group by entries, each tuple is tagged with the set's grouping id
+  local grouping_sets = nil
+  local group_aliases = {}
+  if args["grouping_sets"] ~= nil then
+    if group_by_keys == nil then
+      error("grouping_sets requires group_by_fields")
+    end
+
+    for _, g in ipairs(group_by_keys) do
+      group_aliases[g.alias] = true
+    end
+
+    grouping_sets = {}
+    for set in list.iterator(args["grouping_sets"]) do
+      local members = {}
+      for alias in list.iterator(set) do
+        if not group_aliases[alias] then
+          error("Grouping set member `"..tostring(alias).."` is not in group_by_fields")
+        end
+        members[alias] = true
+      end
+
+      -- like SQL's GROUPING_ID: a bit is set for every rolled up entry,
+      -- the first group by entry being the most significant bit
+      local id = 0
+      for _, g in ipairs(group_by_keys) do
+        id = id * 2
+        if not members[g.alias] then id = id + 1 end
+      end
+
+      table.insert(grouping_sets, {members = members, id = id})
+    end
+  end
+
+  local max_groups = args["max_groups"]
+  local others_keys = nil
+  if max_groups ~= nil then
+    if type(max_groups) ~= "number" or max_groups < 1 then
+      error("max_groups must be a positive number")
+    end
+
+    local on_max_groups = args["on_max_groups"] or "error"
+    if on_max_groups == "others" then
+      -- one others tuple per grouping set, which must not be merged
+      others_keys = {}
+      for _, gs in ipairs(grouping_sets or {{id = ""}}) do
+        others_keys[gs.id] = OTHERS..":"..gs.id
+      end
+    elseif on_max_groups ~= "error" then
+      error("on_max_groups must be `error` or `others`, not `"..tostring(on_max_groups).."`")
+    end
+  end
+
+  local function group_key(values, grouping_set)
+    local m = md5.new()
+    if grouping_set ~= nil then
+      m:update("#"..grouping_set.id..":")
+    end
+
+    if group_by_keys ~= nil then
+      for i, g in ipairs(group_by_keys) do
+        if grouping_set == nil or grouping_set.members[g.alias] then
+          local lv = values[i]
+          -- makes sure sharded values do not concat to the exact same value
+          m:update(tostring(#lv))
+          m:update(lv)
+        end
+      end
+    end
+
+    return md5.tohex(m:finish())
+  end
+
 
   local function map_aggregates(rec)
 
@@ -490,35 +759,69 @@ function select_agg_records(stream, args)
 
     if aggregate_field_funcs ~= nil then
       for alias, f in pairs(aggregate_field_funcs) do
-        local context = {rec = rec, result = nil}
+        local context = sandbox(rec, dim)
 
-        -- sandbox the function
-        setfenv(f, context)
-        f()
+        local field_filter = aggregate_filter_funcs and aggregate_filter_funcs[alias]
+        if field_filter == nil or apply_filter_record(rec, field_filter, dim) then
+          -- sandbox the function
+          setfenv(f, context)
+          f()
+        end
 
         local t = type(context.result)
-        if t == "number" then
+        local fn = aggregate_fields[alias].func
+        if t == "number" or (t == "string" and (fn == "min" or fn == "max")) then
           info[alias] = context.result
         elseif t == "nil" then
           -- do nothing; nil is acceptible, but not actionable
         else
-          error("Expression for field `"..alias.."` ("..aggregate_fields[alias].expr..") returned a value of type `"..t.."`, instead of number or nil")
+          error("Expression for field `"..alias.."` ("..aggregate_fields[alias].expr..") returned a value of type `"..t.."`, instead of number or nil, or string for min and max")
         end
       end
     end
 
-    local m = md5.new()
-    if group_by_fields ~= nil then
-      for v in list.iterator(group_by_fields) do
-        local lv = tostring(rec[v] or info[v])
-        -- makes sure sharded values do not concat to the exact same value
-        m:update(tostring(#lv))
-        m:update(lv)
+    local group_values = {}
+    if group_by_keys ~= nil then
+      for i, g in ipairs(group_by_keys) do
+        local gv = nil
+        if g.func ~= nil then
+          local context = sandbox(rec, dim)
+
+          -- sandbox the function
+          setfenv(g.func, context)
+          g.func()
+
+          gv = context.result
+          local t = type(gv)
+          if t == "number" or t == "string" then
+            info[g.alias] = gv
+          elseif t ~= "nil" then
+            error("Group by expression `"..g.alias.."` ("..group_by_exprs[g.alias]..") returned a value of type `"..t.."`, instead of number, string or nil")
+          end
+        else
+          gv = rec[g.alias] or info[g.alias]
+        end
+
+        group_values[i] = tostring(gv)
       end
     end
-    local key = md5.tohex(m:finish())
 
-    accu[key] = info
+    if grouping_sets == nil then
+      accu[group_key(group_values, nil)] = info
+    else
+      for _, gs in ipairs(grouping_sets) do
+        local tuple = map()
+        for alias, v in map.pairs(info) do
+          -- rolled up group by entries are not returned
+          if not group_aliases[alias] or gs.members[alias] then
+            tuple[alias] = v
+          end
+        end
+        tuple[GROUPING_ID] = gs.id
+
+        accu[group_key(group_values, gs)] = tuple
+      end
+    end
 
     return accu
   end
@@ -546,18 +849,27 @@ function select_agg_records(stream, args)
           if fn == "sum" or fn == "count" then
             aggs[f] = (t1 or 0) + (t2 or 0)
           elseif fn == "min" then
-            if (t2 ~= nil) and (t1 ~= nil) then
-              if t2 < t1 then aggs[f] = t2 end
-            elseif t2 ~= nil and t1 == nil then 
-              aggs[f] = t2
-            end
+            if less(t2, t1) then aggs[f] = t2 end
           elseif fn == "max" then
-            if (t2 ~= nil) and (t1 ~= nil) then
-              if t2 > t1 then aggs[f] = t2 end
-            elseif t2 ~= nil and t1 == nil then 
-              aggs[f] = t2
-            end
+            if less(t1, t2) then aggs[f] = t2 end
           end
+        else
+          -- only one side had a value, e.g. filtered out by the field filter
+          aggs[f] = t1 or t2
+        end
+      end
+    end
+
+    if grouping_sets ~= nil then
+      aggs[GROUPING_ID] = tuple1[GROUPING_ID]
+    end
+
+    if group_by_exprs ~= nil then
+      for alias, _ in pairs(group_by_exprs) do
+        -- group values are equal for the same key, take whichever is set
+        local t = tuple1[alias] or tuple2[alias]
+        if t ~= nil then
+          aggs[alias] = t
         end
       end
     end
@@ -565,27 +877,197 @@ function select_agg_records(stream, args)
     return aggs
   end
 
+  -- only the aggregates of tuples accumulated into others are returned,
+  -- their fields and group values are not the same for all the groups
+  local function to_others(tuple)
+    local others = map()
+    for f, defs in map.pairs(aggregate_fields) do
+      if getmetatable(defs) == mapmetadata and tuple[f] ~= nil then
+        others[f] = tuple[f]
+      end
+    end
+
+    if grouping_sets ~= nil then
+      others[GROUPING_ID] = tuple[GROUPING_ID]
+    end
+    others[OTHERS] = 1
+
+    return others
+  end
+
+  local function count_groups(accu)
+    local groups = map.size(accu)
+    if others_keys ~= nil then
+      for _, key in pairs(others_keys) do
+        if accu[key] ~= nil then groups = groups - 1 end
+      end
+    end
+    return groups
+  end
+
   local function reduce_aggregates(accu1, accu2)
+    -- over the limit, the other groups are dropped
+    if accu1[MAX_GROUPS] ~= nil then
+      return accu1
+    end
+    if accu2[MAX_GROUPS] ~= nil then
+      return accu2
+    end
+
+    local groups = nil
+    if max_groups ~= nil then
+      groups = count_groups(accu1)
+    end
 
     for key, tuple in map.pairs(accu2) do
       if accu1[key] ~= nil then
         -- same key, accumulate
         accu1[key] = accu_tuples(accu1[key], tuple)
-      else
+        if tuple[OTHERS] ~= nil then
+          accu1[key][OTHERS] = 1
+        end
+      elseif groups == nil or tuple[OTHERS] ~= nil then
+        accu1[key] = tuple
+      elseif groups < max_groups then
         accu1[key] = tuple
+        groups = groups + 1
+      elseif others_keys ~= nil then
+        local others_key = others_keys[tuple[GROUPING_ID] or ""]
+        local others = to_others(tuple)
+        if accu1[others_key] ~= nil then
+          others = to_others(accu_tuples(accu1[others_key], others))
+        end
+        accu1[others_key] = others
+      else
+        local exceeded = map()
+        exceeded[MAX_GROUPS] = max_groups
+        local res = map()
+        res[MAX_GROUPS] = exceeded
+        return res
       end
     end
 
     return accu1
   end
 
-  local function filter_records(rec)
-    return apply_filter_record(rec, filter_func)
+  local filter_records = nil
+  if filter_func_str ~= nil then
+    filter_records = function(rec)
+      return apply_filter_record(rec, filter_func, dim)
+    end
   end
 
-  if filter_func_str ~= nil then
-    return stream : filter(filter_records) : map(map_aggregates)  : reduce(reduce_aggregates)
+  return {
+    filter_records = filter_records,
+    map_aggregates = map_aggregates,
+    reduce_aggregates = reduce_aggregates,
+  }
+end
+
+-----------------------------------------------------------------
+-- select_agg_records will return aggregated data
+-- the final reduction happens on the client itself
+-----------------------------------------------------------------
+function select_agg_records(stream, args)
+  local agg = compile(args)
+
+  if agg.filter_records ~= nil then
+    return stream : filter(agg.filter_records) : map(agg.map_aggregates)  : reduce(agg.reduce_aggregates)
   else
-    return stream : map(map_aggregates)  : reduce(reduce_aggregates)
+    return stream : map(agg.map_aggregates)  : reduce(agg.reduce_aggregates)
+  end
+end
+
+-- bins of the group records apply_agg_record maintains
+local ROLLUP_GROUPS = "agg_groups"
+local ROLLUP_CHECKSUM = "agg_checksum"
+local ROLLUP_APPLIED = "agg_applied"
+
+-- number of writes a group record remembers, so applying one again is a
+-- no-op
+local ROLLUP_APPLIED_MAX = 32
+
+-- compiled payloads of the rollups, the most recently used first, so the
+-- records written are not compiling the same payload over and over
+local ROLLUP_CACHE_SIZE = 8
+local rollups = {}
+
+local function compile_rollup(args, checksum)
+  for i, r in ipairs(rollups) do
+    if r.checksum == checksum then
+      table.remove(rollups, i)
+      table.insert(rollups, 1, r)
+      return r.agg
+    end
+  end
+
+  local agg = compile(args)
+  table.insert(rollups, 1, {checksum = checksum, agg = agg})
+  if #rollups > ROLLUP_CACHE_SIZE then
+    table.remove(rollups)
+  end
+  return agg
+end
+
+-----------------------------------------------------------------
+-- map_agg_record returns the groups of a record written, a map of its
+-- bins, by group key, like select_agg_records would map it when scanning
+-- it: none when filtered out, one per grouping set otherwise. It runs on
+-- the key of the record written, which it does not read.
+-----------------------------------------------------------------
+function map_agg_record(rec, args, bins, checksum)
+  local agg = compile_rollup(args, checksum)
+  if agg.filter_records ~= nil and not agg.filter_records(bins) then
+    return map()
+  end
+
+  return agg.map_aggregates(bins)
+end
+
+-----------------------------------------------------------------
+-- apply_agg_record accumulates the group of a record, returned by
+-- map_agg_record under key, into the record of the group. checksum
+-- identifies the payload the group was built by, it cannot be accumulated
+-- by another one. write identifies the write applied: one of the last
+-- ROLLUP_APPLIED_MAX writes of the group is not accumulated again, and 0
+-- is returned instead of 1.
+-----------------------------------------------------------------
+function apply_agg_record(rec, args, key, group, checksum, write)
+  local stored = rec[ROLLUP_CHECKSUM]
+  if stored ~= nil and stored ~= checksum then
+    error("rollup was built by another payload")
+  end
+
+  local applied = list()
+  if rec[ROLLUP_APPLIED] ~= nil then
+    for w in list.iterator(rec[ROLLUP_APPLIED]) do
+      if w == write then
+        return 0
+      end
+      list.append(applied, w)
+    end
+  end
+  list.append(applied, write)
+  if list.size(applied) > ROLLUP_APPLIED_MAX then
+    applied = list.drop(applied, list.size(applied) - ROLLUP_APPLIED_MAX)
+  end
+
+  local groups = map()
+  groups[key] = group
+
+  local agg = compile_rollup(args, checksum)
+  rec[ROLLUP_GROUPS] = agg.reduce_aggregates(rec[ROLLUP_GROUPS] or map(), groups)
+  rec[ROLLUP_CHECKSUM] = checksum
+  rec[ROLLUP_APPLIED] = applied
+
+  local err
+  if aerospike:exists(rec) then
+    err = aerospike:update(rec)
+  else
+    err = aerospike:create(rec)
+  end
+  if err ~= 0 then
+    error("rollup group not written: "..tostring(err))
   end
+  return 1
 end
@@ -0,0 +1,320 @@
+// Package agg runs aggregations through the aggAPI.lua UDF and decodes
+// their results.
+package agg
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+
+	aero "github.com/aerospike/aerospike-client-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// UDFModule is the name the aggAPI.lua module is registered under.
+	UDFModule = "aggAPI"
+
+	// UDFFunction is the stream UDF that runs the aggregation.
+	UDFFunction = "select_agg_records"
+)
+
+// UDFHash returns the hash the server lists the UDF content is registered
+// with, to check it is up to date.
+func UDFHash(content []byte) string {
+	sum := sha1.Sum(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// RegisterUDF registers content as the aggAPI.lua module of client, and
+// waits until the cluster has it, or ctx is done.
+func RegisterUDF(ctx context.Context, client *aero.Client, content []byte) error {
+	_, span := tracer().Start(ctx, "agg.register", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		AttrUDFHash.String(UDFHash(content)),
+	))
+
+	err := registerUDF(ctx, client, content)
+	endSpan(span, err)
+	return err
+}
+
+func registerUDF(ctx context.Context, client *aero.Client, content []byte) error {
+	task, err := client.RegisterUDF(nil, content, UDFModule+".lua", aero.LUA)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-task.OnComplete():
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GroupingIDColumn is the column the grouping id of a row is returned in,
+// when the query has grouping sets.
+const GroupingIDColumn = "__grouping_id"
+
+// OthersColumn is set to 1 in the rows accumulating the groups over the
+// max_groups limit, when on_max_groups is "others".
+const OthersColumn = "__others"
+
+// DefaultMaxGroups is the max_groups limit applied to payloads without one.
+// A payload with a max_groups of 0 or less is not limited.
+const DefaultMaxGroups = 100000
+
+// maxGroupsKey keys the only group the UDF returns over max_groups, when
+// on_max_groups is "error", its column being the limit.
+const maxGroupsKey = "__max_groups"
+
+// TooManyGroupsError is returned by aggregations returning more groups than
+// their max_groups limit.
+type TooManyGroupsError struct {
+	MaxGroups int
+}
+
+func (e *TooManyGroupsError) Error() string {
+	return fmt.Sprintf("aggregation returned more than %d groups; raise max_groups, or set on_max_groups to `others`", e.MaxGroups)
+}
+
+// Row is a single group returned by the aggregation, keyed by field alias.
+type Row map[string]interface{}
+
+// Grouping returns the grouping id of the row, like SQL's GROUPING_ID: a
+// bit is set for every group by entry rolled up in the row's grouping
+// set, the first entry being the most significant bit. It is 0 for rows
+// grouped by all entries, and for queries without grouping sets.
+func (r Row) Grouping() int64 {
+	id, _ := toInt64(r[GroupingIDColumn])
+	return id
+}
+
+// IsOthers reports whether the row accumulates the groups over the
+// max_groups limit. Only its aggregates are set.
+func (r Row) IsOthers() bool {
+	_, exists := r[OthersColumn]
+	return exists
+}
+
+// Aggregate runs the aggregation described by payload on nsName.setName
+// and returns one row per group. Payloads without a max_groups limit are
+// limited to DefaultMaxGroups.
+func Aggregate(client *aero.Client, nsName, setName string, payload map[string]interface{}) ([]Row, error) {
+	return AggregateContext(context.Background(), client, nsName, setName, payload)
+}
+
+// AggregateContext is Aggregate, stopping when ctx is done with a
+// *CanceledError.
+func AggregateContext(ctx context.Context, client *aero.Client, nsName, setName string, payload map[string]interface{}) ([]Row, error) {
+	return aggregate(ctx, client, nil, aero.NewStatement(nsName, setName), payload)
+}
+
+// Progress describes how far an aggregation got. Only the aggregations
+// querying every node on its own, like Query.ExecutePartials, know it
+// before they are done: the client returns nothing but the result of the
+// final reduce, once all the nodes are, so the others only set Elapsed.
+type Progress struct {
+	Done    int   // nodes done; in a union, of the set being aggregated
+	Nodes   int   // nodes queried
+	Records int64 // records aggregated by the nodes done
+
+	// Rows are the groups of the nodes done, merged.
+	Rows []Row
+
+	Elapsed time.Duration
+}
+
+// CanceledError is returned by aggregations stopped because their context
+// is done. It unwraps to the error of the context.
+type CanceledError struct {
+	Err      error
+	Progress Progress
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("aggregation canceled after %v: %v", e.Progress.Elapsed.Round(time.Millisecond), e.Err)
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+func aggregate(ctx context.Context, client *aero.Client, policy *aero.QueryPolicy, stm *aero.Statement, payload map[string]interface{}) ([]Row, error) {
+	// the groups over max_groups are cut once all the nodes are merged, so
+	// that none is split between its own row and the others
+	if payload["on_max_groups"] == "others" {
+		return aggregatePartials(ctx, client, policy, stm, payload, nil)
+	}
+
+	payload, _ = withMaxGroups(payload)
+
+	start := time.Now()
+	ctx, span := startQuerySpan(ctx, stm.Namespace, stm.SetName, payload)
+	rows, err := aggregateResults(ctx, client, policy, stm, payload)
+	endQuerySpan(span, rows, err)
+	logQuery(ctx, stm.Namespace, stm.SetName, payload, start, rows, err)
+	return rows, err
+}
+
+func aggregateResults(ctx context.Context, client *aero.Client, policy *aero.QueryPolicy, stm *aero.Statement, payload map[string]interface{}) ([]Row, error) {
+	start := time.Now()
+	if err := ctx.Err(); err != nil {
+		return nil, &CanceledError{Err: err, Progress: Progress{Rows: []Row{}}}
+	}
+
+	_, dispatch := tracer().Start(ctx, "agg.dispatch")
+	recordset, err := client.QueryAggregate(contextPolicy(ctx, client, policy), stm, UDFModule, UDFFunction, aero.NewValue(payload))
+	endSpan(dispatch, err)
+	if err != nil {
+		return nil, err
+	}
+
+	// the client runs the final reduce before returning the results
+	receiveCtx, receive := tracer().Start(ctx, "agg.receive")
+	res := []Row{}
+	received := 0
+	results := recordset.Results()
+	for {
+		select {
+		case <-ctx.Done():
+			// Close waits for the commands to the nodes to stop
+			go recordset.Close()
+
+			err := &CanceledError{Err: ctx.Err(), Progress: Progress{Rows: []Row{}, Elapsed: time.Since(start)}}
+			endSpan(receive, err)
+			return nil, err
+
+		case result, ok := <-results:
+			if !ok {
+				recordset.Close()
+				receive.SetAttributes(AttrResults.Int(received))
+				endSpan(receive, nil)
+				return res, nil
+			}
+
+			if result.Err != nil {
+				recordset.Close()
+				endSpan(receive, result.Err)
+				return nil, result.Err
+			}
+			if err := groupsError(result.Record.Bins["SUCCESS"]); err != nil {
+				recordset.Close()
+				endSpan(receive, err)
+				return nil, err
+			}
+
+			received++
+
+			_, decode := tracer().Start(receiveCtx, "agg.decode")
+			rows := DecodeGroups(result.Record.Bins["SUCCESS"])
+			decode.SetAttributes(AttrGroups.Int(len(rows)))
+			decode.End()
+
+			res = append(res, rows...)
+		}
+	}
+}
+
+// withMaxGroups returns payload with the default max_groups when it has
+// none, and without it when it is 0 or less, along with the limit.
+func withMaxGroups(payload map[string]interface{}) (map[string]interface{}, int) {
+	v, exists := payload["max_groups"]
+	maxGroups, ok := toInt64(v)
+	if exists && ok && maxGroups > 0 {
+		return payload, int(maxGroups)
+	}
+	if exists && !ok {
+		// left for the UDF to reject
+		return payload, 0
+	}
+
+	res := make(map[string]interface{}, len(payload)+1)
+	for k, v := range payload {
+		res[k] = v
+	}
+
+	if exists {
+		delete(res, "max_groups")
+		return res, 0
+	}
+
+	res["max_groups"] = DefaultMaxGroups
+	return res, DefaultMaxGroups
+}
+
+// groupsError returns a *TooManyGroupsError when v, the map returned by
+// select_agg_records, is the group returned over max_groups.
+func groupsError(v interface{}) error {
+	groups, _ := v.(map[interface{}]interface{})
+	group, exists := groups[maxGroupsKey]
+	if !exists {
+		return nil
+	}
+
+	maxGroups, _ := toInt64(decodeRow(group)[maxGroupsKey])
+	return &TooManyGroupsError{MaxGroups: int(maxGroups)}
+}
+
+// withoutMaxGroups returns payload without its max_groups limit, for the
+// aggregations cutting the groups over it once all are merged.
+func withoutMaxGroups(payload map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		if k != "max_groups" && k != "on_max_groups" {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// DecodeGroups converts the map returned by select_agg_records into rows.
+func DecodeGroups(v interface{}) []Row {
+	groups, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+
+	res := make([]Row, 0, len(groups))
+	for _, group := range groups {
+		if row := decodeRow(group); row != nil {
+			res = append(res, row)
+		}
+	}
+
+	return res
+}
+
+// decodeRow converts a group returned by select_agg_records into a row,
+// or returns nil when it is not a map.
+func decodeRow(v interface{}) Row {
+	fields, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+
+	row := make(Row, len(fields))
+	for k, v := range fields {
+		row[k.(string)] = decodeValue(v)
+	}
+	return row
+}
+
+// decodeValue normalizes numbers; Lua only has floats, so integral values
+// are returned as int64.
+func decodeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,457 @@
+package agg
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	aero "github.com/aerospike/aerospike-client-go"
+)
+
+// CacheOptions are the limits of a Cache. Zero values are unlimited.
+type CacheOptions struct {
+	// TTL is how long results are cached.
+	TTL time.Duration
+
+	// MaxEntries is the number of results cached, the least recently used
+	// being evicted first.
+	MaxEntries int
+
+	// MaxRows is the number of rows cached across the results. Results
+	// with more rows are not cached.
+	MaxRows int
+}
+
+// CacheStats are the counters of a Cache.
+type CacheStats struct {
+	Hits      int64 // results returned from the cache
+	Coalesced int64 // results shared with an identical query running
+	Misses    int64 // queries run
+	Entries   int   // results cached
+	Rows      int   // rows cached
+}
+
+// Cache caches the rows of aggregations, keyed by their namespace, set,
+// index filter and normalized payload. Identical queries arriving while one
+// runs wait for its rows rather than running again. A Cache is safe for
+// concurrent use.
+type Cache struct {
+	opts CacheOptions
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // of *cacheEntry
+	lru     *list.List               // most recently used first
+	calls   map[string]*cacheCall    // queries running
+	gen     int64                    // incremented by invalidations
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	key       string
+	namespace string
+	set       string
+	rows      []Row
+	expires   time.Time
+}
+
+type cacheCall struct {
+	done chan struct{}
+	rows []Row
+	err  error
+}
+
+// NewCache returns an empty cache.
+func NewCache(opts CacheOptions) *Cache {
+	return &Cache{
+		opts:    opts,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		calls:   map[string]*cacheCall{},
+	}
+}
+
+// Execute returns the cached rows of q, or runs it with ExecuteContext.
+// Errors are not cached, nor the rows of unions of sets and of joins.
+func (c *Cache) Execute(ctx context.Context, client *aero.Client, q *Query) ([]Row, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if len(q.Sets) > 0 || len(q.Joins) > 0 {
+		// the sets globs match, and the sets joined, change without
+		// invalidations of the set of the query
+		return q.ExecuteContext(ctx, client)
+	}
+
+	key, err := cacheKey(q.Namespace, q.Set, q.Index, q.Payload())
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(ctx, key, q.Namespace, q.Set, func() ([]Row, error) {
+		return q.ExecuteContext(ctx, client)
+	})
+}
+
+// Aggregate returns the cached rows of payload on nsName.setName, or runs
+// it with AggregateContext.
+func (c *Cache) Aggregate(ctx context.Context, client *aero.Client, nsName, setName string, payload map[string]interface{}) ([]Row, error) {
+	key, err := cacheKey(nsName, setName, nil, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(ctx, key, nsName, setName, func() ([]Row, error) {
+		return AggregateContext(ctx, client, nsName, setName, payload)
+	})
+}
+
+// Invalidate removes the results of the queries on namespace.set, or on
+// any set of namespace when set is empty. Results of the queries running
+// are not cached.
+func (c *Cache) Invalidate(namespace, set string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, elem := range c.entries {
+		e := elem.Value.(*cacheEntry)
+		if e.namespace == namespace && (set == "" || e.set == set) {
+			c.remove(elem)
+		}
+	}
+}
+
+// Purge removes all the results.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, elem := range c.entries {
+		c.remove(elem)
+	}
+}
+
+// Stats returns the counters of the cache.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+func (c *Cache) do(ctx context.Context, key, namespace, set string, run func() ([]Row, error)) ([]Row, error) {
+	for {
+		c.mu.Lock()
+		if rows, ok := c.get(key); ok {
+			c.stats.Hits++
+			c.mu.Unlock()
+			return copyRows(rows), nil
+		}
+
+		if call, ok := c.calls[key]; ok {
+			c.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return nil, &CanceledError{Err: ctx.Err(), Progress: Progress{Rows: []Row{}}}
+			case <-call.done:
+			}
+
+			// the context of the query running was canceled, not ours
+			var canceled *CanceledError
+			if errors.As(call.err, &canceled) && ctx.Err() == nil {
+				continue
+			}
+			if call.err != nil {
+				return nil, call.err
+			}
+
+			c.mu.Lock()
+			c.stats.Coalesced++
+			c.mu.Unlock()
+			return copyRows(call.rows), nil
+		}
+
+		call := &cacheCall{done: make(chan struct{})}
+		c.calls[key] = call
+		c.stats.Misses++
+		gen := c.gen
+		c.mu.Unlock()
+
+		call.rows, call.err = run()
+
+		c.mu.Lock()
+		delete(c.calls, key)
+		if call.err == nil && gen == c.gen {
+			c.add(key, namespace, set, call.rows)
+		}
+		c.mu.Unlock()
+		close(call.done)
+
+		if call.err != nil {
+			return nil, call.err
+		}
+		return copyRows(call.rows), nil
+	}
+}
+
+// get returns the rows cached under key, unless they expired.
+func (c *Cache) get(key string) ([]Row, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := elem.Value.(*cacheEntry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return e.rows, true
+}
+
+// add caches rows under key, evicting the least recently used results
+// over the limits.
+func (c *Cache) add(key, namespace, set string, rows []Row) {
+	if c.opts.MaxRows > 0 && len(rows) > c.opts.MaxRows {
+		return
+	}
+
+	e := &cacheEntry{key: key, namespace: namespace, set: set, rows: rows}
+	if c.opts.TTL > 0 {
+		e.expires = time.Now().Add(c.opts.TTL)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	c.stats.Entries++
+	c.stats.Rows += len(rows)
+
+	for (c.opts.MaxEntries > 0 && c.stats.Entries > c.opts.MaxEntries) ||
+		(c.opts.MaxRows > 0 && c.stats.Rows > c.opts.MaxRows) {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.stats.Entries--
+	c.stats.Rows -= len(e.rows)
+}
+
+func copyRows(rows []Row) []Row {
+	res := make([]Row, len(rows))
+	for i, row := range rows {
+		r := make(Row, len(row))
+		for k, v := range row {
+			r[k] = v
+		}
+		res[i] = r
+	}
+	return res
+}
+
+// cacheKey returns the key of a query: its namespace, set, index filter and
+// normalized payload.
+func cacheKey(namespace, set string, index *IndexFilter, payload map[string]interface{}) (string, error) {
+	p, err := NormalizePayload(payload)
+	if err != nil {
+		return "", err
+	}
+
+	key := namespace + "." + set
+	if index != nil {
+		key += " " + index.String()
+	}
+	return key + " " + string(p), nil
+}
+
+// NormalizePayload returns payload as JSON, with whitespace in expressions
+// collapsed, and the group by entries and grouping set members sorted when
+// their order does not change the rows. Payloads of the same aggregation
+// written differently normalize to the same JSON. The lookup maps of the
+// joins are data, not part of the aggregation: only their names are kept.
+func NormalizePayload(payload map[string]interface{}) ([]byte, error) {
+	if dims, ok := payload["dims"].(map[string]interface{}); ok {
+		names := make([]string, 0, len(dims))
+		for name := range dims {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		res := make(map[string]interface{}, len(payload))
+		for k, v := range payload {
+			res[k] = v
+		}
+		res["dims"] = names
+		payload = res
+	}
+
+	// converts the payload to maps, lists and scalars only
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	var p map[string]interface{}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+
+	if fields, ok := p["fields"].(map[string]interface{}); ok {
+		for alias, def := range fields {
+			fields[alias] = normalizeDefinition(def)
+		}
+	}
+
+	if filter, ok := p["filter"].(string); ok {
+		p["filter"] = normalizeExpr(filter)
+	}
+
+	if groupBy, ok := p["group_by_fields"].([]interface{}); ok {
+		for i, g := range groupBy {
+			groupBy[i] = normalizeDefinition(g)
+		}
+
+		// the order of the group by entries only changes the grouping ids
+		if _, ok := p["grouping_sets"]; !ok {
+			sort.SliceStable(groupBy, func(i, j int) bool {
+				return groupAlias(groupBy[i]) < groupAlias(groupBy[j])
+			})
+		}
+	}
+
+	if sets, ok := p["grouping_sets"].([]interface{}); ok {
+		for _, set := range sets {
+			if members, ok := set.([]interface{}); ok {
+				sort.SliceStable(members, func(i, j int) bool {
+					return groupAlias(members[i]) < groupAlias(members[j])
+				})
+			}
+		}
+	}
+
+	// maps are marshaled with sorted keys
+	return json.Marshal(p)
+}
+
+// normalizeDefinition normalizes a field or group by entry: a name, or a
+// map of expressions.
+func normalizeDefinition(def interface{}) interface{} {
+	switch def := def.(type) {
+	case string:
+		return strings.TrimSpace(def)
+	case map[string]interface{}:
+		for k, v := range def {
+			if s, ok := v.(string); ok {
+				def[k] = normalizeExpr(s)
+			}
+		}
+	}
+	return def
+}
+
+func groupAlias(g interface{}) string {
+	switch g := g.(type) {
+	case string:
+		return g
+	case map[string]interface{}:
+		alias, _ := g["alias"].(string)
+		return alias
+	}
+	return ""
+}
+
+// normalizeExpr trims a Lua expression and collapses its whitespace to a
+// single space, outside of string literals. Comments are whitespace, so
+// that the code following one on the next line is kept apart from it.
+func normalizeExpr(expr string) string {
+	var b strings.Builder
+	space := false
+
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+			i++
+			continue
+		case strings.HasPrefix(expr[i:], "--"):
+			space = true
+			i = commentEnd(expr, i)
+			continue
+		}
+
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+
+		end := literalEnd(expr, i)
+		b.WriteString(expr[i:end])
+		i = end
+	}
+
+	return b.String()
+}
+
+// commentEnd returns the end of the comment starting at i, a long comment
+// or the rest of the line.
+func commentEnd(expr string, i int) int {
+	if end, ok := longBracketEnd(expr, i+2); ok {
+		return end
+	}
+	if n := strings.IndexByte(expr[i:], '\n'); n >= 0 {
+		return i + n
+	}
+	return len(expr)
+}
+
+// literalEnd returns the end of the string literal starting at i, or i+1
+// when none does.
+func literalEnd(expr string, i int) int {
+	if end, ok := longBracketEnd(expr, i); ok {
+		return end
+	}
+
+	quote := expr[i]
+	if quote != '\'' && quote != '"' {
+		return i + 1
+	}
+	for j := i + 1; j < len(expr); j++ {
+		switch expr[j] {
+		case '\\':
+			j++
+		case quote:
+			return j + 1
+		}
+	}
+	return len(expr)
+}
+
+// longBracketEnd returns the end of the long bracket, [[...]] or
+// [==[...]==], starting at i, if one does.
+func longBracketEnd(expr string, i int) (int, bool) {
+	if i >= len(expr) || expr[i] != '[' {
+		return 0, false
+	}
+	level := 0
+	for i+1+level < len(expr) && expr[i+1+level] == '=' {
+		level++
+	}
+	if i+1+level >= len(expr) || expr[i+1+level] != '[' {
+		return 0, false
+	}
+
+	start := i + 2 + level
+	closing := "]" + strings.Repeat("=", level) + "]"
+	if n := strings.Index(expr[start:], closing); n >= 0 {
+		return start + n + len(closing), true
+	}
+	return len(expr), true
+}
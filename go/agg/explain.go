@@ -0,0 +1,312 @@
+package agg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	aero "github.com/aerospike/aerospike-client-go"
+)
+
+// IndexFilter is a secondary index predicate pushed into the statement of
+// a query.
+type IndexFilter struct {
+	Bin string
+
+	// Value selects the records whose bin equals it, an integer or a
+	// string. When nil, Begin and End select a range of integers.
+	Value interface{}
+
+	Begin, End int64
+}
+
+func (f *IndexFilter) validate() error {
+	if f.Bin == "" {
+		return fmt.Errorf("index filter with no bin")
+	}
+
+	switch f.Value.(type) {
+	case nil, int, int64, string:
+	default:
+		return fmt.Errorf("index filter on `%s` must be an integer or a string, not %T", f.Bin, f.Value)
+	}
+
+	if f.Value == nil && f.Begin > f.End {
+		return fmt.Errorf("index filter on `%s` has an empty range", f.Bin)
+	}
+	return nil
+}
+
+func (f *IndexFilter) filter() *aero.Filter {
+	if f.Value != nil {
+		return aero.NewEqualFilter(f.Bin, f.Value)
+	}
+	return aero.NewRangeFilter(f.Bin, f.Begin, f.End)
+}
+
+// String returns the filter in SQL syntax.
+func (f *IndexFilter) String() string {
+	switch v := f.Value.(type) {
+	case nil:
+		return fmt.Sprintf("%s BETWEEN %d AND %d", f.Bin, f.Begin, f.End)
+	case string:
+		return fmt.Sprintf("%s = '%s'", f.Bin, strings.Replace(v, "'", "''", -1))
+	default:
+		return fmt.Sprintf("%s = %v", f.Bin, v)
+	}
+}
+
+var (
+	recRef = regexp.MustCompile(`\brec\b`)
+	binRef = regexp.MustCompile(`\brec\s*(?:\[\s*'([^'\\]*)'\s*\]|\[\s*"([^"\\]*)"\s*\]|\.([A-Za-z_][A-Za-z0-9_]*))`)
+)
+
+// Bins returns the bins the query reads, sorted. ok is false when an
+// expression accesses the record other than with a literal bin name, e.g.
+// rec[name], in which case all bins are read.
+func (q *Query) Bins() (bins []string, ok bool) {
+	seen := map[string]bool{}
+
+	for _, f := range q.Fields {
+		if !f.IsAggregate() {
+			seen[f.Bin] = true
+		}
+	}
+
+	for _, g := range q.GroupBy {
+		if g.Expr == "" {
+			// group by entries are read from the record first
+			seen[g.Alias] = true
+		}
+	}
+
+	for _, c := range q.LuaChunks() {
+		refs := binRef.FindAllStringSubmatch(c.Code, -1)
+		if len(refs) != len(recRef.FindAllStringIndex(c.Code, -1)) {
+			return nil, false
+		}
+
+		for _, ref := range refs {
+			seen[ref[1]+ref[2]+ref[3]] = true
+		}
+	}
+
+	bins = make([]string, 0, len(seen))
+	for bin := range seen {
+		bins = append(bins, bin)
+	}
+	sort.Strings(bins)
+	return bins, true
+}
+
+// Locations of the steps of a plan.
+const (
+	OnServer = "server"
+	OnClient = "client"
+)
+
+// Step is a stage of the execution of a query.
+type Step struct {
+	Location    string `json:"location"`
+	Description string `json:"description"`
+}
+
+// Plan describes how a query runs.
+type Plan struct {
+	Namespace string                 `json:"namespace"`
+	Set       string                 `json:"set"`
+	Sets      []string               `json:"sets,omitempty"`
+	Payload   map[string]interface{} `json:"payload"`
+	Chunks    []LuaChunk             `json:"lua"`
+
+	// Index is the predicate pushed into the statement, nil for a scan.
+	Index *IndexFilter `json:"-"`
+
+	// Bins are the bins projected by the statement; nil when all bins are read.
+	Bins []string `json:"bins"`
+
+	Steps []Step `json:"steps"`
+}
+
+// Explain returns the plan of the query, without running it.
+func (q *Query) Explain() *Plan {
+	p := &Plan{
+		Namespace: q.Namespace,
+		Set:       q.Set,
+		Sets:      q.Sets,
+		Payload:   q.Payload(),
+		Chunks:    q.LuaChunks(),
+		Index:     q.Index,
+	}
+
+	if bins, ok := q.Bins(); ok && len(bins) > 0 {
+		p.Bins = bins
+	}
+
+	source := q.Namespace
+	if q.Set != "" {
+		source += "." + q.Set
+	}
+	if len(q.Sets) > 0 {
+		sets := make([]string, len(q.Sets))
+		for i, set := range q.Sets {
+			ns, name := q.splitSource(set)
+			sets[i] = Source{Namespace: ns, Set: name}.String()
+		}
+		source = strings.Join(sets, ", ")
+	}
+
+	add := func(location, format string, args ...interface{}) {
+		p.Steps = append(p.Steps, Step{Location: location, Description: fmt.Sprintf(format, args...)})
+	}
+
+	for _, j := range q.Joins {
+		bins := "all bins"
+		if len(j.Bins) > 0 {
+			bins = "bins " + strings.Join(j.bins(), ", ")
+		}
+		add(OnClient, "read %s of %s.%s as dim[%s], keyed by %s, shipped in the payload", bins, j.namespace(q), j.Set, luaString(j.Name), j.Key)
+	}
+
+	if q.Index != nil {
+		add(OnServer, "secondary index lookup on %s where %s", source, q.Index)
+	} else {
+		add(OnServer, "scan of %s", source)
+	}
+
+	if p.Bins != nil {
+		add(OnServer, "read bins %s", strings.Join(p.Bins, ", "))
+	} else {
+		add(OnServer, "read all bins")
+	}
+
+	if q.Filter != "" {
+		add(OnServer, "filter records: %s", q.Filter)
+	}
+
+	var aggregates, filters int
+	for _, f := range q.Fields {
+		if f.IsAggregate() {
+			aggregates++
+			if f.Filter != "" {
+				filters++
+			}
+		}
+	}
+
+	mapStep := fmt.Sprintf("map records: %d aggregate expressions", aggregates)
+	if filters > 0 {
+		mapStep += fmt.Sprintf(", %d with a filter", filters)
+	}
+	if len(q.GroupBy) > 0 {
+		mapStep += ", grouped by " + strings.Join(q.groupAliases(), ", ")
+	}
+	if len(q.GroupingSets) > 0 {
+		mapStep += fmt.Sprintf(" over %d grouping sets", len(q.GroupingSets))
+	}
+	add(OnServer, "%s", mapStep)
+
+	limit := ""
+	switch {
+	case q.MaxGroups < 0:
+	case q.Others:
+		limit = fmt.Sprintf(", groups over %d accumulated into others", effectiveMaxGroups(q.MaxGroups))
+	default:
+		limit = fmt.Sprintf(", failing over %d groups", effectiveMaxGroups(q.MaxGroups))
+	}
+
+	add(OnServer, "reduce the groups of each node%s", limit)
+	switch {
+	case len(q.Sets) == 0:
+		add(OnClient, "reduce the groups of all nodes with the local %s.lua%s", UDFModule, limit)
+	case q.SourceColumn != "":
+		add(OnClient, "reduce the groups of all nodes of each set in Go, returning the set as %s%s", q.SourceColumn, limit)
+	default:
+		add(OnClient, "reduce the groups of all nodes of all sets in Go%s", limit)
+	}
+
+	for _, f := range q.Fields {
+		if f.Func == FuncCount {
+			add(OnClient, "set the counts of groups with no counted records to 0")
+			break
+		}
+	}
+
+	return p
+}
+
+func effectiveMaxGroups(maxGroups int) int {
+	if maxGroups == 0 {
+		return DefaultMaxGroups
+	}
+	return maxGroups
+}
+
+// MarshalJSON encodes the plan with its index filter in SQL syntax.
+func (p *Plan) MarshalJSON() ([]byte, error) {
+	type plan Plan
+
+	var index *string
+	if p.Index != nil {
+		s := p.Index.String()
+		index = &s
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(struct {
+		*plan
+		Index *string `json:"index"`
+	}{(*plan)(p), index})
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), err
+}
+
+// String returns the plan as text.
+func (p *Plan) String() string {
+	var b strings.Builder
+
+	if len(p.Sets) > 0 {
+		fmt.Fprintf(&b, "namespace: %s\nsets: %s\n", p.Namespace, strings.Join(p.Sets, ", "))
+	} else {
+		fmt.Fprintf(&b, "namespace: %s\nset: %s\n", p.Namespace, p.Set)
+	}
+
+	if p.Index != nil {
+		fmt.Fprintf(&b, "index: %s\n", p.Index)
+	} else {
+		b.WriteString("index: none, full scan\n")
+	}
+
+	if p.Bins != nil {
+		fmt.Fprintf(&b, "bins: %s\n", strings.Join(p.Bins, ", "))
+	} else {
+		b.WriteString("bins: all\n")
+	}
+
+	b.WriteString("\nsteps:\n")
+	for i, s := range p.Steps {
+		fmt.Fprintf(&b, "  %d. [%s] %s\n", i+1, s.Location, s.Description)
+	}
+
+	var payload bytes.Buffer
+	enc := json.NewEncoder(&payload)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(p.Payload); err != nil {
+		fmt.Fprintf(&payload, "%v\n", err)
+	}
+	fmt.Fprintf(&b, "\npayload:\n%s", payload.String())
+
+	if len(p.Chunks) > 0 {
+		b.WriteString("\nlua:\n")
+		for _, c := range p.Chunks {
+			fmt.Fprintf(&b, "-- %s\n%s\n", c.Name, c.Code)
+		}
+	}
+
+	return b.String()
+}
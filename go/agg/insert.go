@@ -0,0 +1,268 @@
+package agg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	aero "github.com/aerospike/aerospike-client-go"
+)
+
+// Insert modes, how the records of groups already written are updated.
+const (
+	// InsertUpsert creates the records, or updates their bins; bins of the
+	// groups without a value are kept.
+	InsertUpsert = "upsert"
+
+	// InsertReplace creates or replaces the records.
+	InsertReplace = "replace"
+)
+
+// DefaultInsertConcurrency is the number of groups an Insert writes at the
+// same time by default.
+const DefaultInsertConcurrency = 100
+
+// maxBinNameLength is the longest bin name the server accepts.
+const maxBinNameLength = 14
+
+// Insert writes the groups of a query as the records of a set, like
+// INSERT INTO set SELECT. Records are keyed by the values of their group,
+// see Query.GroupKey, so running it again updates the same records.
+type Insert struct {
+	Query *Query
+
+	// Namespace and Set are where the records are written. Namespace is
+	// the query's when empty.
+	Namespace string
+	Set       string
+
+	// Mode is InsertUpsert or InsertReplace, InsertUpsert when empty.
+	Mode string
+
+	// TTL is the time to live of the records: 0 for the namespace's
+	// default, less than 0 for never.
+	TTL time.Duration
+
+	// Concurrency is the number of groups written at the same time, each
+	// by its own Put as the client has no batch writes,
+	// DefaultInsertConcurrency when 0.
+	Concurrency int
+
+	// WritePolicy is the base policy of the writes, nil for the client's
+	// default. Its record exists action and expiration are set from Mode
+	// and TTL.
+	WritePolicy *aero.WritePolicy
+}
+
+// NewInsert returns an upsert of the groups of q into namespace.set.
+func NewInsert(q *Query, namespace, set string) *Insert {
+	return &Insert{Query: q, Namespace: namespace, Set: set}
+}
+
+// WithMode sets the insert mode.
+func (ins *Insert) WithMode(mode string) *Insert {
+	ins.Mode = mode
+	return ins
+}
+
+// WithTTL sets the time to live of the records.
+func (ins *Insert) WithTTL(ttl time.Duration) *Insert {
+	ins.TTL = ttl
+	return ins
+}
+
+// WithConcurrency sets the number of groups written at the same time.
+func (ins *Insert) WithConcurrency(n int) *Insert {
+	ins.Concurrency = n
+	return ins
+}
+
+// Validate checks the target, the mode and that the columns of the query
+// are valid bin names and key the records.
+func (ins *Insert) Validate() error {
+	if err := ins.Query.Validate(); err != nil {
+		return err
+	}
+
+	if ins.Set == "" {
+		return fmt.Errorf("insert has no target set")
+	}
+	switch ins.Mode {
+	case "", InsertUpsert, InsertReplace:
+	default:
+		return fmt.Errorf("unknown insert mode `%s`, expected `%s` or `%s`", ins.Mode, InsertUpsert, InsertReplace)
+	}
+	if ins.Concurrency < 0 {
+		return fmt.Errorf("insert concurrency must be positive")
+	}
+
+	columns := map[string]bool{}
+	for _, col := range ins.Query.ColumnNames() {
+		if len(col) > maxBinNameLength {
+			return fmt.Errorf("column `%s` is longer than a bin name can be (%d characters), give it a shorter alias", col, maxBinNameLength)
+		}
+		columns[col] = true
+	}
+
+	// rows only hold the group values of the bins selected
+	for _, g := range ins.Query.GroupBy {
+		if g.Expr == "" && !columns[g.Alias] {
+			return fmt.Errorf("group by `%s` must be selected to key the records", g.Alias)
+		}
+	}
+
+	return nil
+}
+
+// Execute runs the query and writes its groups. It returns the number of
+// records written.
+func (ins *Insert) Execute(client *aero.Client) (int, error) {
+	return ins.ExecuteContext(context.Background(), client)
+}
+
+// ExecuteContext is Execute, stopping when ctx is done. Groups written
+// before an error are not removed.
+func (ins *Insert) ExecuteContext(ctx context.Context, client *aero.Client) (int, error) {
+	if err := ins.Validate(); err != nil {
+		return 0, err
+	}
+
+	rows, err := ins.Query.ExecuteContext(ctx, client)
+	if err != nil {
+		return 0, err
+	}
+
+	namespace := ins.Namespace
+	if namespace == "" {
+		namespace = ins.Query.Namespace
+	}
+	policy := ins.writePolicy()
+
+	concurrency := ins.Concurrency
+	if concurrency == 0 {
+		concurrency = DefaultInsertConcurrency
+	}
+
+	var (
+		mu       sync.Mutex
+		written  int
+		firstErr error
+	)
+
+	for start := 0; start < len(rows); start += concurrency {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		end := start + concurrency
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var wg sync.WaitGroup
+		for _, row := range rows[start:end] {
+			wg.Add(1)
+			go func(row Row) {
+				defer wg.Done()
+
+				err := ins.write(client, policy, namespace, row)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if err == nil {
+					written++
+				}
+			}(row)
+		}
+		wg.Wait()
+
+		if firstErr != nil {
+			return written, firstErr
+		}
+	}
+
+	return written, nil
+}
+
+func (ins *Insert) write(client *aero.Client, policy *aero.WritePolicy, namespace string, row Row) error {
+	key, err := aero.NewKey(namespace, ins.Set, ins.Query.GroupKey(row))
+	if err != nil {
+		return err
+	}
+
+	bins := make(aero.BinMap, len(row))
+	for k, v := range row {
+		if v != nil {
+			bins[k] = v
+		}
+	}
+
+	return client.Put(policy, key, bins)
+}
+
+// writePolicy returns a copy of the write policy, with the record exists
+// action and expiration of the insert.
+func (ins *Insert) writePolicy() *aero.WritePolicy {
+	policy := aero.NewWritePolicy(0, 0)
+	if ins.WritePolicy != nil {
+		p := *ins.WritePolicy
+		policy = &p
+	}
+
+	policy.RecordExistsAction = aero.UPDATE
+	if ins.Mode == InsertReplace {
+		policy.RecordExistsAction = aero.REPLACE
+	}
+
+	switch {
+	case ins.TTL < 0:
+		policy.Expiration = math.MaxUint32
+	case ins.TTL > 0:
+		policy.Expiration = uint32(math.Ceil(ins.TTL.Seconds()))
+	default:
+		policy.Expiration = 0
+	}
+
+	// keeps the group key in the records, for the services reading them
+	policy.SendKey = true
+	return policy
+}
+
+// GroupKey returns the key of the group of row: the JSON array of its group
+// values in group by order, preceded by the grouping id when the query has
+// grouping sets, and by its set when the query has a source column.
+// Rolled up values are null. The row accumulating the
+// groups over max_groups is keyed "__others", followed by ":" and its
+// grouping id with grouping sets.
+func (q *Query) GroupKey(row Row) string {
+	if row.IsOthers() {
+		if len(q.GroupingSets) > 0 {
+			return fmt.Sprintf("%s:%d", OthersColumn, row.Grouping())
+		}
+		return OthersColumn
+	}
+
+	values := make([]interface{}, 0, len(q.GroupBy)+2)
+	if q.SourceColumn != "" {
+		values = append(values, row[q.SourceColumn])
+	}
+	if len(q.GroupingSets) > 0 {
+		values = append(values, row.Grouping())
+	}
+	for _, g := range q.GroupBy {
+		values = append(values, row[g.Alias])
+	}
+
+	key, err := json.Marshal(values)
+	if err != nil {
+		// group values are numbers and strings
+		return fmt.Sprint(values)
+	}
+	return string(key)
+}
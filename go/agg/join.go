@@ -0,0 +1,254 @@
+package agg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	aero "github.com/aerospike/aerospike-client-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Default size limits of the lookup map of a join, shipped to the UDF on
+// every node in the payload.
+const (
+	DefaultJoinMaxRecords = 10000
+	DefaultJoinMaxBytes   = 1 << 20
+)
+
+// Join is a broadcast join of a small set, the dimension: its records are
+// read in full when the query runs, and shipped to the UDF in the payload,
+// keyed by their Key bin. Expressions look them up by the name of the
+// join, e.g. dim['dept'][rec['dept_id']]['name']. A key with no record
+// returns an empty record, so its bins are nil, like in a left join.
+type Join struct {
+	// Name is the name of the lookup map in dim.
+	Name string
+
+	// Namespace is the namespace of Set, that of the query when empty.
+	Namespace string
+	Set       string
+
+	// Key is the bin the records are keyed by, an integer or a string.
+	// Records without it are not shipped.
+	Key string
+
+	// Bins are the bins shipped, along with Key; all of them when empty.
+	Bins []string
+
+	// MaxRecords and MaxBytes limit the size of the lookup map; 0 applies
+	// the defaults and a negative value removes the limit.
+	MaxRecords int
+	MaxBytes   int
+}
+
+// JoinTooLargeError is returned by queries which join a set over the size
+// limits of the join.
+type JoinTooLargeError struct {
+	Join string
+
+	// MaxRecords or MaxBytes is the limit exceeded, the other is 0.
+	MaxRecords int
+	MaxBytes   int
+}
+
+func (e *JoinTooLargeError) Error() string {
+	if e.MaxRecords > 0 {
+		return fmt.Sprintf("join `%s` has more than %d records; raise its MaxRecords, or ship fewer bins", e.Join, e.MaxRecords)
+	}
+	return fmt.Sprintf("join `%s` is more than %d bytes; raise its MaxBytes, or ship fewer bins", e.Join, e.MaxBytes)
+}
+
+// Join looks the records of set up as dim[name], keyed by their key bin.
+// set is "set", in the namespace of the query, or "namespace.set". Only
+// bins are shipped, along with key, when any are given.
+func (q *Query) Join(name, set, key string, bins ...string) *Query {
+	ns, set := q.splitSource(set)
+	q.Joins = append(q.Joins, Join{Name: name, Namespace: ns, Set: set, Key: key, Bins: bins})
+	return q
+}
+
+func (j *Join) namespace(q *Query) string {
+	if j.Namespace != "" {
+		return j.Namespace
+	}
+	return q.Namespace
+}
+
+// bins returns the bins read, nil for all of them.
+func (j *Join) bins() []string {
+	if len(j.Bins) == 0 {
+		return nil
+	}
+	for _, bin := range j.Bins {
+		if bin == j.Key {
+			return j.Bins
+		}
+	}
+	return append([]string{j.Key}, j.Bins...)
+}
+
+func (j *Join) limits() (maxRecords, maxBytes int) {
+	maxRecords, maxBytes = j.MaxRecords, j.MaxBytes
+	if maxRecords == 0 {
+		maxRecords = DefaultJoinMaxRecords
+	}
+	if maxBytes == 0 {
+		maxBytes = DefaultJoinMaxBytes
+	}
+	return maxRecords, maxBytes
+}
+
+func (q *Query) validateJoins() error {
+	names := make(map[string]bool, len(q.Joins))
+	for _, j := range q.Joins {
+		switch {
+		case j.Name == "":
+			return fmt.Errorf("join with no name")
+		case names[j.Name]:
+			return fmt.Errorf("duplicate join `%s`", j.Name)
+		case j.Set == "":
+			return fmt.Errorf("join `%s` has no set", j.Name)
+		case j.namespace(q) == "":
+			return fmt.Errorf("join `%s` has no namespace", j.Name)
+		case j.Key == "":
+			return fmt.Errorf("join `%s` has no key bin", j.Name)
+		}
+		names[j.Name] = true
+	}
+	return nil
+}
+
+// scanFunc calls fn with the bins of the records of namespace.set, reading
+// only bins when not nil, until fn returns an error.
+type scanFunc func(ctx context.Context, namespace, set string, bins []string, fn func(aero.BinMap) error) error
+
+// withDims returns a copy of q shipping the lookup maps of its joins, read
+// with scan, or q when it has none.
+func (q *Query) withDims(ctx context.Context, scan scanFunc) (*Query, error) {
+	if len(q.Joins) == 0 {
+		return q, nil
+	}
+
+	dims := make(map[string]interface{}, len(q.Joins))
+	for i := range q.Joins {
+		table, err := q.Joins[i].load(ctx, q, scan)
+		if err != nil {
+			return nil, err
+		}
+		dims[q.Joins[i].Name] = table
+	}
+
+	res := *q
+	res.dims = dims
+	return &res, nil
+}
+
+// load reads the lookup map of the join, enforcing its size limits.
+func (j *Join) load(ctx context.Context, q *Query, scan scanFunc) (table map[interface{}]interface{}, err error) {
+	ns := j.namespace(q)
+	_, span := tracer().Start(ctx, "agg.join", trace.WithAttributes(
+		AttrJoin.String(j.Name),
+		AttrNamespace.String(ns),
+		AttrSet.String(j.Set),
+	))
+	defer func() { endSpan(span, err) }()
+
+	maxRecords, maxBytes := j.limits()
+	bins := j.bins()
+
+	table = map[interface{}]interface{}{}
+	err = scan(ctx, ns, j.Set, bins, func(rec aero.BinMap) error {
+		key, ok := joinKey(rec[j.Key])
+		if !ok {
+			return fmt.Errorf("key `%s` of join `%s` must be an integer or a string, not %T", j.Key, j.Name, rec[j.Key])
+		}
+		if key == nil {
+			return nil
+		}
+		if _, exists := table[key]; exists {
+			return fmt.Errorf("join `%s` has several records with key %v", j.Name, key)
+		}
+		if maxRecords > 0 && len(table) >= maxRecords {
+			return &JoinTooLargeError{Join: j.Name, MaxRecords: maxRecords}
+		}
+
+		value := make(map[string]interface{}, len(rec))
+		for bin, v := range rec {
+			if bins == nil || contains(bins, bin) {
+				value[bin] = v
+			}
+		}
+		table[key] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := aero.NewMapValue(table).EstimateSize()
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(AttrRecords.Int(len(table)), AttrBytes.Int(size))
+	if maxBytes > 0 && size > maxBytes {
+		return nil, &JoinTooLargeError{Join: j.Name, MaxBytes: maxBytes}
+	}
+	return table, nil
+}
+
+// joinKey returns the key of a record of a join, integers being int64, or
+// nil when it has none. ok is false for other types.
+func joinKey(v interface{}) (key interface{}, ok bool) {
+	switch v := v.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return v, true
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	}
+	return nil, false
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// clusterScan reads the records of the cluster, for the joins.
+func clusterScan(client *aero.Client) scanFunc {
+	return func(ctx context.Context, namespace, set string, bins []string, fn func(aero.BinMap) error) error {
+		start := time.Now()
+		rs, err := client.ScanAll(nil, namespace, set, bins...)
+		if err != nil {
+			return err
+		}
+		defer rs.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return &CanceledError{Err: ctx.Err(), Progress: Progress{Rows: []Row{}, Elapsed: time.Since(start)}}
+			case res, ok := <-rs.Results():
+				if !ok {
+					return nil
+				}
+				if res.Err != nil {
+					return res.Err
+				}
+				if err := fn(res.Record.Bins); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
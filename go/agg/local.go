@@ -0,0 +1,447 @@
+package agg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	aero "github.com/aerospike/aerospike-client-go"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// localPrelude provides the modules of the server aggAPI.lua uses: map and
+// list, built on tables, and streams recording their operations.
+const localPrelude = `
+local MapMeta, ListMeta = {}, {}
+
+map = setmetatable({}, {__call = function() return setmetatable({}, MapMeta) end})
+map.pairs = pairs
+map.size = function(m)
+  local n = 0
+  for _ in pairs(m) do n = n + 1 end
+  return n
+end
+
+list = setmetatable({}, {__call = function(_, t) return setmetatable(t or {}, ListMeta) end})
+list.size = function(l) return #l end
+list.iterator = function(l)
+  local i = 0
+  return function() i = i + 1 return l[i] end
+end
+list.append = function(l, v) table.insert(l, v) end
+list.drop = function(l, n)
+  local res = list()
+  for i = n + 1, #l do table.insert(res, l[i]) end
+  return res
+end
+
+__map_meta, __list_meta = MapMeta, ListMeta
+
+local Stream = {}
+Stream.__index = Stream
+function Stream:filter(f) table.insert(self.ops, {"filter", f}) return self end
+function Stream:map(f) table.insert(self.ops, {"map", f}) return self end
+function Stream:reduce(f) table.insert(self.ops, {"reduce", f}) return self end
+
+function __stream() return setmetatable({ops = {}}, Stream) end
+
+-- __run passes a record through the operations of stream, and reduces it
+-- into acc
+function __run(stream, acc, rec)
+  local v = rec
+  for _, op in ipairs(stream.ops) do
+    if op[1] == "filter" then
+      if not op[2](v) then return acc end
+    elseif op[1] == "map" then
+      v = op[2](v)
+    elseif acc == nil then
+      return v
+    else
+      return op[2](acc, v)
+    end
+  end
+  return acc
+end
+`
+
+// localCheckEvery is the number of records between two checks of the
+// context of a local aggregation.
+const localCheckEvery = 1000
+
+// Local runs aggregations in process, over records held in memory: it runs
+// the stream UDF of aggAPI.lua with an embedded Lua interpreter, as a
+// single node would, so queries return the same rows as on a cluster. It
+// is meant for tests and development, and does not apply index filters.
+type Local struct {
+	// the prelude and the UDF are compiled once, and run in a new state by
+	// every aggregation
+	prelude, proto *lua.FunctionProto
+
+	mu   sync.RWMutex
+	sets map[string][]aero.BinMap // records by namespace and set
+}
+
+// NewLocal returns an empty in process backend running udf, the source of
+// aggAPI.lua.
+func NewLocal(udf []byte) (*Local, error) {
+	chunk, err := parse.Parse(bytes.NewReader(udf), UDFModule+".lua")
+	if err != nil {
+		return nil, fmt.Errorf("syntax error in %s.lua: %v", UDFModule, err)
+	}
+
+	proto, err := lua.Compile(chunk, UDFModule+".lua")
+	if err != nil {
+		return nil, err
+	}
+
+	chunk, err = parse.Parse(strings.NewReader(localPrelude), "prelude.lua")
+	if err != nil {
+		return nil, err
+	}
+	prelude, err := lua.Compile(chunk, "prelude.lua")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Local{prelude: prelude, proto: proto, sets: map[string][]aero.BinMap{}}, nil
+}
+
+// Put adds a record to namespace.set.
+func (l *Local) Put(namespace, set string, bins aero.BinMap) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k := localSet(namespace, set)
+	l.sets[k] = append(l.sets[k], bins)
+}
+
+// Truncate removes the records of namespace.set, or of the whole
+// namespace when set is empty.
+func (l *Local) Truncate(namespace, set string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if set != "" {
+		delete(l.sets, localSet(namespace, set))
+		return
+	}
+	for k := range l.sets {
+		if strings.HasPrefix(k, namespace+".") {
+			delete(l.sets, k)
+		}
+	}
+}
+
+// Sets returns the sets holding records, as namespace.set, sorted.
+func (l *Local) Sets() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	sets := make([]string, 0, len(l.sets))
+	for k := range l.sets {
+		sets = append(sets, k)
+	}
+	sort.Strings(sets)
+	return sets
+}
+
+// Execute validates and runs q over the records of its set, or of its
+// sets, their globs matching the sets holding records. The sets it joins
+// are read from the records held too.
+func (l *Local) Execute(ctx context.Context, q *Query) ([]Row, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if q.Index != nil {
+		return nil, fmt.Errorf("local aggregations do not apply index filters")
+	}
+
+	q, err := q.withDims(ctx, l.scan)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []Row
+	if len(q.Sets) > 0 {
+		rows, err = l.executeUnion(ctx, q)
+	} else {
+		rows, err = l.Aggregate(ctx, q.Namespace, q.Set, q.Payload())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q.fillCounts(rows)
+	return rows, nil
+}
+
+// Aggregate is AggregateContext, over the records of nsName.setName.
+func (l *Local) Aggregate(ctx context.Context, nsName, setName string, payload map[string]interface{}) ([]Row, error) {
+	payload, maxGroups := withMaxGroups(payload)
+
+	start := time.Now()
+	ctx, span := startQuerySpan(ctx, nsName, setName, payload)
+	var rows []Row
+	groups, err := l.aggregate(ctx, nsName, setName, payload)
+	if err == nil {
+		m := newMerger(payload, maxGroups)
+		if err = m.merge(groups); err == nil {
+			rows = m.rows()
+		}
+	}
+	endQuerySpan(span, rows, err)
+	logQuery(ctx, nsName, setName, payload, start, rows, err)
+	return rows, err
+}
+
+// scan reads the records of namespace.set, for the joins.
+func (l *Local) scan(ctx context.Context, namespace, set string, bins []string, fn func(aero.BinMap) error) error {
+	l.mu.RLock()
+	recs := l.sets[localSet(namespace, set)]
+	l.mu.RUnlock()
+
+	for _, rec := range recs {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// executeUnion runs the union of q over the sets holding records.
+func (l *Local) executeUnion(ctx context.Context, q *Query) ([]Row, error) {
+	known := map[Source]bool{}
+	for _, set := range l.Sets() {
+		if ns, name := q.splitSource(set); name != "" {
+			known[Source{Namespace: ns, Set: name}] = true
+		}
+	}
+
+	sources, err := q.Sources(sortedSources(known))
+	if err != nil {
+		return nil, err
+	}
+
+	return q.aggregateUnion(ctx, sources, func(ctx context.Context, src Source, payload map[string]interface{}) (map[string]Row, error) {
+		return l.aggregate(ctx, src.Namespace, src.Set, payload)
+	})
+}
+
+// aggregate returns the groups of the aggregation by key.
+func (l *Local) aggregate(ctx context.Context, nsName, setName string, payload map[string]interface{}) (map[string]Row, error) {
+	start := time.Now()
+	canceled := func() error {
+		return &CanceledError{Err: ctx.Err(), Progress: Progress{Rows: []Row{}, Elapsed: time.Since(start)}}
+	}
+	if ctx.Err() != nil {
+		return nil, canceled()
+	}
+
+	payload, _ = withMaxGroups(payload)
+	if payload["on_max_groups"] == "others" {
+		// cut by the merger of the groups
+		payload = withoutMaxGroups(payload)
+	}
+
+	l.mu.RLock()
+	recs := l.sets[localSet(nsName, setName)]
+	l.mu.RUnlock()
+
+	L := lua.NewState()
+	defer L.Close()
+
+	L.PreloadModule("bit", loadBit)
+	for _, proto := range []*lua.FunctionProto{l.prelude, l.proto} {
+		L.Push(L.NewFunctionFromProto(proto))
+		if err := L.PCall(0, lua.MultRet, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	stream, err := call(L, L.GetGlobal("__stream"))
+	if err != nil {
+		return nil, err
+	}
+	stream, err = call(L, L.GetGlobal(UDFFunction), stream, toLua(L, payload))
+	if err != nil {
+		return nil, err
+	}
+
+	run := L.GetGlobal("__run")
+	acc := lua.LValue(lua.LNil)
+	for i, rec := range recs {
+		if i%localCheckEvery == 0 && ctx.Err() != nil {
+			return nil, canceled()
+		}
+
+		acc, err = call(L, run, stream, acc, toLua(L, map[string]interface{}(rec)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := groupsError(fromLua(L, acc)); err != nil {
+		return nil, err
+	}
+
+	_, decode := tracer().Start(ctx, "agg.decode", trace.WithAttributes(AttrRecords.Int(len(recs))))
+	groups := decodeKeyedGroups(fromLua(L, acc))
+	if groups == nil {
+		groups = map[string]Row{}
+	}
+	decode.SetAttributes(AttrGroups.Int(len(groups)))
+	decode.End()
+	return groups, nil
+}
+
+// call calls fn with args and returns its result.
+func call(L *lua.LState, fn lua.LValue, args ...lua.LValue) (lua.LValue, error) {
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args...); err != nil {
+		return nil, err
+	}
+	res := L.Get(-1)
+	L.Pop(1)
+	return res, nil
+}
+
+// loadBit loads the bit module of LuaJIT, which the server provides and
+// aggAPI.lua hashes group keys with; its pure Lua fallback is slow.
+func loadBit(L *lua.LState) int {
+	fold := func(op func(a, b int32) int32) lua.LGFunction {
+		return func(L *lua.LState) int {
+			res := toBit(L.CheckNumber(1))
+			for i := 2; i <= L.GetTop(); i++ {
+				res = op(res, toBit(L.CheckNumber(i)))
+			}
+			L.Push(lua.LNumber(res))
+			return 1
+		}
+	}
+	shift := func(op func(a uint32, n uint) uint32) lua.LGFunction {
+		return func(L *lua.LState) int {
+			a, n := toBit(L.CheckNumber(1)), toBit(L.CheckNumber(2))
+			L.Push(lua.LNumber(int32(op(uint32(a), uint(n&31)))))
+			return 1
+		}
+	}
+
+	L.Push(L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"tobit": func(L *lua.LState) int {
+			L.Push(lua.LNumber(toBit(L.CheckNumber(1))))
+			return 1
+		},
+		"bnot": func(L *lua.LState) int {
+			L.Push(lua.LNumber(^toBit(L.CheckNumber(1))))
+			return 1
+		},
+		"bor":    fold(func(a, b int32) int32 { return a | b }),
+		"band":   fold(func(a, b int32) int32 { return a & b }),
+		"bxor":   fold(func(a, b int32) int32 { return a ^ b }),
+		"lshift": shift(func(a uint32, n uint) uint32 { return a << n }),
+		"rshift": shift(func(a uint32, n uint) uint32 { return a >> n }),
+	}))
+	return 1
+}
+
+// toBit converts n into a 32 bit integer like LuaJIT, modulo 2^32.
+func toBit(n lua.LNumber) int32 {
+	return int32(uint32(int64(math.Floor(float64(n)))))
+}
+
+func localSet(namespace, set string) string {
+	return namespace + "." + set
+}
+
+// toLua converts a value of a payload or a bin into Lua, maps and lists
+// being the map and list of the prelude.
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []byte:
+		return lua.LString(v)
+	case []interface{}:
+		t := L.NewTable()
+		for _, e := range v {
+			t.Append(toLua(L, e))
+		}
+		L.SetMetatable(t, L.GetGlobal("__list_meta"))
+		return t
+	case []string:
+		t := L.NewTable()
+		for _, e := range v {
+			t.Append(lua.LString(e))
+		}
+		L.SetMetatable(t, L.GetGlobal("__list_meta"))
+		return t
+	case map[string]interface{}:
+		t := L.NewTable()
+		for k, e := range v {
+			t.RawSetString(k, toLua(L, e))
+		}
+		L.SetMetatable(t, L.GetGlobal("__map_meta"))
+		return t
+	case map[interface{}]interface{}:
+		t := L.NewTable()
+		for k, e := range v {
+			t.RawSet(toLua(L, k), toLua(L, e))
+		}
+		L.SetMetatable(t, L.GetGlobal("__map_meta"))
+		return t
+	case map[string]string:
+		t := L.NewTable()
+		for k, e := range v {
+			t.RawSetString(k, lua.LString(e))
+		}
+		L.SetMetatable(t, L.GetGlobal("__map_meta"))
+		return t
+	default:
+		return lua.LString(fmt.Sprint(v))
+	}
+}
+
+// fromLua converts a Lua value into the values the client decodes results
+// into: lists are slices, other tables maps and numbers floats.
+func fromLua(L *lua.LState, v lua.LValue) interface{} {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		if L.GetMetatable(v) == L.GetGlobal("__list_meta") {
+			l := make([]interface{}, 0, v.Len())
+			for i := 1; i <= v.Len(); i++ {
+				l = append(l, fromLua(L, v.RawGetInt(i)))
+			}
+			return l
+		}
+
+		m := map[interface{}]interface{}{}
+		v.ForEach(func(k, e lua.LValue) {
+			m[fromLua(L, k)] = fromLua(L, e)
+		})
+		return m
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,66 @@
+package agg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// LuaChunk is a piece of Lua code select_agg_records compiles from the
+// payload.
+type LuaChunk struct {
+	// Name describes where the chunk comes from, e.g. `field "sum(age)"`.
+	Name string `json:"name"`
+
+	// Code is the chunk, as aggAPI.lua wraps it.
+	Code string `json:"code"`
+}
+
+// LuaChunks returns the Lua chunks the UDF compiles for the query, in the
+// same way aggAPI.lua wraps the expressions and filters.
+func (q *Query) LuaChunks() []LuaChunk {
+	var chunks []LuaChunk
+
+	if q.Filter != "" {
+		chunks = append(chunks, LuaChunk{Name: "filter", Code: filterChunk(q.Filter)})
+	}
+
+	for _, f := range q.Fields {
+		if !f.IsAggregate() {
+			continue
+		}
+
+		chunks = append(chunks, LuaChunk{Name: fmt.Sprintf("field %q", f.Alias), Code: exprChunk(f.Expr)})
+		if f.Filter != "" {
+			chunks = append(chunks, LuaChunk{Name: fmt.Sprintf("filter of field %q", f.Alias), Code: filterChunk(f.Filter)})
+		}
+	}
+
+	for _, g := range q.GroupBy {
+		if g.Expr != "" {
+			chunks = append(chunks, LuaChunk{Name: fmt.Sprintf("group by %q", g.Alias), Code: exprChunk(g.Expr)})
+		}
+	}
+
+	return chunks
+}
+
+// CheckSyntax parses the Lua chunks of the query, reporting the syntax
+// errors the UDF would otherwise only report on the server.
+func (q *Query) CheckSyntax() error {
+	for _, c := range q.LuaChunks() {
+		if _, err := parse.Parse(strings.NewReader(c.Code), c.Name); err != nil {
+			return fmt.Errorf("syntax error in %s: %v", c.Name, err)
+		}
+	}
+	return nil
+}
+
+func exprChunk(expr string) string {
+	return "result = " + expr
+}
+
+func filterChunk(filter string) string {
+	return "if (" + filter + ") then select_rec = true end"
+}
@@ -0,0 +1,512 @@
+package agg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	aero "github.com/aerospike/aerospike-client-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordsColumn counts the records each node aggregates in partial
+// aggregations. It is removed from the rows returned.
+const recordsColumn = "__records"
+
+// Partial is the aggregate of the records of one node, before the final
+// reduce.
+type Partial struct {
+	Node    string        // name of the node
+	Host    string        // address of the node
+	Source  string        // namespace.set the node aggregated
+	Records int64         // records the node aggregated
+	Rows    []Row         // groups of the node
+	Elapsed time.Duration // time from the start of the query to the node's result
+
+	Done  int // nodes done, this one included
+	Nodes int // nodes queried
+}
+
+// ExecutePartials is ExecuteContext, querying every node on its own. fn,
+// when not nil, is called with the partial aggregate of each node as it
+// arrives, from the calling goroutine; the final reduce runs in Go. In a
+// union, Done and Nodes count the nodes of the set of the partial.
+func (q *Query) ExecutePartials(ctx context.Context, client *aero.Client, fn func(*Partial)) ([]Row, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	q, err := q.withDims(ctx, clusterScan(client))
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []Row
+	if len(q.Sets) > 0 {
+		rows, err = q.executeUnion(ctx, client, fn)
+	} else {
+		rows, err = aggregatePartials(ctx, client, q.Policy, q.Statement(), q.Payload(), fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q.fillCounts(rows)
+	return rows, nil
+}
+
+// AggregatePartials is AggregateContext, calling fn with the partial
+// aggregate of each node like Query.ExecutePartials.
+func AggregatePartials(ctx context.Context, client *aero.Client, nsName, setName string, payload map[string]interface{}, fn func(*Partial)) ([]Row, error) {
+	return aggregatePartials(ctx, client, nil, aero.NewStatement(nsName, setName), payload, fn)
+}
+
+// nodeResult is the result of a node: its partial aggregate and its groups
+// by key, or the error it failed with.
+type nodeResult struct {
+	partial *Partial
+	groups  map[string]Row
+	err     error
+}
+
+func aggregatePartials(ctx context.Context, client *aero.Client, policy *aero.QueryPolicy, stm *aero.Statement, payload map[string]interface{}, fn func(*Partial)) ([]Row, error) {
+	payload, _ = withMaxGroups(payload)
+
+	start := time.Now()
+	ctx, span := startQuerySpan(ctx, stm.Namespace, stm.SetName, payload)
+
+	final, err := aggregateNodes(ctx, client, policy, stm, payload, fn)
+	if err != nil {
+		endQuerySpan(span, nil, err)
+		logQuery(ctx, stm.Namespace, stm.SetName, payload, start, nil, err)
+		return nil, err
+	}
+
+	_, finalize := tracer().Start(ctx, "agg.finalize")
+	rows := final.rows()
+	finalize.SetAttributes(AttrGroups.Int(len(rows)))
+	finalize.End()
+
+	endQuerySpan(span, rows, nil)
+	logQuery(ctx, stm.Namespace, stm.SetName, payload, start, rows, nil)
+	return rows, nil
+}
+
+// aggregateNodes runs the aggregation on every node, and returns their
+// groups merged.
+func aggregateNodes(ctx context.Context, client *aero.Client, policy *aero.QueryPolicy, stm *aero.Statement, payload map[string]interface{}, fn func(*Partial)) (*merger, error) {
+	start := time.Now()
+	if err := ctx.Err(); err != nil {
+		return nil, &CanceledError{Err: err, Progress: Progress{Rows: []Row{}}}
+	}
+
+	payload, maxGroups := withMaxGroups(payload)
+	payload = withRecordCount(payload)
+
+	nodes := client.GetNodes()
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("aggregation failed: the cluster has no nodes")
+	}
+
+	// the nodes return all their groups, cut by the mergers
+	nodePayload := payload
+	if payload["on_max_groups"] == "others" {
+		nodePayload = withoutMaxGroups(payload)
+	}
+	stm.SetAggregateFunction(UDFModule, UDFFunction, []aero.Value{aero.NewValue(nodePayload)}, true)
+	policy = contextPolicy(ctx, client, policy)
+
+	// closed on return, stopping the nodes still running
+	stop := make(chan struct{})
+	defer close(stop)
+
+	_, dispatch := tracer().Start(ctx, "agg.dispatch")
+	results := make(chan nodeResult, len(nodes))
+	for _, node := range nodes {
+		go func(node *aero.Node) {
+			results <- aggregateNode(ctx, stop, client, policy, node, stm, payload, maxGroups, start)
+		}(node)
+	}
+	dispatch.End()
+
+	final := newMerger(payload, maxGroups)
+	progress := Progress{Nodes: len(nodes)}
+	canceled := func() error {
+		progress.Records = final.records()
+		progress.Rows = final.rows()
+		progress.Elapsed = time.Since(start)
+		return &CanceledError{Err: ctx.Err(), Progress: progress}
+	}
+
+	for done := 1; done <= len(nodes); done++ {
+		select {
+		case <-ctx.Done():
+			return nil, canceled()
+
+		case res := <-results:
+			// fn may have canceled ctx while the next node was done
+			if ctx.Err() != nil {
+				return nil, canceled()
+			}
+			if res.err != nil {
+				return nil, res.err
+			}
+			if err := final.merge(res.groups); err != nil {
+				return nil, err
+			}
+
+			progress.Done = done
+			if fn != nil {
+				res.partial.Done = done
+				res.partial.Nodes = len(nodes)
+				fn(res.partial)
+			}
+		}
+	}
+
+	return final, nil
+}
+
+// aggregateNode runs the aggregation on node, until it is done or stop is
+// closed. ctx is the parent of its span.
+func aggregateNode(ctx context.Context, stop <-chan struct{}, client *aero.Client, policy *aero.QueryPolicy, node *aero.Node, stm *aero.Statement, payload map[string]interface{}, maxGroups int, start time.Time) (res nodeResult) {
+	ctx, span := tracer().Start(ctx, "agg.node", trace.WithAttributes(
+		AttrNode.String(node.GetName()),
+		AttrHost.String(node.GetHost().String()),
+	))
+	defer func() {
+		if res.partial != nil {
+			span.SetAttributes(AttrRecords.Int64(res.partial.Records), AttrGroups.Int(len(res.groups)))
+		}
+		endSpan(span, res.err)
+	}()
+
+	recordset, err := client.QueryNode(policy, node, stm)
+	if err != nil {
+		return nodeResult{err: err}
+	}
+	// Close waits for the command to the node to stop
+	defer recordset.Close()
+
+	m := newMerger(payload, maxGroups)
+	results := recordset.Results()
+	for {
+		select {
+		case <-stop:
+			return nodeResult{err: context.Canceled}
+
+		case result, ok := <-results:
+			if !ok {
+				partial := &Partial{
+					Node:    node.GetName(),
+					Host:    node.GetHost().String(),
+					Source:  Source{Namespace: stm.Namespace, Set: stm.SetName}.String(),
+					Records: m.records(),
+					Rows:    m.rows(),
+					Elapsed: time.Since(start),
+				}
+				return nodeResult{partial: partial, groups: m.groups}
+			}
+
+			if result.Err != nil {
+				return nodeResult{err: fmt.Errorf("node %s: %v", node.GetName(), result.Err)}
+			}
+
+			if err := groupsError(result.Record.Bins["SUCCESS"]); err != nil {
+				return nodeResult{err: err}
+			}
+
+			_, decode := tracer().Start(ctx, "agg.decode")
+			groups := decodeKeyedGroups(result.Record.Bins["SUCCESS"])
+			decode.SetAttributes(AttrGroups.Int(len(groups)))
+			decode.End()
+
+			if err := m.merge(groups); err != nil {
+				return nodeResult{err: err}
+			}
+		}
+	}
+}
+
+// withRecordCount returns payload with a count of the records aggregated.
+func withRecordCount(payload map[string]interface{}) map[string]interface{} {
+	fields, ok := payload["fields"].(map[string]interface{})
+	if !ok {
+		// left for the UDF to reject
+		return payload
+	}
+
+	res := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		res[k] = v
+	}
+
+	withCount := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		withCount[k] = v
+	}
+	withCount[recordsColumn] = map[string]string{"func": FuncCount, "expr": "1"}
+	res["fields"] = withCount
+
+	return res
+}
+
+// decodeKeyedGroups converts the map returned by select_agg_records into
+// rows by group key.
+func decodeKeyedGroups(v interface{}) map[string]Row {
+	groups, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+
+	res := make(map[string]Row, len(groups))
+	for k, group := range groups {
+		key, ok := k.(string)
+		if !ok {
+			continue
+		}
+		if row := decodeRow(group); row != nil {
+			res[key] = row
+		}
+	}
+
+	return res
+}
+
+// merger reduces groups by key like reduce_aggregates in aggAPI.lua, but
+// for the groups over maxGroups accumulated into others: it keeps them all,
+// and rows cuts them once they are merged.
+type merger struct {
+	funcs     map[string]string // aggregate functions by alias
+	maxGroups int
+	others    bool
+
+	groups map[string]Row
+	count  int // groups, the others rows excluded
+}
+
+func newMerger(payload map[string]interface{}, maxGroups int) *merger {
+	return &merger{
+		funcs:     fieldFuncs(payload),
+		maxGroups: maxGroups,
+		others:    payload["on_max_groups"] == "others",
+		groups:    map[string]Row{},
+	}
+}
+
+func (m *merger) merge(groups map[string]Row) error {
+	for key, row := range groups {
+		existing, exists := m.groups[key]
+		switch {
+		case exists:
+			m.groups[key] = m.accumulate(existing, row)
+		case m.maxGroups <= 0 || row.IsOthers():
+			m.groups[key] = row
+		case m.others || m.count < m.maxGroups:
+			m.groups[key] = row
+			m.count++
+		default:
+			return &TooManyGroupsError{MaxGroups: m.maxGroups}
+		}
+	}
+
+	return nil
+}
+
+// accumulate returns the aggregates of r1 and r2 combined. Other fields are
+// the same in both, or set in one only.
+func (m *merger) accumulate(r1, r2 Row) Row {
+	res := make(Row, len(r1))
+	for k, v := range r2 {
+		res[k] = v
+	}
+	for k, v := range r1 {
+		res[k] = v
+	}
+
+	for alias, fn := range m.funcs {
+		v1, ok1 := r1[alias]
+		v2, ok2 := r2[alias]
+		if ok1 && ok2 {
+			res[alias] = combine(fn, v1, v2)
+		}
+	}
+
+	return res
+}
+
+// toOthers returns the aggregates of row, to be accumulated into others.
+func (m *merger) toOthers(row Row) Row {
+	res := Row{OthersColumn: int64(1)}
+	for alias := range m.funcs {
+		if v, exists := row[alias]; exists {
+			res[alias] = v
+		}
+	}
+	if id, exists := row[GroupingIDColumn]; exists {
+		res[GroupingIDColumn] = id
+	}
+	return res
+}
+
+// records returns the number of records aggregated. Every record is
+// counted once in each grouping set.
+func (m *merger) records() int64 {
+	bySet := map[int64]int64{}
+	for _, row := range m.groups {
+		n, _ := toInt64(row[recordsColumn])
+		bySet[row.Grouping()] += n
+	}
+
+	var res int64
+	for _, n := range bySet {
+		if n > res {
+			res = n
+		}
+	}
+	return res
+}
+
+// cut returns the groups, those over maxGroups accumulated into others
+// when on_max_groups is "others". The groups kept are the first by key.
+func (m *merger) cut() map[string]Row {
+	if !m.others || m.maxGroups <= 0 || m.count <= m.maxGroups {
+		return m.groups
+	}
+
+	keys := make([]string, 0, m.count)
+	res := make(map[string]Row, m.maxGroups+1)
+	for key, row := range m.groups {
+		if row.IsOthers() {
+			res[key] = row
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for i, key := range keys {
+		row := m.groups[key]
+		if i < m.maxGroups {
+			res[key] = row
+			continue
+		}
+
+		othersKey := othersKey(row)
+		others := m.toOthers(row)
+		if existing, exists := res[othersKey]; exists {
+			others = m.accumulate(existing, others)
+		}
+		res[othersKey] = others
+	}
+
+	return res
+}
+
+// rows returns copies of the groups cut to maxGroups, without the record
+// count.
+func (m *merger) rows() []Row {
+	groups := m.cut()
+	res := make([]Row, 0, len(groups))
+	for _, row := range groups {
+		r := make(Row, len(row))
+		for k, v := range row {
+			if k != recordsColumn {
+				r[k] = v
+			}
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// othersKey is the key of the others row of the grouping set of row, the
+// same as in aggAPI.lua.
+func othersKey(row Row) string {
+	if id, exists := row[GroupingIDColumn]; exists {
+		return fmt.Sprintf("%s:%v", OthersColumn, id)
+	}
+	return OthersColumn + ":"
+}
+
+// fieldFuncs returns the aggregate functions of the fields of payload, by
+// alias.
+func fieldFuncs(payload map[string]interface{}) map[string]string {
+	res := map[string]string{}
+
+	fields, _ := payload["fields"].(map[string]interface{})
+	for alias, def := range fields {
+		switch def := def.(type) {
+		case map[string]string:
+			if def["func"] != "" {
+				res[alias] = def["func"]
+			}
+		case map[string]interface{}:
+			if fn, ok := def["func"].(string); ok {
+				res[alias] = fn
+			}
+		case map[interface{}]interface{}:
+			if fn, ok := def["func"].(string); ok {
+				res[alias] = fn
+			}
+		}
+	}
+
+	return res
+}
+
+// combine returns the aggregate fn of v1 and v2.
+func combine(fn string, v1, v2 interface{}) interface{} {
+	switch fn {
+	case FuncSum, FuncCount:
+		i1, ok1 := v1.(int64)
+		i2, ok2 := v2.(int64)
+		if ok1 && ok2 {
+			return i1 + i2
+		}
+		return decodeValue(toFloat64(v1) + toFloat64(v2))
+	case FuncMin:
+		if lessValue(v2, v1) {
+			return v2
+		}
+	case FuncMax:
+		if lessValue(v1, v2) {
+			return v2
+		}
+	}
+	return v1
+}
+
+// lessValue orders the values of min and max like less in aggAPI.lua:
+// numbers before strings, and values of the same type natively.
+func lessValue(v1, v2 interface{}) bool {
+	s1, str1 := v1.(string)
+	s2, str2 := v2.(string)
+	switch {
+	case str1 && str2:
+		return s1 < s2
+	case str1 || str2:
+		return str2
+	}
+
+	i1, ok1 := v1.(int64)
+	i2, ok2 := v2.(int64)
+	if ok1 && ok2 {
+		return i1 < i2
+	}
+	return toFloat64(v1) < toFloat64(v2)
+}
+
+func toFloat64(v interface{}) float64 {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,118 @@
+package agg
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ParsePayload parses a select_agg_records payload in JSON or YAML into a
+// query on namespace.set. The order of the fields in the document is kept
+// as the order of the columns.
+func ParsePayload(data []byte, namespace, set string) (*Query, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("empty payload")
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: payload must be a map", root.Line)
+	}
+
+	q := NewQuery(namespace, set)
+	for i := 0; i < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+
+		var err error
+		switch key.Value {
+		case "fields":
+			err = parseFields(q, value)
+		case "filter":
+			err = value.Decode(&q.Filter)
+		case "group_by_fields":
+			err = parseGroupBy(q, value)
+		case "grouping_sets":
+			err = value.Decode(&q.GroupingSets)
+		case "max_groups":
+			err = value.Decode(&q.MaxGroups)
+		case "on_max_groups":
+			var mode string
+			if err = value.Decode(&mode); err == nil {
+				switch mode {
+				case "error":
+				case "others":
+					q.Others = true
+				default:
+					err = fmt.Errorf("line %d: on_max_groups must be `error` or `others`", value.Line)
+				}
+			}
+		default:
+			err = fmt.Errorf("line %d: unknown payload key `%s`", key.Line, key.Value)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+func parseFields(q *Query, node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: fields must be a map", node.Line)
+	}
+
+	for i := 0; i < len(node.Content); i += 2 {
+		alias, def := node.Content[i].Value, node.Content[i+1]
+
+		switch def.Kind {
+		case yaml.ScalarNode:
+			q.Select(alias, def.Value)
+		case yaml.MappingNode:
+			var fd struct {
+				Func   string `yaml:"func"`
+				Expr   string `yaml:"expr"`
+				Filter string `yaml:"filter"`
+			}
+			if err := def.Decode(&fd); err != nil {
+				return err
+			}
+			q.AddField(Field{Alias: alias, Func: fd.Func, Expr: fd.Expr, Filter: fd.Filter})
+		default:
+			return fmt.Errorf("line %d: field `%s` must be a bin name or a map", def.Line, alias)
+		}
+	}
+
+	return nil
+}
+
+func parseGroupBy(q *Query, node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		return fmt.Errorf("line %d: group_by_fields must be a list", node.Line)
+	}
+
+	for _, entry := range node.Content {
+		switch entry.Kind {
+		case yaml.ScalarNode:
+			q.GroupByFields(entry.Value)
+		case yaml.MappingNode:
+			var g struct {
+				Alias string `yaml:"alias"`
+				Expr  string `yaml:"expr"`
+			}
+			if err := entry.Decode(&g); err != nil {
+				return err
+			}
+			q.GroupByExpr(g.Alias, g.Expr)
+		default:
+			return fmt.Errorf("line %d: group by entry must be a name or a map", entry.Line)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package agg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	aero "github.com/aerospike/aerospike-client-go"
+)
+
+// Names of the query policy presets.
+const (
+	// PolicyDefault is the policy of the client, with no total timeout.
+	PolicyDefault = "default"
+
+	// PolicyInteractive fails within 30 seconds, and when the cluster
+	// changes during the query, rather than returning aggregates missing
+	// or counting twice the records of migrating partitions.
+	PolicyInteractive = "interactive"
+
+	// PolicyBatch has no total timeout, allows nodes 10 minutes to
+	// aggregate their records, and retries with a backoff.
+	PolicyBatch = "batch"
+)
+
+// PolicyPresets returns the names of the query policy presets.
+func PolicyPresets() []string {
+	return []string{PolicyDefault, PolicyInteractive, PolicyBatch}
+}
+
+// NewPolicy returns a new query policy set to a preset.
+func NewPolicy(preset string) (*aero.QueryPolicy, error) {
+	policy := aero.NewQueryPolicy()
+
+	switch preset {
+	case PolicyDefault, "":
+	case PolicyInteractive:
+		policy.TotalTimeout = 30 * time.Second
+		policy.SocketTimeout = 30 * time.Second
+		policy.MaxRetries = 1
+		policy.SleepBetweenRetries = 100 * time.Millisecond
+		policy.FailOnClusterChange = true
+	case PolicyBatch:
+		policy.TotalTimeout = 0
+		policy.SocketTimeout = 10 * time.Minute
+		policy.MaxRetries = 3
+		policy.SleepBetweenRetries = time.Second
+		policy.SleepMultiplier = 2
+		policy.FailOnClusterChange = true
+	default:
+		return nil, fmt.Errorf("unknown policy preset `%s`, expected one of %v", preset, PolicyPresets())
+	}
+
+	return policy, nil
+}
+
+// contextPolicy returns policy when ctx has no deadline. Otherwise, it
+// returns a copy of policy, or of the default policy of the client when
+// nil, whose total timeout does not exceed the deadline.
+func contextPolicy(ctx context.Context, client *aero.Client, policy *aero.QueryPolicy) *aero.QueryPolicy {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return policy
+	}
+
+	var res aero.QueryPolicy
+	switch {
+	case policy != nil:
+		res = *policy
+	case client.DefaultQueryPolicy != nil:
+		res = *client.DefaultQueryPolicy
+	default:
+		res = *aero.NewQueryPolicy()
+	}
+
+	remaining := time.Until(deadline)
+	if remaining < time.Millisecond {
+		remaining = time.Millisecond
+	}
+
+	if res.TotalTimeout == 0 || remaining < res.TotalTimeout {
+		res.TotalTimeout = remaining
+	}
+	if res.SocketTimeout > res.TotalTimeout {
+		res.SocketTimeout = res.TotalTimeout
+	}
+
+	return &res
+}
@@ -0,0 +1,470 @@
+package agg
+
+import (
+	"context"
+	"fmt"
+
+	aero "github.com/aerospike/aerospike-client-go"
+)
+
+// Aggregate functions supported by aggAPI.lua.
+const (
+	FuncCount = "count"
+	FuncSum   = "sum"
+	FuncMin   = "min"
+	FuncMax   = "max"
+)
+
+// Field is a column returned by the aggregation.
+type Field struct {
+	// Alias is the name of the column in the results.
+	Alias string
+
+	// Bin is returned as is for fields without an aggregate function.
+	Bin string
+
+	// Func is the aggregate function, one of count, sum, min or max.
+	Func string
+
+	// Expr is the Lua expression the aggregate is calculated from.
+	Expr string
+
+	// Filter is an optional Lua boolean expression; only the records it
+	// selects are aggregated into this field.
+	Filter string
+}
+
+// IsAggregate reports whether the field is calculated by an aggregate function.
+func (f *Field) IsAggregate() bool {
+	return f.Func != ""
+}
+
+// GroupBy is an entry of the group by clause.
+type GroupBy struct {
+	// Alias is a field alias or bin name, or the name of the column the
+	// value of Expr is returned as.
+	Alias string
+
+	// Expr is an optional Lua expression to group by a computed value.
+	Expr string
+}
+
+// Query describes an aggregation and builds the select_agg_records payload.
+type Query struct {
+	Namespace string
+	Set       string
+
+	// Sets, when not empty, are the sets the records are aggregated from
+	// instead of Set, see FromSets. SourceColumn is the optional alias of
+	// the set of each group.
+	Sets         []string
+	SourceColumn string
+
+	Fields  []Field
+	Filter  string
+	GroupBy []GroupBy
+
+	// GroupingSets are subsets of the GroupBy aliases the records are
+	// aggregated over in the same scan. Rows are tagged with the grouping
+	// id of their set, see Row.Grouping.
+	GroupingSets [][]string
+
+	// Columns is the order of the columns in the results. When empty, the
+	// fields come first, followed by the group by expressions.
+	Columns []string
+
+	// Index is an optional secondary index predicate pushed into the
+	// statement, so only the records it selects are read. It requires an
+	// index on its bin, and Filter still applies to the records it selects.
+	Index *IndexFilter
+
+	// MaxGroups limits the number of groups the UDF accumulates; 0 applies
+	// DefaultMaxGroups and a negative value removes the limit.
+	MaxGroups int
+
+	// Others accumulates the groups over MaxGroups into rows for which
+	// Row.IsOthers is true, one per grouping set, instead of failing with a
+	// TooManyGroupsError. The nodes then return all their groups, which are
+	// cut once merged: the groups returned are whole, and the others are
+	// the groups last by key.
+	Others bool
+
+	// Joins are the sets looked up by the expressions, see Join.
+	Joins []Join
+
+	// Policy is the query policy, nil for the client's default. The total
+	// timeout is shortened to the deadline of the context, if any.
+	Policy *aero.QueryPolicy
+
+	// dims are the lookup maps of the joins, by name, once read.
+	dims map[string]interface{}
+}
+
+// NewQuery returns an empty query on namespace.set.
+func NewQuery(namespace, set string) *Query {
+	return &Query{Namespace: namespace, Set: set}
+}
+
+// AddField adds a field to the query.
+func (q *Query) AddField(f Field) *Query {
+	q.Fields = append(q.Fields, f)
+	return q
+}
+
+// Select returns the value of bin as alias.
+func (q *Query) Select(alias, bin string) *Query {
+	return q.AddField(Field{Alias: alias, Bin: bin})
+}
+
+// Count counts the records for which expr is not nil.
+func (q *Query) Count(alias, expr string) *Query {
+	return q.AddField(Field{Alias: alias, Func: FuncCount, Expr: expr})
+}
+
+// Sum adds up the values of expr.
+func (q *Query) Sum(alias, expr string) *Query {
+	return q.AddField(Field{Alias: alias, Func: FuncSum, Expr: expr})
+}
+
+// Min returns the smallest value of expr.
+func (q *Query) Min(alias, expr string) *Query {
+	return q.AddField(Field{Alias: alias, Func: FuncMin, Expr: expr})
+}
+
+// Max returns the largest value of expr.
+func (q *Query) Max(alias, expr string) *Query {
+	return q.AddField(Field{Alias: alias, Func: FuncMax, Expr: expr})
+}
+
+// Where sets the Lua boolean expression records are filtered by.
+func (q *Query) Where(filter string) *Query {
+	q.Filter = filter
+	return q
+}
+
+// WithMaxGroups limits the number of groups to n, see MaxGroups.
+func (q *Query) WithMaxGroups(n int) *Query {
+	q.MaxGroups = n
+	return q
+}
+
+// WithOthers accumulates the groups over the limit into others rows
+// instead of failing.
+func (q *Query) WithOthers() *Query {
+	q.Others = true
+	return q
+}
+
+// WithPolicy sets the query policy, e.g. one returned by NewPolicy.
+func (q *Query) WithPolicy(policy *aero.QueryPolicy) *Query {
+	q.Policy = policy
+	return q
+}
+
+// IndexEqual reads only the records whose bin equals value, an integer or
+// a string, through the secondary index on bin.
+func (q *Query) IndexEqual(bin string, value interface{}) *Query {
+	q.Index = &IndexFilter{Bin: bin, Value: value}
+	return q
+}
+
+// IndexRange reads only the records whose integer bin is between begin
+// and end inclusive, through the secondary index on bin.
+func (q *Query) IndexRange(bin string, begin, end int64) *Query {
+	q.Index = &IndexFilter{Bin: bin, Begin: begin, End: end}
+	return q
+}
+
+// GroupByFields groups the records by field aliases or bin names.
+func (q *Query) GroupByFields(aliases ...string) *Query {
+	for _, alias := range aliases {
+		q.GroupBy = append(q.GroupBy, GroupBy{Alias: alias})
+	}
+	return q
+}
+
+// GroupByExpr groups the records by the value of expr, returned as alias.
+func (q *Query) GroupByExpr(alias, expr string) *Query {
+	q.GroupBy = append(q.GroupBy, GroupBy{Alias: alias, Expr: expr})
+	return q
+}
+
+// WithGroupingSets aggregates the records over each of sets, the
+// equivalent of GROUP BY GROUPING SETS (...).
+func (q *Query) WithGroupingSets(sets ...[]string) *Query {
+	q.GroupingSets = sets
+	return q
+}
+
+// Rollup aggregates the records over every prefix of the group by
+// entries, down to the grand total; the equivalent of GROUP BY ROLLUP (...).
+func (q *Query) Rollup() *Query {
+	aliases := q.groupAliases()
+
+	q.GroupingSets = make([][]string, 0, len(aliases)+1)
+	for i := len(aliases); i >= 0; i-- {
+		q.GroupingSets = append(q.GroupingSets, aliases[:i:i])
+	}
+	return q
+}
+
+// Cube aggregates the records over every subset of the group by entries;
+// the equivalent of GROUP BY CUBE (...).
+func (q *Query) Cube() *Query {
+	aliases := q.groupAliases()
+	n := len(aliases)
+
+	// iterate the grouping ids, so the sets come in grouping id order
+	q.GroupingSets = make([][]string, 0, 1<<uint(n))
+	for id := 0; id < 1<<uint(n); id++ {
+		set := []string{}
+		for i, alias := range aliases {
+			if id&(1<<uint(n-1-i)) == 0 {
+				set = append(set, alias)
+			}
+		}
+		q.GroupingSets = append(q.GroupingSets, set)
+	}
+	return q
+}
+
+func (q *Query) groupAliases() []string {
+	aliases := make([]string, len(q.GroupBy))
+	for i, g := range q.GroupBy {
+		aliases[i] = g.Alias
+	}
+	return aliases
+}
+
+// ColumnNames returns the aliases of the columns in the results, in order.
+func (q *Query) ColumnNames() []string {
+	if len(q.Columns) > 0 {
+		return q.Columns
+	}
+
+	cols := make([]string, 0, len(q.Fields)+len(q.GroupBy)+1)
+	if q.SourceColumn != "" {
+		cols = append(cols, q.SourceColumn)
+	}
+	seen := make(map[string]bool, len(q.Fields))
+	for _, f := range q.Fields {
+		cols = append(cols, f.Alias)
+		seen[f.Alias] = true
+	}
+	for _, g := range q.GroupBy {
+		if g.Expr != "" && !seen[g.Alias] {
+			cols = append(cols, g.Alias)
+		}
+	}
+	return cols
+}
+
+// Field returns the field with the given alias, or nil.
+func (q *Query) Field(alias string) *Field {
+	for i := range q.Fields {
+		if q.Fields[i].Alias == alias {
+			return &q.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Validate checks the query for errors the UDF would not report.
+func (q *Query) Validate() error {
+	if len(q.Fields) == 0 {
+		return fmt.Errorf("no fields specified to return")
+	}
+
+	aliases := make(map[string]bool, len(q.Fields))
+	for _, f := range q.Fields {
+		if f.Alias == "" {
+			return fmt.Errorf("field with no alias")
+		}
+
+		if aliases[f.Alias] {
+			return fmt.Errorf("duplicate field alias `%s`", f.Alias)
+		}
+		aliases[f.Alias] = true
+
+		switch f.Func {
+		case "":
+			if f.Bin == "" {
+				return fmt.Errorf("field `%s` has neither a bin nor an aggregate function", f.Alias)
+			}
+			if f.Filter != "" {
+				return fmt.Errorf("field `%s` has a filter but no aggregate function", f.Alias)
+			}
+		case FuncCount, FuncSum, FuncMin, FuncMax:
+			if f.Expr == "" {
+				return fmt.Errorf("aggregate field `%s` has no expression", f.Alias)
+			}
+		default:
+			return fmt.Errorf("invalid aggregate function `%s` for field `%s`", f.Func, f.Alias)
+		}
+	}
+
+	groupAliases := make(map[string]bool, len(q.GroupBy))
+	for _, g := range q.GroupBy {
+		if g.Alias == "" {
+			return fmt.Errorf("group by entry with no alias")
+		}
+		groupAliases[g.Alias] = true
+	}
+
+	for _, set := range q.GroupingSets {
+		for _, alias := range set {
+			if !groupAliases[alias] {
+				return fmt.Errorf("grouping set member `%s` is not a group by entry", alias)
+			}
+		}
+	}
+
+	if q.Index != nil {
+		if err := q.Index.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := q.validateJoins(); err != nil {
+		return err
+	}
+
+	if len(q.Sets) > 0 && q.Set != "" {
+		return fmt.Errorf("query has both a set and sets")
+	}
+	for _, set := range q.Sets {
+		if set == "" {
+			return fmt.Errorf("empty set in the sets of the query")
+		}
+	}
+	if q.SourceColumn != "" {
+		if len(q.Sets) == 0 {
+			return fmt.Errorf("source column `%s` of a query on a single set", q.SourceColumn)
+		}
+		if aliases[q.SourceColumn] || groupAliases[q.SourceColumn] {
+			return fmt.Errorf("source column `%s` is also a field or a group by entry", q.SourceColumn)
+		}
+	}
+
+	return nil
+}
+
+// Payload returns the argument passed to select_agg_records.
+func (q *Query) Payload() map[string]interface{} {
+	fields := make(map[string]interface{}, len(q.Fields))
+	for _, f := range q.Fields {
+		if !f.IsAggregate() {
+			fields[f.Alias] = f.Bin
+			continue
+		}
+
+		def := map[string]string{"func": f.Func, "expr": f.Expr}
+		if f.Filter != "" {
+			def["filter"] = f.Filter
+		}
+		fields[f.Alias] = def
+	}
+
+	payload := map[string]interface{}{
+		"fields": fields,
+	}
+
+	if q.Filter != "" {
+		payload["filter"] = q.Filter
+	}
+
+	if len(q.GroupBy) > 0 {
+		groupBy := make([]interface{}, len(q.GroupBy))
+		for i, g := range q.GroupBy {
+			if g.Expr == "" {
+				groupBy[i] = g.Alias
+			} else {
+				groupBy[i] = map[string]string{"alias": g.Alias, "expr": g.Expr}
+			}
+		}
+		payload["group_by_fields"] = groupBy
+	}
+
+	if len(q.GroupingSets) > 0 {
+		sets := make([]interface{}, len(q.GroupingSets))
+		for i, set := range q.GroupingSets {
+			sets[i] = set
+		}
+		payload["grouping_sets"] = sets
+	}
+
+	if q.MaxGroups != 0 {
+		payload["max_groups"] = q.MaxGroups
+	}
+	if q.Others {
+		payload["on_max_groups"] = "others"
+	}
+	if q.dims != nil {
+		payload["dims"] = q.dims
+	}
+
+	return payload
+}
+
+// Execute validates and runs the query.
+func (q *Query) Execute(client *aero.Client) ([]Row, error) {
+	return q.ExecuteContext(context.Background(), client)
+}
+
+// ExecuteContext validates and runs the query, stopping when ctx is done
+// with a *CanceledError. The sets joined are read first.
+func (q *Query) ExecuteContext(ctx context.Context, client *aero.Client) ([]Row, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	q, err := q.withDims(ctx, clusterScan(client))
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []Row
+	if len(q.Sets) > 0 {
+		rows, err = q.executeUnion(ctx, client, nil)
+	} else {
+		rows, err = aggregate(ctx, client, q.Policy, q.Statement(), q.Payload())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q.fillCounts(rows)
+	return rows, nil
+}
+
+// Statement returns the statement the query runs, with its index filter
+// and the bins the query reads, when they are known. The sets of a union
+// each run the statement on them.
+func (q *Query) Statement() *aero.Statement {
+	return q.statement(q.Namespace, q.Set)
+}
+
+func (q *Query) statement(namespace, set string) *aero.Statement {
+	bins, _ := q.Bins()
+	stm := aero.NewStatement(namespace, set, bins...)
+	if q.Index != nil {
+		stm.SetFilter(q.Index.filter())
+	}
+	return stm
+}
+
+// fillCounts sets the counts the UDF returned no value for to 0, like SQL
+// does for groups in which no records were counted.
+func (q *Query) fillCounts(rows []Row) {
+	for _, f := range q.Fields {
+		if f.Func != FuncCount {
+			continue
+		}
+
+		for _, row := range rows {
+			if _, exists := row[f.Alias]; !exists {
+				row[f.Alias] = int64(0)
+			}
+		}
+	}
+}
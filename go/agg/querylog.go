@@ -0,0 +1,205 @@
+package agg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Outcomes of the aggregations in their QueryLog.
+const (
+	OutcomeOK            = "ok"
+	OutcomeCanceled      = "canceled"
+	OutcomeTooManyGroups = "too_many_groups"
+	OutcomeError         = "error"
+)
+
+// QueryLog is the record of an aggregation, given to the Log function of
+// the QueryLogOptions once it is done.
+type QueryLog struct {
+	Time      time.Time `json:"time"` // when it started
+	Caller    string    `json:"caller,omitempty"`
+	Namespace string    `json:"namespace"`
+	Set       string    `json:"set"`
+
+	// Payload is the normalized payload, its literals replaced with ? when
+	// redacted. Fingerprint is the agg.payload attribute of its span.
+	Payload     json.RawMessage `json:"payload"`
+	Fingerprint string          `json:"fingerprint"`
+
+	Duration time.Duration `json:"duration"`
+	Groups   int           `json:"groups"`
+	Slow     bool          `json:"slow,omitempty"`
+	Outcome  string        `json:"outcome"`
+	Err      string        `json:"error,omitempty"`
+}
+
+// QueryLogOptions set how the aggregations are logged.
+type QueryLogOptions struct {
+	// Log is called with the record of the aggregations, from the
+	// goroutines running them. No aggregation is logged when nil.
+	Log func(*QueryLog)
+
+	// SlowThreshold is the duration from which an aggregation is slow; none
+	// is when 0. With SlowOnly, only the slow and failed aggregations are
+	// logged.
+	SlowThreshold time.Duration
+	SlowOnly      bool
+
+	// Redact replaces the string and number literals of the expressions
+	// and filters of the payloads with ?, except the bin names of
+	// rec['name'].
+	Redact bool
+}
+
+var (
+	queryLogMu   sync.RWMutex
+	queryLogOpts QueryLogOptions
+)
+
+// SetQueryLog sets how the aggregations run by the package are logged,
+// those of Local included, for cost attribution and to find the slow
+// queries. The results returned by a Cache are not logged, only the
+// aggregations it runs.
+func SetQueryLog(opts QueryLogOptions) {
+	queryLogMu.Lock()
+	defer queryLogMu.Unlock()
+	queryLogOpts = opts
+}
+
+type callerKey struct{}
+
+// WithCaller returns a copy of ctx naming the caller of the aggregations
+// run with it, in their QueryLog.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFromContext returns the caller ctx names, if any.
+func CallerFromContext(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// NewJSONQueryLog returns a Log function writing the records to w, one
+// JSON object per line.
+func NewJSONQueryLog(w io.Writer) func(*QueryLog) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return func(ql *QueryLog) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(ql)
+	}
+}
+
+// logQuery logs the aggregation of payload on nsName.setName started at
+// start, returning rows or err.
+func logQuery(ctx context.Context, nsName, setName string, payload map[string]interface{}, start time.Time, rows []Row, err error) {
+	queryLogMu.RLock()
+	opts := queryLogOpts
+	queryLogMu.RUnlock()
+
+	if opts.Log == nil {
+		return
+	}
+
+	ql := &QueryLog{
+		Time:        start,
+		Caller:      CallerFromContext(ctx),
+		Namespace:   nsName,
+		Set:         setName,
+		Fingerprint: payloadFingerprint(payload),
+		Duration:    time.Since(start),
+		Groups:      len(rows),
+		Outcome:     OutcomeOK,
+	}
+	ql.Slow = opts.SlowThreshold > 0 && ql.Duration >= opts.SlowThreshold
+
+	if err != nil {
+		ql.Err = err.Error()
+
+		var canceled *CanceledError
+		var tooMany *TooManyGroupsError
+		switch {
+		case errors.As(err, &canceled):
+			ql.Outcome = OutcomeCanceled
+		case errors.As(err, &tooMany):
+			ql.Outcome = OutcomeTooManyGroups
+		default:
+			ql.Outcome = OutcomeError
+		}
+	}
+
+	if opts.SlowOnly && !ql.Slow && err == nil {
+		return
+	}
+
+	ql.Payload = logPayload(payload, opts.Redact)
+
+	opts.Log(ql)
+}
+
+// literal matches the bin names of rec['name'], kept by redactLua, and the
+// string and number literals of Lua, replaced. Long strings are not.
+var literal = regexp.MustCompile(`\brec\s*\[\s*(?:'[^'\\]*'|"[^"\\]*")\s*\]|'(?:[^'\\]|\\.)*'|"(?:[^"\\]|\\.)*"|\b0[xX][0-9a-fA-F]+\b|(?:\b\d+(?:\.\d*)?|\.\d+)(?:[eE][-+]?\d+)?\b`)
+
+// redactLua replaces the literals of the Lua code with ?.
+func redactLua(code string) string {
+	return literal.ReplaceAllStringFunc(code, func(lit string) string {
+		if lit[0] == 'r' {
+			return lit
+		}
+		return "?"
+	})
+}
+
+// logPayload returns the normalized payload, redacted, without escaping
+// the comparison operators of its expressions.
+func logPayload(payload map[string]interface{}, redact bool) json.RawMessage {
+	p, err := NormalizePayload(payload)
+	if err != nil {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(p, &v); err != nil {
+		return p
+	}
+	if redact {
+		v = redactPayload(v)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return p
+	}
+	return bytes.TrimSpace(buf.Bytes())
+}
+
+// redactPayload redacts the expressions and filters of the maps of v.
+func redactPayload(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if code, ok := e.(string); ok && (k == "expr" || k == "filter") {
+				v[k] = redactLua(code)
+			} else {
+				v[k] = redactPayload(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactPayload(e)
+		}
+	}
+	return v
+}
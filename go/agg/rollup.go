@@ -0,0 +1,457 @@
+package agg
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+
+	aero "github.com/aerospike/aerospike-client-go"
+)
+
+// RollupFunctions are the record UDFs accumulating records written into
+// a rollup: the first maps a record into its groups, the second
+// accumulates a group into its record.
+const (
+	RollupMapFunction = "map_agg_record"
+	RollupFunction    = "apply_agg_record"
+)
+
+// Bins of the group records, see apply_agg_record in aggAPI.lua.
+const (
+	rollupGroupsBin   = "agg_groups"
+	rollupChecksumBin = "agg_checksum"
+)
+
+// Rollup maintains the groups of a query incrementally, one record per
+// group: every record written is mapped into its groups by the
+// map_agg_record UDF, then each group is accumulated into its record by
+// apply_agg_record, with the same semantics as the reduce of an
+// aggregation, so reading a group takes a single read instead of a scan.
+//
+// The group records are keyed by the group keys of the UDF, see Key, in a
+// set of their own. Applying a record takes a round trip to map it, and one
+// per group, one per grouping set, to accumulate them. Records are
+// accumulated, not replaced: a record updated or deleted once applied stays
+// counted until the rollup is rebuilt.
+type Rollup struct {
+	Query *Query
+
+	// Namespace and Set are where the group records are stored.
+	Namespace string
+	Set       string
+
+	// WritePolicy is the policy of the writes to the rollup, nil for the
+	// client's default.
+	WritePolicy *aero.WritePolicy
+}
+
+// NewRollup returns a rollup of the groups of q, stored in namespace.set.
+func NewRollup(q *Query, namespace, set string) *Rollup {
+	return &Rollup{Query: q, Namespace: namespace, Set: set}
+}
+
+// ApplyError is the error of an Apply which accumulated only some of the
+// groups of a record, or none. Retry accumulates the others: each group
+// record remembers the last writes applied to it, so a group applied
+// again by Retry, e.g. after a timeout, is not counted twice.
+type ApplyError struct {
+	Err error
+
+	// Applied and Pending are the keys of the groups accumulated, and of
+	// those which may not be.
+	Applied []string
+	Pending []string
+
+	rollup   *Rollup
+	payload  map[string]interface{}
+	checksum string
+	write    string
+	groups   map[string]interface{}
+}
+
+func (e *ApplyError) Error() string {
+	return fmt.Sprintf("rollup applied %d of %d groups: %v", len(e.Applied), len(e.Applied)+len(e.Pending), e.Err)
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// Retry accumulates the pending groups, returning an ApplyError again
+// when some still are.
+func (e *ApplyError) Retry(client *aero.Client) error {
+	_, err := e.rollup.accumulate(client, e.payload, e.checksum, e.write, e.groups, e.Pending, e.Applied)
+	return err
+}
+
+// Apply accumulates a record written, its key and bins, into the rollup,
+// and returns the keys of its groups. The record is not read, its key only
+// spreads the mapping of the records over the cluster. Applying the same
+// bins to the same key again is a no-op while the group records remember
+// it, the last 32 writes of each group; when only some of the groups were
+// accumulated, the error is an *ApplyError.
+func (r *Rollup) Apply(client *aero.Client, key *aero.Key, bins aero.BinMap) ([]string, error) {
+	payload, checksum, err := r.payload()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(bins)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(append(key.Digest(), b...))
+	write := hex.EncodeToString(sum[:])
+
+	v, err := client.Execute(r.WritePolicy, key, UDFModule, RollupMapFunction,
+		aero.NewValue(payload), aero.NewValue(map[string]interface{}(bins)), aero.NewValue(checksum))
+	if err != nil {
+		return nil, err
+	}
+
+	mapped, _ := v.(map[interface{}]interface{})
+	groups := make(map[string]interface{}, len(mapped))
+	keys := make([]string, 0, len(mapped))
+	for k, group := range mapped {
+		if k, ok := k.(string); ok {
+			groups[k] = group
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return r.accumulate(client, payload, checksum, write, groups, keys, nil)
+}
+
+// accumulate applies the groups of keys, after those applied already.
+func (r *Rollup) accumulate(client *aero.Client, payload map[string]interface{}, checksum, write string, groups map[string]interface{}, keys, applied []string) ([]string, error) {
+	applied = append([]string{}, applied...)
+	for i, k := range keys {
+		groupKey, err := aero.NewKey(r.Namespace, r.Set, k)
+		if err == nil {
+			_, err = client.Execute(r.WritePolicy, groupKey, UDFModule, RollupFunction,
+				aero.NewValue(payload), aero.NewValue(k), aero.NewValue(groups[k]), aero.NewValue(checksum), aero.NewValue(write))
+		}
+		if err != nil {
+			return applied, &ApplyError{
+				Err:      err,
+				Applied:  applied,
+				Pending:  append([]string{}, keys[i:]...),
+				rollup:   r,
+				payload:  payload,
+				checksum: checksum,
+				write:    write,
+				groups:   groups,
+			}
+		}
+		applied = append(applied, k)
+	}
+	return applied, nil
+}
+
+// Key returns the key of the group of row, its group by values and its
+// grouping id, as map_agg_record computes it: the md5 of the values, in
+// the order of the group by entries. Lua writes non integral numbers with
+// 14 digits, which Key only matches for the values Go writes the same way.
+func (r *Rollup) Key(row Row) string {
+	h := md5.New()
+
+	aliases := r.Query.groupAliases()
+	members := make([]bool, len(aliases))
+	if len(r.Query.GroupingSets) > 0 {
+		id := row.Grouping()
+		fmt.Fprintf(h, "#%d:", id)
+		for i := range aliases {
+			// the first group by entry is the most significant bit
+			members[i] = id&(1<<uint(len(aliases)-1-i)) == 0
+		}
+	} else {
+		for i := range members {
+			members[i] = true
+		}
+	}
+
+	for i, alias := range aliases {
+		if members[i] {
+			v := luaToString(row[alias])
+			fmt.Fprintf(h, "%d%s", len(v), v)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// luaToString returns v as tostring returns it in Lua 5.1.
+func luaToString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	if !isNumber(v) {
+		return fmt.Sprint(v)
+	}
+	if n, ok := v.(int64); ok {
+		v = float64(n)
+	} else if n, ok := v.(int); ok {
+		v = float64(n)
+	}
+	return strconv.FormatFloat(v.(float64), 'g', 14, 64)
+}
+
+// Rows returns the groups of the rollup of keys, see Key, reading their
+// records in a batch. Groups without any record applied are not returned.
+func (r *Rollup) Rows(client *aero.Client, keys ...string) ([]Row, error) {
+	_, checksum, err := r.payload()
+	if err != nil {
+		return nil, err
+	}
+
+	recKeys := make([]*aero.Key, len(keys))
+	for i, k := range keys {
+		if recKeys[i], err = aero.NewKey(r.Namespace, r.Set, k); err != nil {
+			return nil, err
+		}
+	}
+
+	recs, err := client.BatchGet(nil, recKeys, rollupGroupsBin, rollupChecksumBin)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]Row, 0, len(keys))
+	for _, rec := range recs {
+		if rec == nil {
+			continue
+		}
+		if rec.Bins[rollupChecksumBin] != checksum {
+			return nil, fmt.Errorf("rollup %s.%s was built by another payload", r.Namespace, r.Set)
+		}
+		for _, row := range decodeKeyedGroups(rec.Bins[rollupGroupsBin]) {
+			rows = append(rows, row)
+		}
+	}
+
+	r.Query.fillCounts(rows)
+	return rows, nil
+}
+
+// Mismatch is a group whose aggregates in a rollup differ from a scan's.
+type Mismatch struct {
+	Key     string // key of the group
+	Stored  Row    // nil when the rollup does not have the group
+	Scanned Row    // nil when the scan did not return the group
+}
+
+// Reconciliation is the result of comparing a rollup with a scan.
+type Reconciliation struct {
+	Groups     int // groups scanned
+	Mismatches []Mismatch
+}
+
+// OK reports whether the rollup has the groups of the scan.
+func (rc *Reconciliation) OK() bool {
+	return len(rc.Mismatches) == 0
+}
+
+// Reconcile compares the group records of the rollup with a scan running
+// the query. Records written during the scan may show up as mismatches.
+func (r *Rollup) Reconcile(ctx context.Context, client *aero.Client) (*Reconciliation, error) {
+	payload, checksum, err := r.payload()
+	if err != nil {
+		return nil, err
+	}
+	return r.reconcile(ctx, client, payload, checksum)
+}
+
+// Rebuild replaces the group records of the rollup which differ from a
+// scan's, and deletes those the scan did not return. Records applied
+// during the scan may be missing from the groups, or counted twice.
+func (r *Rollup) Rebuild(ctx context.Context, client *aero.Client) error {
+	payload, checksum, err := r.payload()
+	if err != nil {
+		return err
+	}
+
+	rc, err := r.reconcile(ctx, client, payload, checksum)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range rc.Mismatches {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		key, err := aero.NewKey(r.Namespace, r.Set, m.Key)
+		if err != nil {
+			return err
+		}
+
+		if m.Scanned == nil {
+			_, err = client.Delete(r.WritePolicy, key)
+		} else {
+			err = client.Put(r.WritePolicy, key, aero.BinMap{
+				rollupGroupsBin:   map[string]interface{}{m.Key: map[string]interface{}(m.Scanned)},
+				rollupChecksumBin: checksum,
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Rollup) reconcile(ctx context.Context, client *aero.Client, payload map[string]interface{}, checksum string) (*Reconciliation, error) {
+	stored, err := r.groups(client, checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	scanned, err := r.scan(ctx, client, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(scanned))
+	for key := range scanned {
+		keys = append(keys, key)
+	}
+	for key := range stored {
+		if _, exists := scanned[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	rc := &Reconciliation{Groups: len(scanned)}
+	for _, key := range keys {
+		s, sc := stored[key], scanned[key]
+		if s == nil || sc == nil || !sameRow(s, sc) {
+			rc.Mismatches = append(rc.Mismatches, Mismatch{Key: key, Stored: s, Scanned: sc})
+		}
+	}
+
+	return rc, nil
+}
+
+// payload returns the payload of the rollup and its checksum.
+func (r *Rollup) payload() (map[string]interface{}, string, error) {
+	if err := r.Query.Validate(); err != nil {
+		return nil, "", err
+	}
+	if r.Query.Index != nil {
+		return nil, "", fmt.Errorf("rollups apply every record written, they cannot have an index filter")
+	}
+	if len(r.Query.Sets) > 0 {
+		return nil, "", fmt.Errorf("rollups are of the records of a single set, not of a union")
+	}
+	if len(r.Query.Joins) > 0 {
+		return nil, "", fmt.Errorf("rollups apply every record written, they cannot join sets which change independently")
+	}
+	if r.Query.MaxGroups > 0 || r.Query.Others {
+		return nil, "", fmt.Errorf("rollups store one record per group, they have no max_groups")
+	}
+
+	// not normalized: the order of the group by entries changes the keys
+	payload := r.Query.Payload()
+	delete(payload, "max_groups")
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sum := sha1.Sum(p)
+	return payload, hex.EncodeToString(sum[:]), nil
+}
+
+// groups scans the group records of the rollup, by group key, for
+// Reconcile and Rebuild.
+func (r *Rollup) groups(client *aero.Client, checksum string) (map[string]Row, error) {
+	recordset, err := client.ScanAll(nil, r.Namespace, r.Set, rollupGroupsBin, rollupChecksumBin)
+	if err != nil {
+		return nil, err
+	}
+	defer recordset.Close()
+
+	groups := map[string]Row{}
+	for res := range recordset.Results() {
+		if res.Err != nil {
+			return nil, res.Err
+		}
+
+		if res.Record.Bins[rollupChecksumBin] != checksum {
+			return nil, fmt.Errorf("rollup %s.%s was built by another payload", r.Namespace, r.Set)
+		}
+		for key, row := range decodeKeyedGroups(res.Record.Bins[rollupGroupsBin]) {
+			groups[key] = row
+		}
+	}
+	return groups, nil
+}
+
+// scan aggregates the records of the query by group key, without a limit
+// on the number of groups.
+func (r *Rollup) scan(ctx context.Context, client *aero.Client, payload map[string]interface{}) (map[string]Row, error) {
+	unlimited := make(map[string]interface{}, len(payload)+1)
+	for k, v := range payload {
+		unlimited[k] = v
+	}
+	unlimited["max_groups"] = -1
+
+	final, err := aggregateNodes(ctx, client, r.Query.Policy, r.Query.Statement(), unlimited, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range final.groups {
+		delete(row, recordsColumn)
+	}
+	return final.groups, nil
+}
+
+// sameRow reports whether r1 and r2 have the same values, numbers being
+// compared with a tolerance for the order floats were summed in.
+func sameRow(r1, r2 Row) bool {
+	if len(r1) != len(r2) {
+		return false
+	}
+
+	for k, v1 := range r1 {
+		v2, exists := r2[k]
+		if !exists || !sameValue(v1, v2) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameValue(v1, v2 interface{}) bool {
+	if !isNumber(v1) || !isNumber(v2) {
+		return reflect.DeepEqual(v1, v2)
+	}
+
+	f1, f2 := toFloat64(v1), toFloat64(v2)
+	return f1 == f2 || math.Abs(f1-f2) <= 1e-9*math.Max(math.Abs(f1), math.Abs(f2))
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int64, float64:
+		return true
+	}
+	return false
+}
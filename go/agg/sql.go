@@ -0,0 +1,1450 @@
+package agg
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ParseSQL compiles a SELECT statement into a query. args are bound to
+// the `?` placeholders of the statement, in order.
+//
+// The supported syntax is:
+//
+//	SELECT item [, item ...]
+//	FROM [namespace.]set [UNION ALL [namespace.]set ...]
+//	[[INNER | LEFT [OUTER]] JOIN [namespace.]set [[AS] alias] ON alias.key = expr ...]
+//	[WHERE condition]
+//	[GROUP BY expr [, expr ...] | ROLLUP (...) | CUBE (...) | GROUPING SETS ((...), ...)]
+//
+// where items are bins, expressions that also appear in the group by
+// clause, or count, sum, min and max aggregates with an optional
+// FILTER (WHERE condition). Columns are named after their alias, or the
+// text of the item. Expressions are evaluated in Lua, so division is
+// floating point; use floor() for integer division. % truncates, its sign
+// being that of the dividend, and x % 0 is NaN. LIKE ignores the case of
+// ASCII letters, like SQLite. A missing bin is NULL:
+// arithmetic and functions on NULL return NULL, and comparisons to it are
+// neither true nor false, so WHERE and FILTER skip the record.
+//
+// The records of the sets of a union are aggregated together, see
+// Query.FromSets; quoted names may be globs, like "events_2026_*", and
+// the sets without a namespace are in that of the first set with one.
+// SOURCE_SET() selects the set of each group, keeping the groups of
+// different sets apart.
+//
+// The sets joined are small sets read in full and shipped to the UDF, see
+// Query.Join: their bins are alias.bin, looked up by the key of the ON
+// clause, an expression of the records aggregated. A LEFT JOIN returns
+// NULL bins for the records with no match, which a JOIN filters out.
+func ParseSQL(sql string, args ...interface{}) (*Query, error) {
+	tokens, err := lex(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{sql: sql, tokens: tokens, args: args}
+	q, err := p.parseSelect()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.argIdx != len(args) {
+		return nil, fmt.Errorf("statement has %d placeholders, but %d arguments were passed", p.argIdx, len(args))
+	}
+
+	return q, nil
+}
+
+// ParseInsert compiles an INSERT INTO ... SELECT statement into an insert.
+// args are bound to the `?` placeholders of the statement, in order.
+//
+// The supported syntax is:
+//
+//	INSERT [OR REPLACE] INTO [namespace.]set
+//	SELECT ...
+//
+// INSERT upserts the records of the groups, INSERT OR REPLACE replaces
+// them. The select statement is the one of ParseSQL.
+func ParseInsert(sql string, args ...interface{}) (*Insert, error) {
+	tokens, err := lex(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{sql: sql, tokens: tokens, args: args}
+	ins, err := p.parseInsert()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.argIdx != len(args) {
+		return nil, fmt.Errorf("statement has %d placeholders, but %d arguments were passed", p.argIdx, len(args))
+	}
+
+	return ins, nil
+}
+
+// NumPlaceholders returns the number of `?` placeholders in sql.
+func NumPlaceholders(sql string) (int, error) {
+	tokens, err := lex(sql)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, t := range tokens {
+		if t.kind == tokPlaceholder {
+			n++
+		}
+	}
+	return n, nil
+}
+
+/****************************************************************************
+
+Lexer
+
+****************************************************************************/
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokQuotedIdent
+	tokNumber
+	tokString
+	tokOp
+	tokPlaceholder
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+	end  int
+}
+
+// is reports whether the token is the keyword or operator s.
+func (t token) is(s string) bool {
+	switch t.kind {
+	case tokIdent:
+		return strings.EqualFold(t.text, s)
+	case tokOp:
+		return t.text == s
+	}
+	return false
+}
+
+func lex(sql string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(sql) {
+		c := rune(sql[i])
+		start := i
+		switch {
+		case unicode.IsSpace(c):
+			i++
+			continue
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+			continue
+		case isIdentStart(c):
+			for i < len(sql) && isIdentPart(rune(sql[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: sql[start:i], pos: start, end: i})
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(sql) && sql[i+1] >= '0' && sql[i+1] <= '9':
+			for i < len(sql) && (sql[i] >= '0' && sql[i] <= '9' || sql[i] == '.' || sql[i] == 'e' || sql[i] == 'E' ||
+				(sql[i] == '-' || sql[i] == '+') && (sql[i-1] == 'e' || sql[i-1] == 'E')) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: sql[start:i], pos: start, end: i})
+		case c == '\'':
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(sql) {
+					return nil, fmt.Errorf("unterminated string at position %d", start)
+				}
+				if sql[i] == '\'' {
+					if i+1 < len(sql) && sql[i+1] == '\'' {
+						sb.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteByte(sql[i])
+				i++
+			}
+			tokens = append(tokens, token{kind: tokString, text: sb.String(), pos: start, end: i})
+		case c == '"' || c == '`':
+			end := strings.IndexByte(sql[i+1:], sql[i])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated identifier at position %d", start)
+			}
+			i += end + 2
+			tokens = append(tokens, token{kind: tokQuotedIdent, text: sql[start+1 : i-1], pos: start, end: i})
+		case c == '?':
+			i++
+			tokens = append(tokens, token{kind: tokPlaceholder, text: "?", pos: start, end: i})
+		default:
+			op := ""
+			for _, o := range []string{"<>", "!=", "<=", ">=", "||", "(", ")", ",", "*", "+", "-", "/", "%", "=", "<", ">", ".", ";"} {
+				if strings.HasPrefix(sql[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			i += len(op)
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: start, end: i})
+		}
+	}
+
+	// a trailing semicolon is allowed
+	if n := len(tokens); n > 0 && tokens[n-1].is(";") {
+		tokens = tokens[:n-1]
+	}
+
+	return append(tokens, token{kind: tokEOF, pos: len(sql), end: len(sql)}), nil
+}
+
+func isIdentStart(c rune) bool {
+	return c == '_' || unicode.IsLetter(c)
+}
+
+func isIdentPart(c rune) bool {
+	return isIdentStart(c) || unicode.IsDigit(c)
+}
+
+/****************************************************************************
+
+Parser
+
+****************************************************************************/
+
+var sqlAggregates = map[string]string{
+	"count": FuncCount,
+	"sum":   FuncSum,
+	"min":   FuncMin,
+	"max":   FuncMax,
+}
+
+// sqlFunctions maps the scalar SQL functions to their Lua equivalents.
+var sqlFunctions = map[string]string{
+	"lower":       "string.lower",
+	"upper":       "string.upper",
+	"length":      "string.len",
+	"substr":      "string.sub",
+	"abs":         "math.abs",
+	"floor":       "math.floor",
+	"ceil":        "math.ceil",
+	"time_bucket": "time_bucket",
+	"date_trunc":  "date_trunc",
+}
+
+var reservedWords = map[string]bool{
+	"select": true, "from": true, "where": true, "group": true, "by": true, "as": true,
+	"and": true, "or": true, "not": true, "filter": true, "order": true, "limit": true,
+	"having": true, "union": true, "join": true, "on": true,
+}
+
+// selectItem is a non aggregate item of the select list.
+type selectItem struct {
+	alias string
+	bin   string
+	expr  string
+}
+
+type parser struct {
+	sql    string
+	tokens []token
+	pos    int
+	args   []interface{}
+	argIdx int
+
+	// joins are the keys of the sets joined, by alias, and the bins of
+	// them expressions refer to
+	joins    map[string]string
+	joinBins map[string]map[string]bool
+
+	// joinFilters select the records with a match in the sets inner joined
+	joinFilters []string
+
+	// inJoin is set while parsing the ON clauses, parsed before the select
+	// list and so before its placeholders
+	inJoin bool
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) peekAt(n int) token {
+	if p.pos+n >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.pos+n]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(s string) bool {
+	if p.peek().is(s) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) error {
+	if !p.accept(s) {
+		return p.errorf("expected %s", strings.ToUpper(s))
+	}
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	t := p.peek()
+	near := "end of statement"
+	if t.kind != tokEOF {
+		near = strconv.Quote(p.sql[t.pos:t.end])
+	}
+	return fmt.Errorf("SQL error near %s (position %d): %s", near, t.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) parseSelect() (*Query, error) {
+	if err := p.expect("select"); err != nil {
+		return nil, err
+	}
+
+	q := &Query{}
+
+	// the FROM clause is parsed first, for the select list to refer to the
+	// sets joined
+	fromEnd := -1
+	if from := p.findFrom(); from >= 0 {
+		start := p.pos
+		p.pos = from + 1
+		if err := p.parseFrom(q); err != nil {
+			return nil, err
+		}
+		fromEnd, p.pos = p.pos, start
+	}
+
+	var items []selectItem
+	for {
+		if err := p.parseSelectItem(q, &items); err != nil {
+			return nil, err
+		}
+		if !p.accept(",") {
+			break
+		}
+	}
+
+	if err := p.expect("from"); err != nil {
+		return nil, err
+	}
+	if fromEnd >= 0 {
+		p.pos = fromEnd
+	} else if err := p.parseFrom(q); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if p.accept("where") {
+		if q.Filter, err = p.parseCond(); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.joinFilters) > 0 {
+		filters := p.joinFilters
+		if q.Filter != "" {
+			filters = append(filters, "("+q.Filter+")")
+		}
+		q.Filter = strings.Join(filters, " and ")
+	}
+
+	if p.peek().is("group") {
+		p.next()
+		if err := p.expect("by"); err != nil {
+			return nil, err
+		}
+		if err := p.parseGroupBy(q, items); err != nil {
+			return nil, err
+		}
+	}
+
+	if t := p.peek(); t.kind != tokEOF {
+		if t.is("order") || t.is("limit") || t.is("having") || t.is("union") {
+			return nil, p.errorf("%s is not supported", strings.ToUpper(t.text))
+		}
+		return nil, p.errorf("unexpected token")
+	}
+
+	// computed columns can only be returned as group by values
+	grouped := make(map[string]bool, len(q.GroupBy))
+	for _, g := range q.GroupBy {
+		grouped[g.Alias] = true
+	}
+	for _, item := range items {
+		if item.expr != "" && !grouped[item.alias] {
+			return nil, fmt.Errorf("column `%s` must be an aggregate or appear in the GROUP BY clause", item.alias)
+		}
+	}
+
+	// only the bins referred to are shipped
+	for i := range q.Joins {
+		j := &q.Joins[i]
+		bins := p.joinBins[j.Name]
+		bins[j.Key] = true
+		for bin := range bins {
+			j.Bins = append(j.Bins, bin)
+		}
+		sort.Strings(j.Bins)
+	}
+
+	return q, nil
+}
+
+// findFrom returns the position of the FROM keyword of the statement, out
+// of parentheses, or -1.
+func (p *parser) findFrom() int {
+	depth := 0
+	for i := p.pos; i < len(p.tokens); i++ {
+		switch t := p.tokens[i]; {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case depth == 0 && t.is("from"):
+			return i
+		}
+	}
+	return -1
+}
+
+// parseFrom parses the sets of the FROM clause, a set or a union of sets
+// which names may be globs, and the sets joined.
+func (p *parser) parseFrom(q *Query) error {
+	if err := p.parseSources(q); err != nil {
+		return err
+	}
+
+	for {
+		inner := true
+		switch {
+		case p.accept("join"):
+		case p.peek().is("inner") && p.peekAt(1).is("join"):
+			p.pos += 2
+		case p.peek().is("left"):
+			p.next()
+			p.accept("outer")
+			if err := p.expect("join"); err != nil {
+				return err
+			}
+			inner = false
+		default:
+			return nil
+		}
+
+		if err := p.parseJoin(q, inner); err != nil {
+			return err
+		}
+	}
+}
+
+// parseJoin parses a set joined: [namespace.]set [[AS] alias] ON
+// alias.key = expr, expr being an expression of the records aggregated.
+func (p *parser) parseJoin(q *Query, inner bool) error {
+	j := Join{}
+	name, err := p.parseName()
+	if err != nil {
+		return err
+	}
+	j.Set = name
+	if p.accept(".") {
+		if j.Set, err = p.parseName(); err != nil {
+			return err
+		}
+		j.Namespace = name
+	}
+
+	j.Name = j.Set
+	if p.accept("as") || !p.peek().is("on") {
+		if j.Name, err = p.parseName(); err != nil {
+			return err
+		}
+	}
+	if _, exists := p.joins[j.Name]; exists {
+		return p.errorf("`%s` is joined more than once", j.Name)
+	}
+
+	if err := p.expect("on"); err != nil {
+		return err
+	}
+
+	// either side of the equality may be the key of the set joined
+	p.inJoin = true
+	defer func() { p.inJoin = false }()
+
+	isKey := func() bool {
+		t := p.peek()
+		return (t.kind == tokIdent || t.kind == tokQuotedIdent) && t.text == j.Name && p.peekAt(1).is(".")
+	}
+	key := func() (string, error) {
+		if !isKey() {
+			return "", p.errorf("expected the key of `%s`, as %s.bin", j.Name, j.Name)
+		}
+		p.pos += 2
+		return p.parseName()
+	}
+
+	var expr string
+	if isKey() {
+		if j.Key, err = key(); err != nil {
+			return err
+		}
+		if err := p.expect("="); err != nil {
+			return err
+		}
+		if expr, err = p.parseKey(); err != nil {
+			return err
+		}
+	} else {
+		if expr, err = p.parseKey(); err != nil {
+			return err
+		}
+		if err := p.expect("="); err != nil {
+			return err
+		}
+		if j.Key, err = key(); err != nil {
+			return err
+		}
+	}
+
+	if p.joins == nil {
+		p.joins = map[string]string{}
+		p.joinBins = map[string]map[string]bool{}
+	}
+	p.joins[j.Name] = expr
+	p.joinBins[j.Name] = map[string]bool{}
+	q.Joins = append(q.Joins, j)
+
+	if inner {
+		p.joinFilters = append(p.joinFilters, dimRef(j.Name, expr, j.Key)+" ~= nil")
+	}
+	return nil
+}
+
+// parseKey parses the expression the records of a join are looked up by.
+func (p *parser) parseKey() (string, error) {
+	e, err := p.parseAdditive()
+	if err != nil {
+		return "", err
+	}
+	return e.value(), nil
+}
+
+// dimRef returns the Lua expression of bin of the record of the join name
+// looked up by key.
+func dimRef(name, key, bin string) string {
+	return "dim[" + luaString(name) + "][" + key + "][" + luaString(bin) + "]"
+}
+
+// parseDimRef parses the rest of alias.bin, when t is the alias of a set
+// joined, into the Lua expression of the bin.
+func (p *parser) parseDimRef(t token) (string, bool, error) {
+	key, ok := p.joins[t.text]
+	if !ok || !p.peek().is(".") {
+		return "", false, nil
+	}
+	p.next()
+	bin, err := p.parseName()
+	if err != nil {
+		return "", true, err
+	}
+	p.joinBins[t.text][bin] = true
+	return dimRef(t.text, key, bin), true, nil
+}
+
+// parseSources parses the sets the records are aggregated from.
+func (p *parser) parseSources(q *Query) error {
+	var sources []Source
+	for {
+		name, err := p.parseName()
+		if err != nil {
+			return err
+		}
+		src := Source{Set: name}
+		if p.accept(".") {
+			if src.Set, err = p.parseName(); err != nil {
+				return err
+			}
+			src.Namespace = name
+		}
+		sources = append(sources, src)
+
+		if !p.peek().is("union") {
+			break
+		}
+		p.next()
+		if !p.accept("all") {
+			return p.errorf("only UNION ALL of sets is supported")
+		}
+	}
+
+	if len(sources) == 1 && !isGlob(sources[0].Namespace) && !isGlob(sources[0].Set) {
+		q.Namespace, q.Set = sources[0].Namespace, sources[0].Set
+		return nil
+	}
+
+	// the sets without a namespace are in that of the first set with one
+	for _, src := range sources {
+		if src.Namespace == "" {
+			q.Sets = append(q.Sets, src.Set)
+			continue
+		}
+		q.Sets = append(q.Sets, src.String())
+		if q.Namespace == "" && !isGlob(src.Namespace) {
+			q.Namespace = src.Namespace
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseInsert() (*Insert, error) {
+	if err := p.expect("insert"); err != nil {
+		return nil, err
+	}
+
+	ins := &Insert{Mode: InsertUpsert}
+	if p.accept("or") {
+		if err := p.expect("replace"); err != nil {
+			return nil, err
+		}
+		ins.Mode = InsertReplace
+	}
+
+	if err := p.expect("into"); err != nil {
+		return nil, err
+	}
+	name, err := p.parseName()
+	if err != nil {
+		return nil, err
+	}
+	ins.Set = name
+	if p.accept(".") {
+		if ins.Set, err = p.parseName(); err != nil {
+			return nil, err
+		}
+		ins.Namespace = name
+	}
+
+	if ins.Query, err = p.parseSelect(); err != nil {
+		return nil, err
+	}
+	return ins, nil
+}
+
+func (p *parser) parseName() (string, error) {
+	t := p.next()
+	if t.kind == tokQuotedIdent || t.kind == tokIdent && !reservedWords[strings.ToLower(t.text)] {
+		return t.text, nil
+	}
+	p.pos--
+	return "", p.errorf("expected a name")
+}
+
+func (p *parser) parseSelectItem(q *Query, items *[]selectItem) error {
+	start := p.peek().pos
+
+	if p.isSourceSet() {
+		p.pos += 3
+		if !p.isItemEnd() {
+			return p.errorf("SOURCE_SET() can not be part of an expression")
+		}
+		alias, err := p.parseAlias(p.sql[start:p.tokens[p.pos-1].end])
+		if err != nil {
+			return err
+		}
+		if q.SourceColumn != "" {
+			return fmt.Errorf("SOURCE_SET() is selected more than once")
+		}
+		q.SourceColumn = alias
+		q.Columns = append(q.Columns, alias)
+		return nil
+	}
+
+	if fn, ok := sqlAggregates[strings.ToLower(p.peek().text)]; ok && p.peek().kind == tokIdent && p.peekAt(1).is("(") {
+		p.pos += 2
+		f := Field{Func: fn}
+
+		if p.accept("distinct") {
+			return p.errorf("DISTINCT aggregates are not supported")
+		}
+
+		if fn == FuncCount && p.accept("*") {
+			f.Expr = "1"
+		} else {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return err
+			}
+			f.Expr = expr
+			if fn == FuncCount {
+				// SQL counts the values which are not null
+				f.Expr = "(" + expr + ") ~= nil and 1 or nil"
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return err
+		}
+
+		if p.accept("filter") {
+			if err := p.expect("("); err != nil {
+				return err
+			}
+			if err := p.expect("where"); err != nil {
+				return err
+			}
+			filter, err := p.parseCond()
+			if err != nil {
+				return err
+			}
+			if err := p.expect(")"); err != nil {
+				return err
+			}
+			f.Filter = filter
+		}
+		text := p.sql[start:p.tokens[p.pos-1].end]
+
+		if !p.isItemEnd() {
+			return p.errorf("aggregates can not be part of an expression")
+		}
+
+		alias, err := p.parseAlias(text)
+		if err != nil {
+			return err
+		}
+		f.Alias = alias
+		q.AddField(f)
+		q.Columns = append(q.Columns, alias)
+		return nil
+	}
+
+	// a single bin is returned as is
+	if t := p.peek(); (t.kind == tokIdent || t.kind == tokQuotedIdent) && !p.peekAt(1).is("(") {
+		save := p.pos
+		p.next()
+		if p.isItemEnd() {
+			alias, err := p.parseAlias(t.text)
+			if err != nil {
+				return err
+			}
+			q.Select(alias, t.text)
+			q.Columns = append(q.Columns, alias)
+			*items = append(*items, selectItem{alias: alias, bin: t.text})
+			return nil
+		}
+		p.pos = save
+	}
+
+	expr, err := p.parseExpr()
+	if err != nil {
+		return err
+	}
+	text := p.sql[start:p.tokens[p.pos-1].end]
+	alias, err := p.parseAlias(text)
+	if err != nil {
+		return err
+	}
+	q.Columns = append(q.Columns, alias)
+	*items = append(*items, selectItem{alias: alias, expr: expr})
+	return nil
+}
+
+// isSourceSet reports whether the next tokens are SOURCE_SET(), the set of
+// the groups of a union.
+func (p *parser) isSourceSet() bool {
+	return p.peek().kind == tokIdent && p.peek().is("source_set") && p.peekAt(1).is("(") && p.peekAt(2).is(")")
+}
+
+func (p *parser) isItemEnd() bool {
+	t := p.peek()
+	return t.kind == tokEOF || t.is(",") || t.is("from") || t.is("as") || t.kind == tokQuotedIdent ||
+		t.kind == tokIdent && !reservedWords[strings.ToLower(t.text)]
+}
+
+func (p *parser) parseAlias(text string) (string, error) {
+	if p.accept("as") {
+		return p.parseName()
+	}
+	if t := p.peek(); t.kind == tokQuotedIdent || t.kind == tokIdent && !reservedWords[strings.ToLower(t.text)] {
+		return p.parseName()
+	}
+	return text, nil
+}
+
+func (p *parser) parseGroupBy(q *Query, items []selectItem) error {
+	// returns the alias of a group by element, adding it to the group by
+	// entries the first time it is seen; the groups of the sets of a union
+	// are kept apart without one, so SOURCE_SET() returns none
+	element := func() (string, error) {
+		start := p.peek().pos
+		single := (p.peek().kind == tokIdent || p.peek().kind == tokQuotedIdent) && !p.peekAt(1).is("(") && !p.peekAt(1).is(".")
+		name := p.peek().text
+
+		if p.isSourceSet() {
+			p.pos += 3
+			return "", nil
+		}
+		if single && q.SourceColumn != "" && name == q.SourceColumn && !p.peekAt(1).is(".") {
+			p.next()
+			return "", nil
+		}
+
+		expr, err := p.parseExpr()
+		if err != nil {
+			return "", err
+		}
+		text := p.sql[start:p.tokens[p.pos-1].end]
+
+		g := GroupBy{Alias: text, Expr: expr}
+		for _, item := range items {
+			if single && item.alias == name || item.expr == expr {
+				g = GroupBy{Alias: item.alias, Expr: item.expr}
+				break
+			}
+		}
+		if single && g.Expr == expr {
+			// a bin that is not selected
+			g = GroupBy{Alias: name}
+		}
+
+		for _, e := range q.GroupBy {
+			if e.Alias == g.Alias {
+				return g.Alias, nil
+			}
+		}
+		q.GroupBy = append(q.GroupBy, g)
+		return g.Alias, nil
+	}
+
+	list := func() ([]string, error) {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		set := []string{}
+		if p.accept(")") {
+			return set, nil
+		}
+		for {
+			alias, err := element()
+			if err != nil {
+				return nil, err
+			}
+			if alias != "" {
+				set = append(set, alias)
+			}
+			if !p.accept(",") {
+				break
+			}
+		}
+		return set, p.expect(")")
+	}
+
+	switch {
+	case p.peek().is("rollup") && p.peekAt(1).is("("):
+		p.next()
+		if _, err := list(); err != nil {
+			return err
+		}
+		q.Rollup()
+	case p.peek().is("cube") && p.peekAt(1).is("("):
+		p.next()
+		if _, err := list(); err != nil {
+			return err
+		}
+		q.Cube()
+	case p.peek().is("grouping") && p.peekAt(1).is("sets"):
+		p.pos += 2
+		if err := p.expect("("); err != nil {
+			return err
+		}
+		for {
+			var set []string
+			var err error
+			if p.peek().is("(") {
+				set, err = list()
+			} else {
+				var alias string
+				alias, err = element()
+				set = []string{}
+				if alias != "" {
+					set = append(set, alias)
+				}
+			}
+			if err != nil {
+				return err
+			}
+			q.GroupingSets = append(q.GroupingSets, set)
+			if !p.accept(",") {
+				break
+			}
+		}
+		return p.expect(")")
+	default:
+		for {
+			if _, err := element(); err != nil {
+				return err
+			}
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+/****************************************************************************
+
+Expressions, compiled to Lua
+
+****************************************************************************/
+
+// sqlExpr is an expression compiled to Lua. Lua raises an error comparing
+// nil or computing with it, where SQL returns NULL, so an expression keeps
+// the nullable values it is made of, bins and NULL, and is guarded by them
+// once where it is used rather than around every operator.
+type sqlExpr struct {
+	lua   string
+	nulls []string
+
+	// cond is set for conditions, compiled as the expressions true when
+	// the condition is TRUE and FALSE respectively: neither is when NULL
+	cond *sqlCond
+}
+
+type sqlCond struct {
+	isTrue, isFalse string
+	nullable        bool
+}
+
+func constant(lua string) sqlExpr {
+	return sqlExpr{lua: lua}
+}
+
+func nullable(lua string) sqlExpr {
+	return sqlExpr{lua: lua, nulls: []string{lua}}
+}
+
+// operand returns the Lua expression of e as the operand of an operator,
+// and the values which make it NULL.
+func (e sqlExpr) operand() (string, []string) {
+	if e.cond != nil {
+		return e.value(), nil
+	}
+	return e.lua, e.nulls
+}
+
+// value returns the Lua expression of e, nil when it is NULL.
+func (e sqlExpr) value() string {
+	if c := e.cond; c != nil {
+		if !c.nullable {
+			return c.isTrue
+		}
+		return "(" + c.isTrue + " or not " + c.isFalse + " and nil)"
+	}
+	if len(e.nulls) == 0 || len(e.nulls) == 1 && e.nulls[0] == e.lua {
+		return e.lua
+	}
+	return "(" + notNil(e.nulls) + " and " + e.lua + " or nil)"
+}
+
+// asCond returns e as a condition, the truth of its value otherwise.
+func (e sqlExpr) asCond() sqlCond {
+	if e.cond != nil {
+		return *e.cond
+	}
+	v := e.value()
+	return sqlCond{isTrue: v, isFalse: "(" + v + " == false)", nullable: len(e.nulls) > 0}
+}
+
+// comparison returns the condition cmp, NULL when any of nulls is nil.
+func comparison(cmp string, nulls []string) sqlExpr {
+	if len(nulls) == 0 {
+		return sqlExpr{cond: &sqlCond{isTrue: "(" + cmp + ")", isFalse: "not (" + cmp + ")"}}
+	}
+	guard := notNil(nulls)
+	return sqlExpr{cond: &sqlCond{
+		isTrue:   "(" + guard + " and " + cmp + ")",
+		isFalse:  "(" + guard + " and not (" + cmp + "))",
+		nullable: true,
+	}}
+}
+
+func notNil(nulls []string) string {
+	checks := make([]string, len(nulls))
+	for i, n := range nulls {
+		checks[i] = n + " ~= nil"
+	}
+	return strings.Join(checks, " and ")
+}
+
+// mergeNulls returns the nullable values of all the lists, once.
+func mergeNulls(lists ...[]string) []string {
+	var res []string
+	for _, list := range lists {
+		for _, n := range list {
+			if !contains(res, n) {
+				res = append(res, n)
+			}
+		}
+	}
+	return res
+}
+
+// parseExpr parses an expression, returning its value.
+func (p *parser) parseExpr() (string, error) {
+	e, err := p.parseOr()
+	if err != nil {
+		return "", err
+	}
+	return e.value(), nil
+}
+
+// parseCond parses a condition, returning the Lua expression true when it
+// is TRUE, as WHERE selects the records.
+func (p *parser) parseCond() (string, error) {
+	e, err := p.parseOr()
+	if err != nil {
+		return "", err
+	}
+	return e.asCond().isTrue, nil
+}
+
+func (p *parser) parseOr() (sqlExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return sqlExpr{}, err
+	}
+	for p.accept("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return sqlExpr{}, err
+		}
+		l, r := left.asCond(), right.asCond()
+		left = sqlExpr{cond: &sqlCond{
+			isTrue:   "(" + l.isTrue + " or " + r.isTrue + ")",
+			isFalse:  "(" + l.isFalse + " and " + r.isFalse + ")",
+			nullable: l.nullable || r.nullable,
+		}}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (sqlExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return sqlExpr{}, err
+	}
+	for p.accept("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return sqlExpr{}, err
+		}
+		l, r := left.asCond(), right.asCond()
+		left = sqlExpr{cond: &sqlCond{
+			isTrue:   l.isTrue + " and " + r.isTrue,
+			isFalse:  "(" + l.isFalse + " or " + r.isFalse + ")",
+			nullable: l.nullable || r.nullable,
+		}}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (sqlExpr, error) {
+	if p.accept("not") {
+		e, err := p.parseNot()
+		if err != nil {
+			return sqlExpr{}, err
+		}
+		c := e.asCond()
+		return sqlExpr{cond: &sqlCond{isTrue: c.isFalse, isFalse: "(" + c.isTrue + ")", nullable: c.nullable}}, nil
+	}
+	return p.parseComparison()
+}
+
+var comparisonOps = map[string]string{
+	"=": "==", "<>": "~=", "!=": "~=", "<": "<", "<=": "<=", ">": ">", ">=": ">=",
+}
+
+func (p *parser) parseComparison() (sqlExpr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return sqlExpr{}, err
+	}
+	l, nulls := left.operand()
+
+	t := p.peek()
+	if op, ok := comparisonOps[t.text]; ok && t.kind == tokOp {
+		p.next()
+		right, err := p.parseAdditive()
+		if err != nil {
+			return sqlExpr{}, err
+		}
+		r, rnulls := right.operand()
+		return comparison(l+" "+op+" "+r, mergeNulls(nulls, rnulls)), nil
+	}
+
+	if p.accept("is") {
+		isTrue, isFalse := "==", "~="
+		if p.accept("not") {
+			isTrue, isFalse = isFalse, isTrue
+		}
+		if err := p.expect("null"); err != nil {
+			return sqlExpr{}, err
+		}
+		v := left.value()
+		return sqlExpr{cond: &sqlCond{isTrue: "(" + v + " " + isTrue + " nil)", isFalse: "(" + v + " " + isFalse + " nil)"}}, nil
+	}
+
+	negate := false
+	if p.peek().is("not") && (p.peekAt(1).is("like") || p.peekAt(1).is("between") || p.peekAt(1).is("in")) {
+		p.next()
+		negate = true
+	}
+
+	var cond sqlExpr
+	switch {
+	case p.accept("like"):
+		t := p.next()
+		if t.kind != tokString {
+			p.pos--
+			return sqlExpr{}, p.errorf("LIKE expects a string pattern")
+		}
+		cond = comparison("string.find(string.lower("+l+"), "+luaString(likeToLuaPattern(t.text))+") ~= nil", nulls)
+	case p.accept("between"):
+		low, err := p.parseAdditive()
+		if err != nil {
+			return sqlExpr{}, err
+		}
+		if err := p.expect("and"); err != nil {
+			return sqlExpr{}, err
+		}
+		high, err := p.parseAdditive()
+		if err != nil {
+			return sqlExpr{}, err
+		}
+		lo, lonulls := low.operand()
+		hi, hinulls := high.operand()
+		cond = comparison(l+" >= "+lo+" and "+l+" <= "+hi, mergeNulls(nulls, lonulls, hinulls))
+	case p.accept("in"):
+		if err := p.expect("("); err != nil {
+			return sqlExpr{}, err
+		}
+		var alts []string
+		for {
+			v, err := p.parseAdditive()
+			if err != nil {
+				return sqlExpr{}, err
+			}
+			alt, altnulls := v.operand()
+			alts = append(alts, l+" == "+alt)
+			nulls = mergeNulls(nulls, altnulls)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return sqlExpr{}, err
+		}
+		cond = comparison(strings.Join(alts, " or "), nulls)
+	default:
+		if negate {
+			return sqlExpr{}, p.errorf("expected LIKE, BETWEEN or IN")
+		}
+		return left, nil
+	}
+
+	if negate {
+		c := cond.cond
+		return sqlExpr{cond: &sqlCond{isTrue: c.isFalse, isFalse: c.isTrue, nullable: c.nullable}}, nil
+	}
+	return cond, nil
+}
+
+// arithmetic returns left op right, NULL when either is.
+func arithmetic(left sqlExpr, op string, right sqlExpr) sqlExpr {
+	l, lnulls := left.operand()
+	r, rnulls := right.operand()
+	if op == "%" {
+		// the % of Lua is floored, SQL truncates like fmod
+		return sqlExpr{lua: "math.fmod(" + l + ", " + r + ")", nulls: mergeNulls(lnulls, rnulls)}
+	}
+	return sqlExpr{lua: "(" + l + " " + op + " " + r + ")", nulls: mergeNulls(lnulls, rnulls)}
+}
+
+func (p *parser) parseAdditive() (sqlExpr, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return sqlExpr{}, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || (t.text != "+" && t.text != "-" && t.text != "||") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return sqlExpr{}, err
+		}
+		op := t.text
+		if op == "||" {
+			op = ".."
+		}
+		left = arithmetic(left, op, right)
+	}
+}
+
+func (p *parser) parseMultiplicative() (sqlExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return sqlExpr{}, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || (t.text != "*" && t.text != "/" && t.text != "%") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return sqlExpr{}, err
+		}
+		left = arithmetic(left, t.text, right)
+	}
+}
+
+func (p *parser) parseUnary() (sqlExpr, error) {
+	if p.accept("-") {
+		e, err := p.parseUnary()
+		if err != nil {
+			return sqlExpr{}, err
+		}
+		v, nulls := e.operand()
+		return sqlExpr{lua: "(-" + v + ")", nulls: nulls}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (sqlExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		if _, err := strconv.ParseFloat(t.text, 64); err != nil {
+			p.pos--
+			return sqlExpr{}, p.errorf("invalid number")
+		}
+		return constant(t.text), nil
+	case tokString:
+		return constant(luaString(t.text)), nil
+	case tokPlaceholder:
+		if p.inJoin {
+			p.pos--
+			return sqlExpr{}, p.errorf("placeholders are not supported in JOIN ... ON")
+		}
+		if p.argIdx >= len(p.args) {
+			p.pos--
+			return sqlExpr{}, p.errorf("missing argument for placeholder %d", p.argIdx+1)
+		}
+		v, err := luaLiteral(p.args[p.argIdx])
+		if err != nil {
+			p.pos--
+			return sqlExpr{}, p.errorf("placeholder %d: %v", p.argIdx+1, err)
+		}
+		p.argIdx++
+		if v == "nil" {
+			return nullable(v), nil
+		}
+		return constant(v), nil
+	case tokQuotedIdent:
+		if ref, ok, err := p.parseDimRef(t); ok {
+			return nullable(ref), err
+		}
+		return nullable("rec[" + luaString(t.text) + "]"), nil
+	case tokOp:
+		if t.text == "(" {
+			e, err := p.parseOr()
+			if err != nil {
+				return sqlExpr{}, err
+			}
+			if err := p.expect(")"); err != nil {
+				return sqlExpr{}, err
+			}
+			if c := e.cond; c != nil {
+				return sqlExpr{cond: &sqlCond{isTrue: "(" + c.isTrue + ")", isFalse: c.isFalse, nullable: c.nullable}}, nil
+			}
+			return sqlExpr{lua: "(" + e.lua + ")", nulls: e.nulls}, nil
+		}
+	case tokIdent:
+		name := strings.ToLower(t.text)
+		switch name {
+		case "null":
+			return nullable("nil"), nil
+		case "true", "false":
+			return constant(name), nil
+		}
+
+		if p.peek().is("(") {
+			if _, ok := sqlAggregates[name]; ok {
+				p.pos--
+				return sqlExpr{}, p.errorf("aggregates can not be part of an expression")
+			}
+			fn, ok := sqlFunctions[name]
+			if !ok {
+				p.pos--
+				return sqlExpr{}, p.errorf("unknown function %s", t.text)
+			}
+			p.next()
+			var args []string
+			var nulls []string
+			if !p.accept(")") {
+				for {
+					e, err := p.parseOr()
+					if err != nil {
+						return sqlExpr{}, err
+					}
+					a, anulls := e.operand()
+					args = append(args, a)
+					nulls = mergeNulls(nulls, anulls)
+					if !p.accept(",") {
+						break
+					}
+				}
+				if err := p.expect(")"); err != nil {
+					return sqlExpr{}, err
+				}
+			}
+			if name == "substr" && len(args) == 3 {
+				// SQL's substr takes a length, Lua's string.sub an end
+				args[2] = "(" + args[1] + ") + (" + args[2] + ") - 1"
+			}
+			// the functions return NULL for NULL arguments, like in SQL
+			return sqlExpr{lua: fn + "(" + strings.Join(args, ", ") + ")", nulls: nulls}, nil
+		}
+
+		if reservedWords[name] {
+			p.pos--
+			return sqlExpr{}, p.errorf("unexpected keyword")
+		}
+		if ref, ok, err := p.parseDimRef(t); ok {
+			return nullable(ref), err
+		}
+		return nullable("rec[" + luaString(t.text) + "]"), nil
+	}
+
+	p.pos--
+	return sqlExpr{}, p.errorf("expected an expression")
+}
+
+// likeToLuaPattern converts a LIKE pattern to an anchored Lua pattern, in
+// lower case: LIKE ignores the case of ASCII letters, like string.lower.
+func likeToLuaPattern(like string) string {
+	var sb strings.Builder
+	sb.WriteByte('^')
+	for _, c := range like {
+		switch c {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteByte('.')
+		case '^', '$', '(', ')', '.', '[', ']', '*', '+', '-', '?':
+			sb.WriteByte('%')
+			sb.WriteRune(c)
+		case 'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'I', 'J', 'K', 'L', 'M',
+			'N', 'O', 'P', 'Q', 'R', 'S', 'T', 'U', 'V', 'W', 'X', 'Y', 'Z':
+			sb.WriteRune(c - 'A' + 'a')
+		default:
+			sb.WriteRune(c)
+		}
+	}
+	sb.WriteByte('$')
+	return sb.String()
+}
+
+// luaString quotes s as a Lua 5.1 string literal.
+func luaString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\'' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c == '\n':
+			sb.WriteString(`\n`)
+		case c < 32 || c == 127:
+			// Lua 5.1 only has decimal escapes
+			sb.WriteString(fmt.Sprintf(`\%03d`, c))
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
+
+// luaLiteral returns v as a Lua literal.
+func luaLiteral(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "nil", nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case string:
+		return luaString(v), nil
+	case []byte:
+		return luaString(string(v)), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case time.Time:
+		// timestamps are epoch milliseconds, like time_bucket expects
+		return strconv.FormatInt(v.UnixNano()/int64(time.Millisecond), 10), nil
+	default:
+		return "", fmt.Errorf("unsupported argument type %T", v)
+	}
+}
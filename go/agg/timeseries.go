@@ -0,0 +1,165 @@
+package agg
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var msPerUnit = map[string]int64{
+	"ms": 1,
+	"s":  1000, "sec": 1000, "second": 1000,
+	"m": 60000, "min": 60000, "minute": 60000,
+	"h": 3600000, "hour": 3600000,
+	"d": 86400000, "day": 86400000,
+	"w": 604800000, "week": 604800000,
+}
+
+var intervalRegexp = regexp.MustCompile(`^\s*(\d*)\s*([a-zA-Z]+)\s*$`)
+
+// ParseInterval parses intervals in the format accepted by time_bucket in
+// aggAPI.lua, like '15s', '5m', '1h' or '1d', and returns them in
+// milliseconds.
+func ParseInterval(interval string) (int64, error) {
+	m := intervalRegexp.FindStringSubmatch(interval)
+	if m == nil {
+		return 0, fmt.Errorf("invalid interval: %q", interval)
+	}
+
+	size, ok := msPerUnit[strings.ToLower(m[2])]
+	if !ok {
+		return 0, fmt.Errorf("invalid interval: %q", interval)
+	}
+
+	if len(m[1]) > 0 {
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid interval: %q", interval)
+		}
+		size *= n
+	}
+
+	return size, nil
+}
+
+// TimeBuckets fills the empty buckets of a time series aggregation and
+// orders the rows by time.
+type TimeBuckets struct {
+	// Column is the alias of the group column holding the bucket start,
+	// usually computed with time_bucket(rec['ts'], interval).
+	Column string
+
+	// From and To are the requested range in epoch milliseconds. Empty
+	// buckets overlapping [From, To) are filled.
+	From, To int64
+
+	// Interval is the bucket size in milliseconds.
+	Interval int64
+
+	// Series are the other group columns. Each distinct combination of
+	// their values is filled separately.
+	Series []string
+
+	// Fill holds the values of the aggregate columns for empty buckets,
+	// e.g. Row{"count(*)": int64(0)}. Columns not set are left out.
+	Fill Row
+}
+
+// Apply returns rows with the missing buckets filled in, ordered by time
+// and then by the series columns.
+func (tb *TimeBuckets) Apply(rows []Row) ([]Row, error) {
+	if tb.Interval <= 0 {
+		return nil, fmt.Errorf("invalid time bucket interval: %d", tb.Interval)
+	}
+
+	seen := make(map[string]bool, len(rows))
+	series := map[string]Row{}
+	res := make([]Row, 0, len(rows))
+	for _, row := range rows {
+		ts, ok := toInt64(row[tb.Column])
+		if !ok {
+			return nil, fmt.Errorf("column `%s` is not a timestamp: %#v", tb.Column, row[tb.Column])
+		}
+
+		key := tb.seriesKey(row)
+		if _, exists := series[key]; !exists {
+			series[key] = row
+		}
+		seen[key+strconv.FormatInt(ts, 10)] = true
+		res = append(res, row)
+	}
+
+	// with no rows at all, there is still a single empty series to fill
+	if len(series) == 0 && len(tb.Series) == 0 {
+		series[tb.seriesKey(Row{})] = Row{}
+	}
+
+	start := tb.From - mod(tb.From, tb.Interval)
+	for key, sample := range series {
+		for ts := start; ts < tb.To; ts += tb.Interval {
+			if seen[key+strconv.FormatInt(ts, 10)] {
+				continue
+			}
+
+			row := make(Row, len(tb.Fill)+len(tb.Series)+1)
+			for k, v := range tb.Fill {
+				row[k] = v
+			}
+			for _, col := range tb.Series {
+				if v, exists := sample[col]; exists {
+					row[col] = v
+				}
+			}
+			row[tb.Column] = ts
+			res = append(res, row)
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		ti, _ := toInt64(res[i][tb.Column])
+		tj, _ := toInt64(res[j][tb.Column])
+		if ti != tj {
+			return ti < tj
+		}
+		return tb.seriesKey(res[i]) < tb.seriesKey(res[j])
+	})
+
+	return res, nil
+}
+
+func (tb *TimeBuckets) seriesKey(row Row) string {
+	var sb strings.Builder
+	for _, col := range tb.Series {
+		v := fmt.Sprint(row[col])
+		// length prefix, so that values do not concat to the same key
+		sb.WriteString(strconv.Itoa(len(v)))
+		sb.WriteByte(':')
+		sb.WriteString(v)
+	}
+	sb.WriteByte('|')
+	return sb.String()
+}
+
+// mod is the floor modulo, same as Lua's % operator.
+func mod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,116 @@
+package agg
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer recording the spans of the package.
+const TracerName = "github.com/aerospike/aerospike-lua-aggregations/go/agg"
+
+// Attributes of the spans.
+const (
+	AttrNamespace = attribute.Key("aerospike.namespace")
+	AttrSet       = attribute.Key("aerospike.set")
+	AttrNode      = attribute.Key("aerospike.node")
+	AttrHost      = attribute.Key("aerospike.host")
+	AttrFields    = attribute.Key("agg.fields")
+	AttrGroupBy   = attribute.Key("agg.group_by")
+	AttrPayload   = attribute.Key("agg.payload")
+	AttrMaxGroups = attribute.Key("agg.max_groups")
+	AttrGroups    = attribute.Key("agg.groups")
+	AttrRecords   = attribute.Key("agg.records")
+	AttrResults   = attribute.Key("agg.results")
+	AttrUDFHash   = attribute.Key("agg.udf_hash")
+	AttrJoin      = attribute.Key("agg.join")
+	AttrBytes     = attribute.Key("agg.bytes")
+)
+
+var (
+	tracerMu       sync.RWMutex
+	tracerProvider trace.TracerProvider
+)
+
+// SetTracerProvider sets the provider of the spans of the aggregations and
+// of the UDF registration. When nil, the default, they are recorded by the
+// global provider of OpenTelemetry, which records none until it is set.
+//
+// An aggregation is an agg.query span, with agg.dispatch, agg.receive and
+// agg.decode children. The client runs the final reduce while receiving
+// the results, so only Query.ExecutePartials has an agg.node span per node
+// and an agg.finalize span merging them. The sets a query joins are read
+// in agg.join spans first.
+func SetTracerProvider(tp trace.TracerProvider) {
+	tracerMu.Lock()
+	defer tracerMu.Unlock()
+	tracerProvider = tp
+}
+
+func tracer() trace.Tracer {
+	tracerMu.RLock()
+	tp := tracerProvider
+	tracerMu.RUnlock()
+
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(TracerName)
+}
+
+// startQuerySpan starts the span of an aggregation.
+func startQuerySpan(ctx context.Context, nsName, setName string, payload map[string]interface{}) (context.Context, trace.Span) {
+	ctx, span := tracer().Start(ctx, "agg.query", trace.WithSpanKind(trace.SpanKindClient))
+	if !span.IsRecording() {
+		return ctx, span
+	}
+
+	fields, _ := payload["fields"].(map[string]interface{})
+	groupBy, _ := payload["group_by_fields"].([]interface{})
+	span.SetAttributes(
+		AttrNamespace.String(nsName),
+		AttrSet.String(setName),
+		AttrFields.Int(len(fields)),
+		AttrGroupBy.Int(len(groupBy)),
+		AttrPayload.String(payloadFingerprint(payload)),
+	)
+	if maxGroups, ok := toInt64(payload["max_groups"]); ok {
+		span.SetAttributes(AttrMaxGroups.Int64(maxGroups))
+	}
+	return ctx, span
+}
+
+// endQuerySpan ends the span of an aggregation returning rows, or err.
+func endQuerySpan(span trace.Span, rows []Row, err error) {
+	if err == nil {
+		span.SetAttributes(AttrGroups.Int(len(rows)))
+	}
+	endSpan(span, err)
+}
+
+// endSpan ends span, with the error of the step it records.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// payloadFingerprint returns a short hash of the normalized payload, the
+// same for the payloads the cache does not tell apart.
+func payloadFingerprint(payload map[string]interface{}) string {
+	p, err := NormalizePayload(payload)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha1.Sum(p)
+	return hex.EncodeToString(sum[:8])
+}
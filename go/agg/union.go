@@ -0,0 +1,247 @@
+package agg
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	aero "github.com/aerospike/aerospike-client-go"
+)
+
+// Source is a set the records of a union are aggregated from.
+type Source struct {
+	Namespace string
+	Set       string
+}
+
+func (s Source) String() string {
+	return s.Namespace + "." + s.Set
+}
+
+// FromSets makes the query aggregate the records of sets, like the tables
+// of a UNION ALL, instead of those of its set. A set is "set", in the
+// namespace of the query, or "namespace.set", and either name may be a
+// glob like events_2026_*, matched against the sets of the cluster. The
+// sets are queried one after the other, and their groups merged in Go.
+func (q *Query) FromSets(sets ...string) *Query {
+	q.Sets = append(q.Sets, sets...)
+	return q
+}
+
+// WithSourceColumn returns the set of each group, namespace.set, as alias.
+// The groups of different sets are then kept apart.
+func (q *Query) WithSourceColumn(alias string) *Query {
+	q.SourceColumn = alias
+	return q
+}
+
+func isGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// splitSource splits a set of a union into its namespace, the one of the
+// query when it has none, and its set.
+func (q *Query) splitSource(set string) (string, string) {
+	if i := strings.Index(set, "."); i >= 0 {
+		return set[:i], set[i+1:]
+	}
+	return q.Namespace, set
+}
+
+// hasGlobs reports whether the sets of the union have globs, which need
+// the sets of the cluster to be expanded.
+func (q *Query) hasGlobs() bool {
+	for _, set := range q.Sets {
+		ns, name := q.splitSource(set)
+		if isGlob(ns) || isGlob(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sources returns the sets of the union of the query, in the order of
+// Sets, the globs being expanded against known in order. A set appearing
+// more than once is aggregated once, and a glob matching no set is an
+// error.
+func (q *Query) Sources(known []Source) ([]Source, error) {
+	var res []Source
+	seen := map[Source]bool{}
+	add := func(src Source) {
+		if !seen[src] {
+			seen[src] = true
+			res = append(res, src)
+		}
+	}
+
+	for _, set := range q.Sets {
+		ns, name := q.splitSource(set)
+		switch {
+		case ns == "":
+			return nil, fmt.Errorf("set `%s` has no namespace", set)
+		case name == "":
+			return nil, fmt.Errorf("set `%s` has no name", set)
+		case !isGlob(ns) && !isGlob(name):
+			add(Source{Namespace: ns, Set: name})
+			continue
+		}
+
+		if _, err := path.Match(ns, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob `%s`: %v", set, err)
+		}
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob `%s`: %v", set, err)
+		}
+
+		matched := false
+		for _, src := range known {
+			nsOK, _ := path.Match(ns, src.Namespace)
+			setOK, _ := path.Match(name, src.Set)
+			if nsOK && setOK {
+				add(src)
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no set matches `%s`", set)
+		}
+	}
+
+	return res, nil
+}
+
+// ClusterSets returns the sets of the namespaces of the cluster, sorted,
+// from the info of its nodes.
+func ClusterSets(client *aero.Client) ([]Source, error) {
+	nodes := client.GetNodes()
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("the cluster has no nodes")
+	}
+
+	seen := map[Source]bool{}
+	for _, node := range nodes {
+		info, err := node.RequestInfo(aero.NewInfoPolicy(), "sets")
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %v", node.GetName(), err)
+		}
+		for _, src := range parseSetsInfo(info["sets"]) {
+			seen[src] = true
+		}
+	}
+
+	return sortedSources(seen), nil
+}
+
+// parseSetsInfo parses the response to the sets info command, entries like
+// ns=test:set=users:objects=1000:... separated by semicolons. Older
+// servers name the fields ns_name and set_name.
+func parseSetsInfo(info string) []Source {
+	var res []Source
+	for _, entry := range strings.Split(info, ";") {
+		var src Source
+		for _, field := range strings.Split(entry, ":") {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "ns", "ns_name":
+				src.Namespace = kv[1]
+			case "set", "set_name":
+				src.Set = kv[1]
+			}
+		}
+		if src.Namespace != "" && src.Set != "" {
+			res = append(res, src)
+		}
+	}
+	return res
+}
+
+func sortedSources(set map[Source]bool) []Source {
+	res := make([]Source, 0, len(set))
+	for src := range set {
+		res = append(res, src)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].String() < res[j].String()
+	})
+	return res
+}
+
+// aggregateUnion runs the aggregation of q on each of sources with run,
+// which returns their groups by key, and merges them.
+func (q *Query) aggregateUnion(ctx context.Context, sources []Source, run func(context.Context, Source, map[string]interface{}) (map[string]Row, error)) ([]Row, error) {
+	payload, maxGroups := withMaxGroups(q.Payload())
+
+	names := make([]string, len(sources))
+	for i, src := range sources {
+		names[i] = src.String()
+	}
+	setName := strings.Join(names, ",")
+
+	start := time.Now()
+	ctx, span := startQuerySpan(ctx, q.Namespace, setName, payload)
+
+	rows, err := q.mergeSources(ctx, sources, payload, maxGroups, run)
+	endQuerySpan(span, rows, err)
+	logQuery(ctx, q.Namespace, setName, payload, start, rows, err)
+	return rows, err
+}
+
+func (q *Query) mergeSources(ctx context.Context, sources []Source, payload map[string]interface{}, maxGroups int, run func(context.Context, Source, map[string]interface{}) (map[string]Row, error)) ([]Row, error) {
+	final := newMerger(payload, maxGroups)
+	for _, src := range sources {
+		groups, err := run(ctx, src, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		if q.SourceColumn != "" {
+			keyed := make(map[string]Row, len(groups))
+			for key, row := range groups {
+				row[q.SourceColumn] = src.String()
+				keyed[src.String()+"\x00"+key] = row
+			}
+			groups = keyed
+		}
+
+		if err := final.merge(groups); err != nil {
+			return nil, err
+		}
+	}
+
+	_, finalize := tracer().Start(ctx, "agg.finalize")
+	rows := final.rows()
+	finalize.SetAttributes(AttrGroups.Int(len(rows)))
+	finalize.End()
+	return rows, nil
+}
+
+// executeUnion runs the union of q on the cluster, calling fn with the
+// partial aggregate of each node of each set, when not nil.
+func (q *Query) executeUnion(ctx context.Context, client *aero.Client, fn func(*Partial)) ([]Row, error) {
+	var known []Source
+	if q.hasGlobs() {
+		var err error
+		if known, err = ClusterSets(client); err != nil {
+			return nil, err
+		}
+	}
+
+	sources, err := q.Sources(known)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.aggregateUnion(ctx, sources, func(ctx context.Context, src Source, payload map[string]interface{}) (map[string]Row, error) {
+		m, err := aggregateNodes(ctx, client, q.Policy, q.statement(src.Namespace, src.Set), payload, fn)
+		if err != nil {
+			return nil, err
+		}
+		return m.groups, nil
+	})
+}
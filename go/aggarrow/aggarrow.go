@@ -0,0 +1,232 @@
+//go:build arrow
+// +build arrow
+
+// Package aggarrow converts aggregation results into Apache Arrow records,
+// and writes them as Arrow IPC or Parquet files.
+//
+//	rows, err := q.Execute(client)
+//	err = aggarrow.WriteParquet(f, q, rows)
+//
+// Importing the package registers the "arrow" and "parquet" formats of
+// aggfmt. It depends on Apache Arrow, and is built only with the arrow tag.
+package aggarrow
+
+import (
+	"io"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggfmt"
+)
+
+func init() {
+	aggfmt.Register("arrow", formatter(WriteIPC))
+	aggfmt.Register("parquet", formatter(WriteParquet))
+}
+
+// Schema returns the schema of the rows of q. Counts are non nullable
+// int64 columns, other aggregates int64 columns when all their values are
+// integers, string columns for the min and max of strings, and float64
+// columns otherwise. Bins and group values are typed
+// after their values: strings, int64, float64 or booleans, and lists, maps
+// or values of mixed types are strings of JSON. Columns other than counts
+// are nullable.
+func Schema(q *agg.Query, rows []agg.Row) *arrow.Schema {
+	columns := q.ColumnNames()
+	fields := make([]arrow.Field, len(columns))
+	for i, col := range columns {
+		switch f := q.Field(col); {
+		case f != nil && f.Func == agg.FuncCount:
+			fields[i] = arrow.Field{Name: col, Type: arrow.PrimitiveTypes.Int64}
+		case f != nil && f.IsAggregate():
+			typ := columnType(col, rows)
+			switch {
+			case typ.ID() == arrow.INT64:
+			case typ.ID() == arrow.STRING && (f.Func == agg.FuncMin || f.Func == agg.FuncMax) && hasValues(col, rows):
+			default:
+				typ = arrow.PrimitiveTypes.Float64
+			}
+			fields[i] = arrow.Field{Name: col, Type: typ, Nullable: true}
+		default:
+			fields[i] = arrow.Field{Name: col, Type: columnType(col, rows), Nullable: true}
+		}
+	}
+
+	return arrow.NewSchema(fields, nil)
+}
+
+// columnType returns the type of the values of col: the type they all
+// have, float64 for numbers of both types, and string otherwise.
+func columnType(col string, rows []agg.Row) arrow.DataType {
+	var typ arrow.DataType
+	for _, row := range rows {
+		var t arrow.DataType
+		switch row[col].(type) {
+		case nil:
+			continue
+		case int64, int:
+			t = arrow.PrimitiveTypes.Int64
+		case float64:
+			t = arrow.PrimitiveTypes.Float64
+		case bool:
+			t = arrow.FixedWidthTypes.Boolean
+		default:
+			return arrow.BinaryTypes.String
+		}
+
+		switch {
+		case typ == nil:
+			typ = t
+		case arrow.TypeEqual(typ, t):
+		case isNumeric(typ) && isNumeric(t):
+			typ = arrow.PrimitiveTypes.Float64
+		default:
+			return arrow.BinaryTypes.String
+		}
+	}
+
+	if typ == nil {
+		return arrow.BinaryTypes.String
+	}
+	return typ
+}
+
+// hasValues reports whether some of the rows have a value for col.
+func hasValues(col string, rows []agg.Row) bool {
+	for _, row := range rows {
+		if row[col] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func isNumeric(t arrow.DataType) bool {
+	return t.ID() == arrow.INT64 || t.ID() == arrow.FLOAT64
+}
+
+// NewRecord returns the rows of q as a record of Schema(q, rows). The
+// caller releases it.
+func NewRecord(mem memory.Allocator, q *agg.Query, rows []agg.Row) arrow.Record {
+	return newRecord(mem, Schema(q, rows), rows)
+}
+
+func newRecord(mem memory.Allocator, schema *arrow.Schema, rows []agg.Row) arrow.Record {
+	b := array.NewRecordBuilder(mem, schema)
+	defer b.Release()
+
+	for i, field := range schema.Fields() {
+		col := field.Name
+		switch fb := b.Field(i).(type) {
+		case *array.Int64Builder:
+			for _, row := range rows {
+				switch v := row[col].(type) {
+				case int64:
+					fb.Append(v)
+				case int:
+					fb.Append(int64(v))
+				default:
+					fb.AppendNull()
+				}
+			}
+		case *array.Float64Builder:
+			for _, row := range rows {
+				switch v := row[col].(type) {
+				case float64:
+					fb.Append(v)
+				case int64:
+					fb.Append(float64(v))
+				case int:
+					fb.Append(float64(v))
+				default:
+					fb.AppendNull()
+				}
+			}
+		case *array.BooleanBuilder:
+			for _, row := range rows {
+				if v, ok := row[col].(bool); ok {
+					fb.Append(v)
+				} else {
+					fb.AppendNull()
+				}
+			}
+		case *array.StringBuilder:
+			for _, row := range rows {
+				if v := row[col]; v != nil {
+					fb.Append(aggfmt.Text(v))
+				} else {
+					fb.AppendNull()
+				}
+			}
+		}
+	}
+
+	return b.NewRecord()
+}
+
+// WriteIPC writes the rows of q as an Arrow IPC file, a single record
+// batch.
+func WriteIPC(w io.Writer, q *agg.Query, rows []agg.Row) error {
+	return writeIPC(w, Schema(q, rows), rows)
+}
+
+func writeIPC(w io.Writer, schema *arrow.Schema, rows []agg.Row) error {
+	mem := memory.NewGoAllocator()
+	rec := newRecord(mem, schema, rows)
+	defer rec.Release()
+
+	fw, err := ipc.NewFileWriter(w, ipc.WithSchema(schema), ipc.WithAllocator(mem))
+	if err != nil {
+		return err
+	}
+	if err := fw.Write(rec); err != nil {
+		fw.Close()
+		return err
+	}
+	return fw.Close()
+}
+
+// WriteParquet writes the rows of q as a Parquet file, compressed with
+// Snappy.
+func WriteParquet(w io.Writer, q *agg.Query, rows []agg.Row) error {
+	return writeParquet(w, Schema(q, rows), rows)
+}
+
+func writeParquet(w io.Writer, schema *arrow.Schema, rows []agg.Row) error {
+	mem := memory.NewGoAllocator()
+	rec := newRecord(mem, schema, rows)
+	defer rec.Release()
+
+	props := parquet.NewWriterProperties(
+		parquet.WithCompression(compress.Codecs.Snappy),
+		parquet.WithAllocator(mem),
+	)
+	fw, err := pqarrow.NewFileWriter(schema, w, props, pqarrow.NewArrowWriterProperties(pqarrow.WithAllocator(mem)))
+	if err != nil {
+		return err
+	}
+	if err := fw.Write(rec); err != nil {
+		fw.Close()
+		return err
+	}
+	return fw.Close()
+}
+
+// formatter is an aggfmt formatter writing the rows of a query. Without
+// the query, columns are typed after their values only.
+type formatter func(w io.Writer, q *agg.Query, rows []agg.Row) error
+
+func (f formatter) FormatQuery(w io.Writer, q *agg.Query, rows []agg.Row) error {
+	return f(w, q, rows)
+}
+
+func (f formatter) Format(w io.Writer, columns []string, rows []agg.Row) error {
+	return f(w, &agg.Query{Columns: columns}, rows)
+}
@@ -0,0 +1,164 @@
+// Package aggfmt writes aggregation results as aligned tables, JSON,
+// NDJSON, CSV or TSV.
+//
+//	rows, err := q.Execute(client)
+//	err = aggfmt.Write(os.Stdout, "csv", q, rows)
+//
+// Columns are written in the order of the query, and numbers as they were
+// returned: integers never print with a fraction. Other formats can be
+// added with Register, like the arrow and parquet formats of the aggarrow
+// package.
+package aggfmt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+)
+
+// Formatter writes rows, in the order of columns.
+type Formatter interface {
+	Format(w io.Writer, columns []string, rows []agg.Row) error
+}
+
+// QueryFormatter is a formatter which types its columns after the query,
+// like columnar formats. Write calls FormatQuery rather than Format.
+type QueryFormatter interface {
+	Formatter
+	FormatQuery(w io.Writer, q *agg.Query, rows []agg.Row) error
+}
+
+// FormatterFunc adapts a function to the Formatter interface.
+type FormatterFunc func(w io.Writer, columns []string, rows []agg.Row) error
+
+// Format calls f(w, columns, rows).
+func (f FormatterFunc) Format(w io.Writer, columns []string, rows []agg.Row) error {
+	return f(w, columns, rows)
+}
+
+var (
+	mu         sync.RWMutex
+	formatters = map[string]Formatter{
+		"table":  FormatterFunc(formatTable),
+		"json":   FormatterFunc(formatJSON),
+		"ndjson": FormatterFunc(formatNDJSON),
+		"csv":    &delimited{comma: ','},
+		"tsv":    &delimited{comma: '\t'},
+	}
+)
+
+// Register makes a formatter available under name, replacing any formatter
+// registered under the same name.
+func Register(name string, f Formatter) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	formatters[name] = f
+}
+
+// Lookup returns the formatter registered under name.
+func Lookup(name string) (Formatter, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	f, exists := formatters[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown format `%s`, expected one of %v", name, namesLocked())
+	}
+	return f, nil
+}
+
+// Names returns the names of the registered formatters, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return namesLocked()
+}
+
+func namesLocked() []string {
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Write writes the rows returned by q in format.
+func Write(w io.Writer, format string, q *agg.Query, rows []agg.Row) error {
+	f, err := Lookup(format)
+	if err != nil {
+		return err
+	}
+	if qf, ok := f.(QueryFormatter); ok {
+		return qf.FormatQuery(w, q, rows)
+	}
+	return f.Format(w, q.ColumnNames(), rows)
+}
+
+// Text returns v as text: integers without a fraction, floats with as
+// many digits as needed to read them back, and lists and maps as JSON.
+// nil is returned as an empty string.
+func Text(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, err := marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	}
+}
+
+// marshal encodes v as JSON, without escaping HTML characters.
+func marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(jsonValue(v)); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// jsonValue converts the maps decoded by the client, which are keyed by
+// interface{}, to maps encoding/json accepts.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = jsonValue(e)
+		}
+		return l
+	default:
+		return v
+	}
+}
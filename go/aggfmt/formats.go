@@ -0,0 +1,193 @@
+package aggfmt
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+)
+
+// formatTable writes an aligned table, numbers aligned to the right, and
+// missing values as NULL.
+func formatTable(w io.Writer, columns []string, rows []agg.Row) error {
+	cells := make([][]string, len(rows))
+	widths := make([]int, len(columns))
+	numeric := make([]bool, len(columns))
+
+	for i, col := range columns {
+		widths[i] = utf8.RuneCountInString(col)
+		numeric[i] = true
+	}
+
+	for r, row := range rows {
+		cells[r] = make([]string, len(columns))
+		for i, col := range columns {
+			v := row[col]
+
+			s := "NULL"
+			if v != nil {
+				s = Text(v)
+			}
+			cells[r][i] = s
+
+			if n := utf8.RuneCountInString(s); n > widths[i] {
+				widths[i] = n
+			}
+			if !isNumber(v) {
+				numeric[i] = false
+			}
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	writeLine := func(values []string) {
+		for i, s := range values {
+			if i > 0 {
+				bw.WriteString("  ")
+			}
+
+			pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(s))
+			if numeric[i] {
+				bw.WriteString(pad + s)
+			} else if i < len(values)-1 {
+				bw.WriteString(s + pad)
+			} else {
+				bw.WriteString(s)
+			}
+		}
+		bw.WriteString("\n")
+	}
+
+	writeLine(columns)
+	rules := make([]string, len(columns))
+	for i := range columns {
+		rules[i] = strings.Repeat("-", widths[i])
+	}
+	writeLine(rules)
+
+	for _, values := range cells {
+		writeLine(values)
+	}
+
+	if len(rows) == 1 {
+		bw.WriteString("(1 row)\n")
+	} else {
+		fmt.Fprintf(bw, "(%d rows)\n", len(rows))
+	}
+
+	return bw.Flush()
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case nil, int, int64, float64:
+		return true
+	default:
+		return false
+	}
+}
+
+// formatJSON writes an indented array of objects.
+func formatJSON(w io.Writer, columns []string, rows []agg.Row) error {
+	bw := bufio.NewWriter(w)
+
+	if len(rows) == 0 {
+		bw.WriteString("[]\n")
+		return bw.Flush()
+	}
+
+	bw.WriteString("[\n")
+	for r, row := range rows {
+		bw.WriteString("  {")
+		for i, col := range columns {
+			if i > 0 {
+				bw.WriteString(",")
+			}
+			bw.WriteString("\n    ")
+			if err := writeMember(bw, col, row[col], ": "); err != nil {
+				return err
+			}
+		}
+
+		if len(columns) > 0 {
+			bw.WriteString("\n  ")
+		}
+		if r < len(rows)-1 {
+			bw.WriteString("},\n")
+		} else {
+			bw.WriteString("}\n")
+		}
+	}
+	bw.WriteString("]\n")
+
+	return bw.Flush()
+}
+
+// formatNDJSON writes an object per line.
+func formatNDJSON(w io.Writer, columns []string, rows []agg.Row) error {
+	bw := bufio.NewWriter(w)
+
+	for _, row := range rows {
+		bw.WriteString("{")
+		for i, col := range columns {
+			if i > 0 {
+				bw.WriteString(",")
+			}
+			if err := writeMember(bw, col, row[col], ":"); err != nil {
+				return err
+			}
+		}
+		bw.WriteString("}\n")
+	}
+
+	return bw.Flush()
+}
+
+func writeMember(bw *bufio.Writer, key string, value interface{}, sep string) error {
+	k, err := marshal(key)
+	if err != nil {
+		return err
+	}
+
+	v, err := marshal(value)
+	if err != nil {
+		return fmt.Errorf("column `%s`: %v", key, err)
+	}
+
+	bw.Write(k)
+	bw.WriteString(sep)
+	bw.Write(v)
+	return nil
+}
+
+// delimited writes a header line followed by a line per row, missing
+// values as empty fields.
+type delimited struct {
+	comma rune
+}
+
+func (d *delimited) Format(w io.Writer, columns []string, rows []agg.Row) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = d.comma
+
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+
+	values := make([]string, len(columns))
+	for _, row := range rows {
+		for i, col := range columns {
+			values[i] = Text(row[col])
+		}
+		if err := cw.Write(values); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
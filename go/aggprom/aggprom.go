@@ -0,0 +1,454 @@
+// Package aggprom exports the aggregates of queries run on a schedule as
+// Prometheus metrics. Each aggregate of a query is a gauge named
+// <prefix>_<query>_<alias>, labeled with the group values of its rows:
+//
+//	# TYPE agg_users_payroll gauge
+//	agg_users_payroll{name="Eva"} 12000
+//
+// along with the duration, runs, errors and groups of the queries:
+//
+//	agg_query_duration_seconds{query="users"} 0.084
+//	agg_query_errors_total{query="users"} 0
+package aggprom
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggfmt"
+)
+
+// Backend runs the queries of an exporter, like the backends of aggserve.
+type Backend interface {
+	Execute(ctx context.Context, q *agg.Query) ([]agg.Row, error)
+}
+
+// othersLabel is the value of the group labels of the rows accumulating
+// the groups over max_groups.
+const othersLabel = "__others"
+
+// groupingLabel is the label of the grouping id, for queries with
+// grouping sets.
+const groupingLabel = "grouping"
+
+// Exporter runs queries on a schedule, and writes their last results as
+// metrics. It is the http.Handler of the metrics.
+type Exporter struct {
+	// ErrorLog logs the errors of the queries, the standard logger when
+	// nil.
+	ErrorLog *log.Logger
+
+	backend Backend
+	prefix  string
+	queries []*query
+}
+
+// query is a query of the exporter, and its last results.
+type query struct {
+	QueryConfig
+	q       *agg.Query
+	labels  []label
+	metrics []metric
+
+	mu          sync.Mutex
+	samples     [][]sample // by metric
+	groups      int
+	duration    time.Duration
+	runs        uint64
+	errors      uint64
+	lastSuccess time.Time
+}
+
+// label is a group by column and the name of its label.
+type label struct {
+	column, name string
+}
+
+// metric is an aggregate column and the name of its gauge.
+type metric struct {
+	column, name string
+	help         string
+}
+
+// sample is a value of a metric with the values of its labels.
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// NewExporter parses the queries of cfg, which run on backend.
+func NewExporter(backend Backend, cfg *Config) (*Exporter, error) {
+	if !nameRe.MatchString(cfg.Prefix) {
+		return nil, fmt.Errorf("prefix %q must be letters, digits and underscores", cfg.Prefix)
+	}
+
+	e := &Exporter{backend: backend, prefix: cfg.Prefix}
+	names := map[string]bool{}
+	for _, qc := range cfg.Queries {
+		if names[qc.Name] {
+			return nil, fmt.Errorf("query %s is defined twice", qc.Name)
+		}
+		names[qc.Name] = true
+
+		q, err := qc.query(cfg.Namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		qr := &query{QueryConfig: qc, q: q}
+		if err := qr.mapColumns(cfg.Prefix); err != nil {
+			return nil, fmt.Errorf("query %s: %v", qc.Name, err)
+		}
+		e.queries = append(e.queries, qr)
+	}
+
+	return e, nil
+}
+
+// mapColumns maps the group by columns, and the source column of a union,
+// to labels, and the aggregates to metrics.
+func (qr *query) mapColumns(prefix string) error {
+	columns := map[string]bool{}
+	for _, col := range qr.q.ColumnNames() {
+		columns[col] = true
+	}
+
+	for col := range qr.Labels {
+		if !isGroupBy(qr.q, col) {
+			return fmt.Errorf("label of `%s`, which is not a group by column", col)
+		}
+	}
+
+	labels := map[string]bool{}
+	for _, col := range groupColumns(qr.q) {
+		if !columns[col] {
+			return fmt.Errorf("group by `%s` must be selected to label the metrics", col)
+		}
+
+		name := sanitize(col)
+		if len(qr.Labels) > 0 {
+			var ok bool
+			if name, ok = qr.Labels[col]; !ok {
+				return fmt.Errorf("group by `%s` has no label", col)
+			}
+		}
+
+		if !nameRe.MatchString(name) || strings.HasPrefix(name, "__") || name == groupingLabel {
+			return fmt.Errorf("invalid label name %q for `%s`", name, col)
+		}
+		if labels[name] {
+			return fmt.Errorf("two labels are named %q", name)
+		}
+		labels[name] = true
+		qr.labels = append(qr.labels, label{column: col, name: name})
+	}
+	if len(qr.q.GroupingSets) > 0 {
+		qr.labels = append(qr.labels, label{column: agg.GroupingIDColumn, name: groupingLabel})
+	}
+
+	metrics := map[string]string{}
+	for _, col := range qr.q.ColumnNames() {
+		f := qr.q.Field(col)
+		if f == nil || !f.IsAggregate() {
+			continue
+		}
+
+		name := prefix + "_" + qr.Name + "_" + sanitize(col)
+		if other, exists := metrics[name]; exists {
+			return fmt.Errorf("`%s` and `%s` are both exported as %s, give them other aliases", other, col, name)
+		}
+		metrics[name] = col
+		qr.metrics = append(qr.metrics, metric{
+			column: col,
+			name:   name,
+			help:   fmt.Sprintf("%s(%s) of query %s, as %s.", f.Func, f.Expr, qr.Name, col),
+		})
+	}
+	if len(qr.metrics) == 0 {
+		return fmt.Errorf("no aggregates to export")
+	}
+
+	return nil
+}
+
+// groupColumns returns the columns telling the groups of q apart.
+func groupColumns(q *agg.Query) []string {
+	cols := make([]string, 0, len(q.GroupBy)+1)
+	if q.SourceColumn != "" {
+		cols = append(cols, q.SourceColumn)
+	}
+	for _, g := range q.GroupBy {
+		cols = append(cols, g.Alias)
+	}
+	return cols
+}
+
+func isGroupBy(q *agg.Query, col string) bool {
+	for _, c := range groupColumns(q) {
+		if c == col {
+			return true
+		}
+	}
+	return false
+}
+
+var invalidRe = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// sanitize returns s with the characters invalid in metric and label names
+// replaced, e.g. "count(*)" is "count" and "lower(name)" "lower_name".
+func sanitize(s string) string {
+	s = strings.Trim(invalidRe.ReplaceAllString(s, "_"), "_")
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return s
+}
+
+// Run runs the queries every interval, the first time right away, until
+// ctx is done.
+func (e *Exporter) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, qr := range e.queries {
+		wg.Add(1)
+		go func(qr *query) {
+			defer wg.Done()
+
+			ticker := time.NewTicker(qr.Interval)
+			defer ticker.Stop()
+
+			for {
+				if err := e.run(ctx, qr); err != nil && ctx.Err() == nil {
+					e.logf("query %s: %v", qr.Name, err)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(qr)
+	}
+	wg.Wait()
+}
+
+// Refresh runs all the queries once, and returns the first error.
+func (e *Exporter) Refresh(ctx context.Context) error {
+	var firstErr error
+	for _, qr := range e.queries {
+		if err := e.run(ctx, qr); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("query %s: %v", qr.Name, err)
+		}
+	}
+	return firstErr
+}
+
+// run runs a query, and keeps its results. The results of the last run
+// succeeding are kept when it fails. The caller of its aggregation is
+// "exporter/<name>", unless ctx names one.
+func (e *Exporter) run(ctx context.Context, qr *query) error {
+	if agg.CallerFromContext(ctx) == "" {
+		ctx = agg.WithCaller(ctx, "exporter/"+qr.Name)
+	}
+	ctx, cancel := context.WithTimeout(ctx, qr.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	rows, err := e.backend.Execute(ctx, qr.q)
+	elapsed := time.Since(start)
+
+	qr.mu.Lock()
+	defer qr.mu.Unlock()
+
+	qr.runs++
+	qr.duration = elapsed
+	if err != nil {
+		qr.errors++
+		return err
+	}
+
+	qr.samples = qr.collect(rows)
+	qr.groups = len(rows)
+	qr.lastSuccess = time.Now()
+	return nil
+}
+
+// collect returns the samples of the metrics in rows, sorted by labels.
+func (qr *query) collect(rows []agg.Row) [][]sample {
+	samples := make([][]sample, len(qr.metrics))
+	for _, row := range rows {
+		values := make([]string, len(qr.labels))
+		for i, l := range qr.labels {
+			switch v := row[l.column]; {
+			case l.name == groupingLabel:
+				values[i] = strconv.FormatInt(row.Grouping(), 10)
+			case row.IsOthers():
+				values[i] = othersLabel
+			case v != nil:
+				values[i] = aggfmt.Text(v)
+			}
+		}
+
+		for i, m := range qr.metrics {
+			if v, ok := toFloat64(row[m.column]); ok {
+				samples[i] = append(samples[i], sample{labels: values, value: v})
+			}
+		}
+	}
+
+	for _, s := range samples {
+		sort.Slice(s, func(i, j int) bool {
+			return strings.Join(s[i].labels, "\xff") < strings.Join(s[j].labels, "\xff")
+		})
+	}
+	return samples
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func (e *Exporter) logf(format string, args ...interface{}) {
+	if e.ErrorLog != nil {
+		e.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.WriteMetrics(w)
+}
+
+// WriteMetrics writes the metrics in the Prometheus text format: the
+// aggregates of the last run of the queries succeeding, and the metrics of
+// the runs.
+func (e *Exporter) WriteMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	type stats struct {
+		name         string
+		groups       int
+		duration     time.Duration
+		runs, errors uint64
+		lastSuccess  time.Time
+	}
+	all := make([]stats, len(e.queries))
+
+	for i, qr := range e.queries {
+		qr.mu.Lock()
+		samples := qr.samples
+		all[i] = stats{qr.Name, qr.groups, qr.duration, qr.runs, qr.errors, qr.lastSuccess}
+		qr.mu.Unlock()
+
+		names := make([]string, len(qr.labels))
+		for j, l := range qr.labels {
+			names[j] = l.name
+		}
+
+		for j, m := range qr.metrics {
+			writeHeader(bw, m.name, "gauge", m.help)
+			if samples == nil {
+				continue
+			}
+			for _, s := range samples[j] {
+				writeSample(bw, m.name, names, s.labels, s.value)
+			}
+		}
+	}
+
+	families := []struct {
+		name, typ, help string
+		value           func(s stats) (float64, bool)
+	}{
+		{"query_duration_seconds", "gauge", "Duration of the last run of the query.", func(s stats) (float64, bool) {
+			return s.duration.Seconds(), s.runs > 0
+		}},
+		{"query_runs_total", "counter", "Runs of the query.", func(s stats) (float64, bool) {
+			return float64(s.runs), true
+		}},
+		{"query_errors_total", "counter", "Runs of the query which failed.", func(s stats) (float64, bool) {
+			return float64(s.errors), true
+		}},
+		{"query_groups", "gauge", "Groups returned by the last run of the query succeeding.", func(s stats) (float64, bool) {
+			return float64(s.groups), !s.lastSuccess.IsZero()
+		}},
+		{"query_last_success_timestamp_seconds", "gauge", "Time of the last run of the query succeeding.", func(s stats) (float64, bool) {
+			return float64(s.lastSuccess.UnixNano()) / 1e9, !s.lastSuccess.IsZero()
+		}},
+	}
+
+	for _, f := range families {
+		name := e.prefix + "_" + f.name
+		writeHeader(bw, name, f.typ, f.help)
+		for _, s := range all {
+			if v, ok := f.value(s); ok {
+				writeSample(bw, name, []string{"query"}, []string{s.name}, v)
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+func writeHeader(w *bufio.Writer, name, typ, help string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, l, labelValueEscaper.Replace(values[i]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatValue(v))
+	w.WriteByte('\n')
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	// without an exponent, like the counts of the CLI
+	if a := math.Abs(v); a == 0 || a >= 1e-6 && a < 1e15 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
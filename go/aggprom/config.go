@@ -0,0 +1,163 @@
+package aggprom
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+)
+
+// Defaults of the configuration of an exporter.
+const (
+	DefaultPrefix   = "agg"
+	DefaultInterval = time.Minute
+	DefaultTimeout  = 30 * time.Second
+)
+
+// Config lists the queries of an exporter, in YAML:
+//
+//	namespace: test
+//	interval: 1m
+//	queries:
+//	  - name: users
+//	    sql: select name, count(*) as users, sum(salary) as payroll from users group by name
+//	    interval: 30s
+//	  - name: adults
+//	    set: users
+//	    payload:
+//	      fields: {n: {func: count, expr: "1"}}
+//	      filter: rec['age'] >= 18
+//	      group_by_fields: [{alias: lname, expr: string.lower(rec['name'])}]
+//	    labels: {lname: name}
+type Config struct {
+	// Namespace is the namespace of the queries which name none.
+	Namespace string `yaml:"namespace"`
+
+	// Prefix starts the names of the metrics, DefaultPrefix when empty.
+	Prefix string `yaml:"prefix"`
+
+	// Interval and Timeout are those of the queries which set none,
+	// DefaultInterval and DefaultTimeout when 0.
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+
+	Queries []QueryConfig `yaml:"queries"`
+}
+
+// QueryConfig is a named query, a SQL statement or a payload on a set,
+// run every interval.
+type QueryConfig struct {
+	// Name is in the names of the metrics of the aggregates of the query,
+	// <prefix>_<name>_<alias>, and the query label of the others.
+	Name string `yaml:"name"`
+
+	SQL     string    `yaml:"sql"`
+	Set     string    `yaml:"set"`
+	Payload yaml.Node `yaml:"payload"`
+
+	// Labels maps the group by columns to the names of their labels. When
+	// empty, the labels are named after the columns.
+	Labels map[string]string `yaml:"labels"`
+
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// LoadConfig reads a configuration file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseConfig parses a configuration in YAML, and applies the defaults.
+func ParseConfig(data []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Prefix == "" {
+		cfg.Prefix = DefaultPrefix
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+
+	for i := range cfg.Queries {
+		qc := &cfg.Queries[i]
+		if qc.Interval == 0 {
+			qc.Interval = cfg.Interval
+		}
+		if qc.Timeout == 0 {
+			qc.Timeout = cfg.Timeout
+		}
+	}
+
+	return &cfg, nil
+}
+
+var nameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// query parses the query of qc.
+func (qc *QueryConfig) query(namespace string) (*agg.Query, error) {
+	if !nameRe.MatchString(qc.Name) {
+		return nil, fmt.Errorf("query name %q must be letters, digits and underscores", qc.Name)
+	}
+	if qc.Interval <= 0 || qc.Timeout <= 0 {
+		return nil, fmt.Errorf("query %s: interval and timeout must be positive", qc.Name)
+	}
+
+	var q *agg.Query
+	switch hasPayload := qc.Payload.Kind != 0; {
+	case qc.SQL != "" && hasPayload:
+		return nil, fmt.Errorf("query %s: both sql and payload given", qc.Name)
+	case qc.SQL != "":
+		if qc.Set != "" {
+			return nil, fmt.Errorf("query %s: the set of a SQL statement is in its FROM clause", qc.Name)
+		}
+
+		var err error
+		if q, err = agg.ParseSQL(qc.SQL); err != nil {
+			return nil, fmt.Errorf("query %s: %v", qc.Name, err)
+		}
+		if q.Namespace == "" {
+			q.Namespace = namespace
+		}
+	case hasPayload:
+		data, err := yaml.Marshal(&qc.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if q, err = agg.ParsePayload(data, namespace, qc.Set); err != nil {
+			return nil, fmt.Errorf("query %s: payload: %v", qc.Name, err)
+		}
+	default:
+		return nil, fmt.Errorf("query %s: no sql or payload given", qc.Name)
+	}
+
+	if q.Namespace == "" {
+		return nil, fmt.Errorf("query %s: no namespace given", qc.Name)
+	}
+	if err := q.Validate(); err != nil {
+		return nil, fmt.Errorf("query %s: %v", qc.Name, err)
+	}
+	if err := q.CheckSyntax(); err != nil {
+		return nil, fmt.Errorf("query %s: %v", qc.Name, err)
+	}
+	return q, nil
+}
@@ -0,0 +1,330 @@
+// Package aggserve serves aggregations over HTTP, for services without an
+// Aerospike client:
+//
+//	POST /query    {"sql": "select name, count(*) from test.users group by name"}
+//	POST /query    {"namespace": "test", "set": "users", "payload": {"fields": ...}}
+//	GET  /healthz  the server is up
+//	GET  /readyz   the backend can run queries
+//
+// Queries run on a Backend: a cluster, or records held in memory for
+// tests.
+package aggserve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	aero "github.com/aerospike/aerospike-client-go"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggfmt"
+)
+
+// Defaults of the options of a server.
+const (
+	DefaultTimeout     = 30 * time.Second
+	DefaultMaxTimeout  = 5 * time.Minute
+	DefaultMaxBodySize = 1 << 20
+
+	// readyTimeout bounds the readiness checks of the backend.
+	readyTimeout = 5 * time.Second
+)
+
+// Backend runs the queries of a server.
+type Backend interface {
+	// Execute runs q, stopping when ctx is done.
+	Execute(ctx context.Context, q *agg.Query) ([]agg.Row, error)
+
+	// Ready reports why queries cannot run, or nil.
+	Ready(ctx context.Context) error
+}
+
+// Options configure a server.
+type Options struct {
+	// Namespace is the namespace of the queries which name none.
+	Namespace string
+
+	// Timeout is the timeout of the queries which ask for none,
+	// DefaultTimeout when 0. MaxTimeout is the longest timeout a query
+	// may ask for, DefaultMaxTimeout when 0.
+	Timeout    time.Duration
+	MaxTimeout time.Duration
+
+	// Policy is the query policy of the queries which ask for no preset,
+	// the default preset when nil. The timeout of a query replaces its
+	// total timeout.
+	Policy *aero.QueryPolicy
+
+	// MaxBodySize is the size of the largest request accepted,
+	// DefaultMaxBodySize when 0.
+	MaxBodySize int64
+
+	// CallerHeader is the header naming the caller of a query in the
+	// agg.QueryLog of its aggregation, its remote address when empty or
+	// not sent.
+	CallerHeader string
+}
+
+// Request is the body of a query: a SQL statement and the arguments of
+// its placeholders, or a payload on a set.
+type Request struct {
+	SQL  string        `json:"sql,omitempty"`
+	Args []interface{} `json:"args,omitempty"`
+
+	Namespace string          `json:"namespace,omitempty"`
+	Set       string          `json:"set,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+
+	// Timeout is a duration like "500ms" or "10s".
+	Timeout string `json:"timeout,omitempty"`
+
+	// Policy is the name of a query policy preset.
+	Policy string `json:"policy,omitempty"`
+}
+
+// Response is the result of a query. Rows are objects with their columns
+// in order, counts and integral values being integers.
+type Response struct {
+	Columns []string        `json:"columns"`
+	Rows    json.RawMessage `json:"rows"`
+	Elapsed float64         `json:"elapsed_ms"`
+}
+
+// errorResponse is the body of the responses of failed requests.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Server is the HTTP handler of the queries and health checks.
+type Server struct {
+	backend Backend
+	opts    Options
+	mux     *http.ServeMux
+
+	draining int32
+}
+
+// NewServer returns a server running queries on backend.
+func NewServer(backend Backend, opts Options) *Server {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxTimeout == 0 {
+		opts.MaxTimeout = DefaultMaxTimeout
+	}
+	if opts.MaxBodySize == 0 {
+		opts.MaxBodySize = DefaultMaxBodySize
+	}
+
+	s := &Server{backend: backend, opts: opts, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/query", s.handleQuery)
+	s.mux.HandleFunc("/healthz", s.handleHealth)
+	s.mux.HandleFunc("/readyz", s.handleReady)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// caller returns the caller of the query r.
+func (s *Server) caller(r *http.Request) string {
+	if s.opts.CallerHeader != "" {
+		if caller := r.Header.Get(s.opts.CallerHeader); caller != "" {
+			return caller
+		}
+	}
+	return r.RemoteAddr
+}
+
+// Drain fails the readiness checks from then on, so load balancers stop
+// sending queries before the server shuts down.
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.draining) != 0 {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("shutting down"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	if err := s.backend.Ready(ctx); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("queries must be POSTed"))
+		return
+	}
+
+	var req Request
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.opts.MaxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request larger than %d bytes", s.opts.MaxBodySize))
+			return
+		}
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+
+	q, timeout, err := s.parse(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(agg.WithCaller(r.Context(), s.caller(r)), timeout)
+	defer cancel()
+
+	rows, err := s.backend.Execute(ctx, q)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := aggfmt.Write(&buf, "json", q, rows); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &Response{
+		Columns: q.ColumnNames(),
+		Rows:    buf.Bytes(),
+		Elapsed: float64(time.Since(start)) / float64(time.Millisecond),
+	})
+}
+
+// parse returns the query of req, with its policy, and its timeout.
+func (s *Server) parse(req *Request) (*agg.Query, time.Duration, error) {
+	var q *agg.Query
+	var err error
+
+	switch {
+	case req.SQL != "" && len(req.Payload) > 0:
+		return nil, 0, fmt.Errorf("both sql and payload given")
+	case req.SQL != "":
+		if req.Set != "" {
+			return nil, 0, fmt.Errorf("the set of a SQL statement is in its FROM clause")
+		}
+		if q, err = agg.ParseSQL(req.SQL, req.Args...); err != nil {
+			return nil, 0, err
+		}
+		if q.Namespace == "" {
+			q.Namespace = req.Namespace
+		}
+	case len(req.Payload) > 0:
+		if len(req.Args) > 0 {
+			return nil, 0, fmt.Errorf("args are for the placeholders of SQL statements")
+		}
+		if q, err = agg.ParsePayload(req.Payload, req.Namespace, req.Set); err != nil {
+			return nil, 0, fmt.Errorf("payload: %v", err)
+		}
+	default:
+		return nil, 0, fmt.Errorf("no sql or payload given")
+	}
+
+	if q.Namespace == "" {
+		q.Namespace = s.opts.Namespace
+	}
+	if q.Namespace == "" {
+		return nil, 0, fmt.Errorf("no namespace given")
+	}
+	if err := q.Validate(); err != nil {
+		return nil, 0, err
+	}
+	if err := q.CheckSyntax(); err != nil {
+		return nil, 0, err
+	}
+
+	timeout := s.opts.Timeout
+	if req.Timeout != "" {
+		if timeout, err = time.ParseDuration(req.Timeout); err != nil {
+			return nil, 0, fmt.Errorf("invalid timeout: %v", err)
+		}
+		if timeout <= 0 || timeout > s.opts.MaxTimeout {
+			return nil, 0, fmt.Errorf("timeout must be positive and at most %v", s.opts.MaxTimeout)
+		}
+	}
+
+	if q.Policy, err = s.policy(req.Policy, timeout); err != nil {
+		return nil, 0, err
+	}
+	return q, timeout, nil
+}
+
+// policy returns a copy of the policy of the server, or of preset, whose
+// total timeout is timeout.
+func (s *Server) policy(preset string, timeout time.Duration) (*aero.QueryPolicy, error) {
+	var policy *aero.QueryPolicy
+	switch {
+	case preset != "":
+		var err error
+		if policy, err = agg.NewPolicy(preset); err != nil {
+			return nil, err
+		}
+	case s.opts.Policy != nil:
+		p := *s.opts.Policy
+		policy = &p
+	default:
+		policy = aero.NewQueryPolicy()
+	}
+
+	policy.TotalTimeout = timeout
+	if policy.SocketTimeout == 0 || policy.SocketTimeout > timeout {
+		policy.SocketTimeout = timeout
+	}
+	return policy, nil
+}
+
+// errorStatus returns the status of the responses of queries failed with
+// err.
+func errorStatus(err error) int {
+	var groups *agg.TooManyGroupsError
+	var canceled *agg.CanceledError
+
+	switch {
+	case errors.As(err, &groups):
+		return http.StatusUnprocessableEntity
+	case errors.As(err, &canceled) && errors.Is(canceled.Err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case isTimeout(err):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,94 @@
+package aggserve
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	aero "github.com/aerospike/aerospike-client-go"
+	aerotypes "github.com/aerospike/aerospike-client-go/types"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+)
+
+// ClusterBackend runs queries on a cluster.
+type ClusterBackend struct {
+	Client *aero.Client
+
+	// UDF is the local copy of aggAPI.lua the client runs the final
+	// reduce with. When set, the server is ready only once the cluster
+	// runs the same version.
+	UDF []byte
+}
+
+// NewClusterBackend returns a backend running queries through client.
+func NewClusterBackend(client *aero.Client, udf []byte) *ClusterBackend {
+	return &ClusterBackend{Client: client, UDF: udf}
+}
+
+// Execute runs q on the cluster.
+func (b *ClusterBackend) Execute(ctx context.Context, q *agg.Query) ([]agg.Row, error) {
+	return q.ExecuteContext(ctx, b.Client)
+}
+
+// Ready checks the client is connected and aggAPI.lua is registered.
+func (b *ClusterBackend) Ready(ctx context.Context) error {
+	if !b.Client.IsConnected() {
+		return fmt.Errorf("not connected to the cluster")
+	}
+
+	policy := aero.NewPolicy()
+	if deadline, ok := ctx.Deadline(); ok {
+		policy.TotalTimeout = time.Until(deadline)
+	}
+
+	udfs, err := b.Client.ListUDF(policy)
+	if err != nil {
+		return err
+	}
+
+	for _, udf := range udfs {
+		if udf.Filename != agg.UDFModule+".lua" {
+			continue
+		}
+		if b.UDF != nil && udf.Hash != agg.UDFHash(b.UDF) {
+			return fmt.Errorf("%s.lua registered on the cluster differs from the local copy", agg.UDFModule)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s.lua is not registered", agg.UDFModule)
+}
+
+// LocalBackend runs queries in process, over the records of an agg.Local.
+type LocalBackend struct {
+	Local *agg.Local
+}
+
+// NewLocalBackend returns a backend running queries on l.
+func NewLocalBackend(l *agg.Local) *LocalBackend {
+	return &LocalBackend{Local: l}
+}
+
+// Execute runs q on the records of the backend.
+func (b *LocalBackend) Execute(ctx context.Context, q *agg.Query) ([]agg.Row, error) {
+	return b.Local.Execute(ctx, q)
+}
+
+// Ready returns nil: the records are in memory.
+func (b *LocalBackend) Ready(ctx context.Context) error {
+	return nil
+}
+
+// isTimeout reports whether err is a timeout of the cluster.
+func isTimeout(err error) bool {
+	ae, ok := err.(aerotypes.AerospikeError)
+	if !ok {
+		return false
+	}
+
+	switch ae.ResultCode() {
+	case aerotypes.TIMEOUT, aerotypes.QUERY_TIMEOUT:
+		return true
+	}
+	return false
+}
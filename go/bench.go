@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+func runBench(args []string) error {
+	var cfg config
+	var src querySource
+	var pf policyFlags
+	fs := newFlagSet("bench", &cfg)
+	src.flags(fs)
+	pf.flags(fs)
+	runs := fs.Int("runs", 10, "number of times the query is run")
+	concurrency := fs.Int("concurrency", 1, "number of queries run at the same time")
+	fs.Parse(args)
+
+	if *runs < 1 || *concurrency < 1 {
+		return fmt.Errorf("-runs and -concurrency must be at least 1")
+	}
+
+	q, err := src.load(&cfg, fs.Args())
+	if err != nil {
+		return err
+	}
+	if q.Namespace == "" {
+		return fmt.Errorf("no namespace given")
+	}
+	if q.Policy, err = pf.policy(); err != nil {
+		return err
+	}
+
+	client, err := cfg.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		durations []time.Duration
+		groups    int
+		firstErr  error
+	)
+
+	jobs := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				start := time.Now()
+				rows, err := q.ExecuteContext(ctx, client)
+				d := time.Since(start)
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				durations = append(durations, d)
+				groups = len(rows)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	start := time.Now()
+feed:
+	for i := 0; i < *runs; i++ {
+		select {
+		case jobs <- struct{}{}:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	total := time.Since(start)
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	var sum time.Duration
+	for _, d := range durations {
+		sum += d
+	}
+
+	fmt.Printf("runs: %d, concurrency: %d, groups: %d\n", *runs, *concurrency, groups)
+	fmt.Printf("total: %v, %.2f queries/s\n", total, float64(*runs)/total.Seconds())
+	fmt.Printf("min: %v, mean: %v, p50: %v, p95: %v, max: %v\n",
+		durations[0],
+		sum/time.Duration(len(durations)),
+		percentile(durations, 50),
+		percentile(durations, 95),
+		durations[len(durations)-1],
+	)
+	return nil
+}
+
+// percentile returns the p-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggprom"
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggserve"
+)
+
+func runExport(args []string) error {
+	var cfg config
+	var lf queryLogFlags
+	fs := newFlagSet("export", &cfg)
+	lf.flags(fs)
+	configFile := fs.String("config", env("AGG_EXPORT_CONFIG", "exporter.yaml"), "file of the queries to export (AGG_EXPORT_CONFIG)")
+	addr := fs.String("addr", env("AGG_ADDR", ":9145"), "address to serve the metrics on (AGG_ADDR)")
+	once := fs.Bool("once", false, "run the queries once, and print the metrics instead of serving them")
+	fs.Parse(args)
+
+	exportCfg, err := aggprom.LoadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	if exportCfg.Namespace == "" {
+		exportCfg.Namespace = cfg.namespace
+	}
+
+	queryLog, err := lf.setup()
+	if err != nil {
+		return err
+	}
+	defer queryLog.Close()
+
+	client, err := cfg.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	exporter, err := aggprom.NewExporter(aggserve.NewClusterBackend(client, nil), exportCfg)
+	if err != nil {
+		return err
+	}
+
+	if *once {
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		err := exporter.Refresh(ctx)
+		if werr := exporter.WriteMetrics(os.Stdout); werr != nil {
+			return werr
+		}
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	running := make(chan struct{})
+	go func() {
+		exporter.Run(ctx)
+		close(running)
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	httpSrv := &http.Server{Addr: *addr, Handler: mux}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	go func() {
+		<-sig
+		cancel()
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		httpSrv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("exporting %d queries on %s/metrics", len(exportCfg.Queries), *addr)
+	if err := httpSrv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-running
+	return nil
+}
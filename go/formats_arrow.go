@@ -0,0 +1,8 @@
+//go:build arrow
+// +build arrow
+
+package main
+
+// The arrow and parquet formats depend on Apache Arrow, and are built only
+// with the arrow tag.
+import _ "github.com/aerospike/aerospike-lua-aggregations/go/aggarrow"
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+)
+
+func runInsert(args []string) error {
+	var cfg config
+	var src querySource
+	var pf policyFlags
+	fs := newFlagSet("insert", &cfg)
+	src.flags(fs)
+	pf.flags(fs)
+	into := fs.String("into", "", "[namespace.]set the groups of a payload file are written to")
+	ttl := fs.Duration("ttl", 0, "time to live of the records, 0 for the namespace default, -1s for never")
+	concurrency := fs.Int("concurrency", agg.DefaultInsertConcurrency, "number of groups written at the same time")
+	fs.Parse(args)
+
+	var ins *agg.Insert
+	switch {
+	case src.file != "":
+		if *into == "" {
+			return fmt.Errorf("-into is required with a payload file")
+		}
+		q, err := src.load(&cfg, fs.Args())
+		if err != nil {
+			return err
+		}
+
+		ins = agg.NewInsert(q, "", *into)
+		if i := strings.IndexByte(*into, '.'); i >= 0 {
+			ins.Namespace, ins.Set = (*into)[:i], (*into)[i+1:]
+		}
+	case fs.NArg() > 0:
+		if *into != "" {
+			return fmt.Errorf("-into is for payload files, INSERT INTO names the set")
+		}
+
+		var err error
+		if ins, err = agg.ParseInsert(strings.Join(fs.Args(), " ")); err != nil {
+			return err
+		}
+		if ins.Query.Namespace == "" {
+			ins.Query.Namespace = cfg.namespace
+		}
+		if err := src.apply(ins.Query); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("no INSERT statement or payload file given")
+	}
+
+	if ins.Query.Namespace == "" {
+		return fmt.Errorf("no namespace given")
+	}
+
+	ins.TTL = *ttl
+	ins.Concurrency = *concurrency
+	policy, err := pf.policy()
+	if err != nil {
+		return err
+	}
+	ins.Query.Policy = policy
+
+	if err := ins.Validate(); err != nil {
+		return err
+	}
+
+	client, err := cfg.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	n, err := ins.ExecuteContext(ctx, client)
+	if err != nil {
+		return fmt.Errorf("%v (%d groups written)", err, n)
+	}
+
+	namespace := ins.Namespace
+	if namespace == "" {
+		namespace = ins.Query.Namespace
+	}
+	fmt.Printf("%d groups written to %s.%s\n", n, namespace, ins.Set)
+	return nil
+}
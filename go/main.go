@@ -1,121 +1,171 @@
+// Command aggctl registers the aggAPI.lua UDF and runs aggregations through it.
+//
+//	aggctl register
+//	aggctl status
+//	aggctl query -n test "select name, count(*) from users group by name"
+//	aggctl query -n test -s users -f payload.yaml
+//	aggctl explain -f payload.yaml
+//	aggctl validate "select sum(age) from test.users"
+//	aggctl bench -runs 20 -concurrency 4 "select count(*) from test.users"
+//	aggctl repl -n test -s users
+//	aggctl serve -n test -addr :8080
+//	aggctl export -config exporter.yaml -addr :9145
+//
+// The connection flags default to the AGG_HOST, AGG_PORT, AGG_USER,
+// AGG_PASSWORD, AGG_NAMESPACE, AGG_SET and AGG_LUA_DIR environment variables.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 
 	aero "github.com/aerospike/aerospike-client-go"
 )
 
-var (
-	host        = flag.String("h", "127.0.0.1", "host")
-	port        = flag.Int("p", 3000, "port")
-	user        = flag.String("U", "", "User.")
-	password    = flag.String("P", "", "Password.")
-	currentPath = flag.String("dir", "", "Lua Path")
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
 
-	// currentPath string
-)
+var commands = []command{
+	{"register", "register aggAPI.lua on the cluster", runRegister},
+	{"status", "show whether aggAPI.lua is registered and up to date", runStatus},
+	{"query", "run a SQL statement or a payload file", runQuery},
+	{"explain", "show the payload and Lua chunks a query compiles to", runExplain},
+	{"validate", "check a query without running it", runValidate},
+	{"insert", "write the groups of a query into a set", runInsert},
+	{"bench", "run a query repeatedly and report its latency", runBench},
+	{"repl", "run queries interactively", runRepl},
+	{"serve", "serve queries over HTTP", runServe},
+	{"export", "export the aggregates of queries as Prometheus metrics", runExport},
+}
 
 func main() {
-	flag.Parse()
-
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	log.SetOutput(os.Stdout)
+	log.SetOutput(os.Stderr)
 	log.SetFlags(0)
 
-	clientPolicy := aero.NewClientPolicy()
-	if *user != "" {
-		clientPolicy.User = *user
-		clientPolicy.Password = *password
-	}
-
-	client, err := aero.NewClientWithPolicyAndHost(clientPolicy, aero.NewHost(*host, *port))
-	if err != nil {
-		log.Fatalln("Error connecting to the DB:", err)
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
 	}
-	defer client.Close()
 
-	if len(*currentPath) == 0 {
-		*currentPath, err = os.Getwd()
-		if err != nil {
-			log.Println(err)
+	name := os.Args[1]
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				log.Fatalln(err)
+			}
+			return
 		}
 	}
 
-	if err := setupDB(client); err != nil {
-		log.Fatalln("Error registering the UDF:", err)
+	if name != "help" && name != "-help" && name != "--help" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
 	}
+	usage()
+	os.Exit(2)
+}
 
-	aero.SetLuaPath(filepath.Clean(*currentPath) + "/")
-	if err := queryAggregate(client, "test", "test"); err != nil {
-		log.Fatalln(err)
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: aggctl <command> [flags] [args]\n\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
 	}
+	fmt.Fprintln(os.Stderr, "\nrun `aggctl <command> -help` for the flags of a command")
 }
 
-func queryAggregate(client *aero.Client, nsName, setName string) error {
-	stm := aero.NewStatement(nsName, setName)
-
-	functionArgsMap := map[string]interface{}{
-		"fields": map[string]interface{}{
-			"name":              "name",
-			"doesnt_exist":      "doesnt_exist",
-			"max(doesnt_exist)": map[string]string{"func": "max", "expr": "rec['doesnt_exist']"},
-			"max(age)":          map[string]string{"func": "max", "expr": "rec['age']"},
-			"count(age)":        map[string]string{"func": "count", "expr": "rec['age'] ~= nil and 1"},
-			"min(age)":          map[string]string{"func": "min", "expr": "rec['age']"},
-			"sum(age*salary)":   map[string]string{"func": "sum", "expr": "(rec['age']  or 0) * (rec['salary'] or 0)"},
-			"sum(age)":          map[string]string{"func": "sum", "expr": "rec['age']"},
-		},
-		"filter": "rec['age'] ~= nil and rec['age'] > 25",
-		"group_by_fields": []string{
-			"name",
-			"lastname",
-		},
-	}
+// config holds the connection flags shared by all commands.
+type config struct {
+	host      string
+	port      int
+	user      string
+	password  string
+	namespace string
+	set       string
+	luaDir    string
+}
 
-	recordset, err := client.QueryAggregate(nil, stm, "aggAPI", "select_agg_records", aero.NewValue(functionArgsMap))
-	defer recordset.Close()
+func newFlagSet(name string, cfg *config) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
 
+	port, err := strconv.Atoi(env("AGG_PORT", "3000"))
 	if err != nil {
-		return err
+		port = 3000
 	}
 
-	for result := range recordset.Results() {
-		if result.Err != nil {
-			return result.Err
-		}
+	fs.StringVar(&cfg.host, "h", env("AGG_HOST", "127.0.0.1"), "host (AGG_HOST)")
+	fs.IntVar(&cfg.port, "p", port, "port (AGG_PORT)")
+	fs.StringVar(&cfg.user, "U", env("AGG_USER", ""), "user (AGG_USER)")
+	fs.StringVar(&cfg.password, "P", env("AGG_PASSWORD", ""), "password (AGG_PASSWORD)")
+	fs.StringVar(&cfg.namespace, "n", env("AGG_NAMESPACE", ""), "namespace (AGG_NAMESPACE)")
+	fs.StringVar(&cfg.set, "s", env("AGG_SET", ""), "set (AGG_SET)")
+	fs.StringVar(&cfg.luaDir, "dir", env("AGG_LUA_DIR", ""), "directory of aggAPI.lua, defaults to the working directory (AGG_LUA_DIR)")
+	return fs
+}
 
-		// pp.Println(result.Record.Bins["SUCCESS"])
-		fmt.Println("DONE!", len(result.Record.Bins["SUCCESS"].(map[interface{}]interface{})))
+func env(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
 	}
-
-	return nil
+	return def
 }
 
-func setupDB(client *aero.Client) error {
-	fileName := filepath.Join(*currentPath, "aggAPI.lua")
-	luaFile, err := ioutil.ReadFile(fileName)
-	if err != nil {
-		return err
+// connect connects to the cluster and sets the Lua path the client runs
+// the final reduce from.
+func (cfg *config) connect() (*aero.Client, error) {
+	clientPolicy := aero.NewClientPolicy()
+	if cfg.user != "" {
+		clientPolicy.User = cfg.user
+		clientPolicy.Password = cfg.password
 	}
 
-	regTask, err := client.RegisterUDF(nil, luaFile, "aggAPI.lua", aero.LUA)
+	client, err := aero.NewClientWithPolicyAndHost(clientPolicy, aero.NewHost(cfg.host, cfg.port))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("error connecting to the DB: %v", err)
 	}
 
-	// wait until UDF is created
-	err = <-regTask.OnComplete()
+	dir, err := cfg.luaPath()
 	if err != nil {
-		return err
+		client.Close()
+		return nil, err
 	}
+	aero.SetLuaPath(dir + string(filepath.Separator))
+
+	return client, nil
+}
+
+func (cfg *config) luaPath() (string, error) {
+	if cfg.luaDir != "" {
+		return filepath.Clean(cfg.luaDir), nil
+	}
+	return os.Getwd()
+}
+
+// interruptContext returns a context canceled by an interrupt, so Ctrl-C
+// stops the query being run.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sig)
+	}()
 
-	return nil
+	return ctx, cancel
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	aero "github.com/aerospike/aerospike-client-go"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+)
+
+// policyFlags are the query policy flags, a preset and the settings
+// overriding it.
+type policyFlags struct {
+	fs *flag.FlagSet
+
+	preset              string
+	totalTimeout        time.Duration
+	socketTimeout       time.Duration
+	maxRetries          int
+	maxConcurrentNodes  int
+	recordQueueSize     int
+	failOnClusterChange bool
+}
+
+func (pf *policyFlags) flags(fs *flag.FlagSet) {
+	pf.fs = fs
+
+	fs.StringVar(&pf.preset, "policy", env("AGG_POLICY", agg.PolicyDefault), fmt.Sprintf("query policy preset, one of %s (AGG_POLICY)", strings.Join(agg.PolicyPresets(), ", ")))
+	fs.DurationVar(&pf.totalTimeout, "total-timeout", 0, "total timeout of the query, 0 for none")
+	fs.DurationVar(&pf.socketTimeout, "socket-timeout", 0, "network timeout of the nodes, 0 for none")
+	fs.IntVar(&pf.maxRetries, "max-retries", 0, "maximum number of retries")
+	fs.IntVar(&pf.maxConcurrentNodes, "max-concurrent-nodes", 0, "maximum number of nodes queried at the same time, 0 for all")
+	fs.IntVar(&pf.recordQueueSize, "record-queue-size", 0, "number of results queued from the nodes")
+	fs.BoolVar(&pf.failOnClusterChange, "fail-on-cluster-change", false, "fail when the cluster changes during the query")
+}
+
+// policy returns the preset, with the settings of the flags given on the
+// command line.
+func (pf *policyFlags) policy() (*aero.QueryPolicy, error) {
+	policy, err := agg.NewPolicy(pf.preset)
+	if err != nil {
+		return nil, err
+	}
+
+	pf.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "total-timeout":
+			policy.TotalTimeout = pf.totalTimeout
+		case "socket-timeout":
+			policy.SocketTimeout = pf.socketTimeout
+		case "max-retries":
+			policy.MaxRetries = pf.maxRetries
+		case "max-concurrent-nodes":
+			policy.MaxConcurrentNodes = pf.maxConcurrentNodes
+		case "record-queue-size":
+			policy.RecordQueueSize = pf.recordQueueSize
+		case "fail-on-cluster-change":
+			policy.FailOnClusterChange = pf.failOnClusterChange
+		}
+	})
+
+	return policy, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggfmt"
+)
+
+// querySource is the query of a command, either a SQL statement in the
+// arguments or a payload file.
+type querySource struct {
+	file      string
+	index     string
+	maxGroups int
+	others    bool
+}
+
+func (src *querySource) flags(fs *flag.FlagSet) {
+	fs.StringVar(&src.file, "f", "", "JSON or YAML payload file, - for stdin, instead of a SQL statement")
+	fs.StringVar(&src.index, "index", "", "secondary index predicate, bin=value or bin=begin..end for integers")
+	fs.IntVar(&src.maxGroups, "max-groups", 0, fmt.Sprintf("maximum number of groups, %d by default, -1 for no limit", agg.DefaultMaxGroups))
+	fs.BoolVar(&src.others, "others", false, "accumulate the groups over -max-groups into others rows instead of failing")
+}
+
+// load parses the query, defaulting its namespace and set to the flags.
+func (src *querySource) load(cfg *config, args []string) (*agg.Query, error) {
+	var q *agg.Query
+
+	switch {
+	case src.file != "" && len(args) > 0:
+		return nil, fmt.Errorf("both a payload file and a SQL statement given")
+	case src.file != "":
+		var data []byte
+		var err error
+		if src.file == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(src.file)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if q, err = agg.ParsePayload(data, cfg.namespace, cfg.set); err != nil {
+			return nil, fmt.Errorf("%s: %v", src.file, err)
+		}
+	case len(args) > 0:
+		var err error
+		if q, err = agg.ParseSQL(strings.Join(args, " ")); err != nil {
+			return nil, err
+		}
+		if q.Namespace == "" {
+			q.Namespace = cfg.namespace
+		}
+	default:
+		return nil, fmt.Errorf("no SQL statement or payload file given")
+	}
+
+	if err := src.apply(q); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// apply sets the options of the flags on q, and checks it.
+func (src *querySource) apply(q *agg.Query) error {
+	if src.maxGroups != 0 {
+		q.MaxGroups = src.maxGroups
+	}
+	if src.others {
+		q.Others = true
+	}
+
+	if src.index != "" {
+		index, err := parseIndexFilter(src.index)
+		if err != nil {
+			return err
+		}
+		q.Index = index
+	}
+
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	return q.CheckSyntax()
+}
+
+// parseIndexFilter parses bin=value or bin=begin..end; values which are
+// integers select integers, and strings otherwise.
+func parseIndexFilter(s string) (*agg.IndexFilter, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid index predicate %q, expected bin=value or bin=begin..end", s)
+	}
+	bin, value := s[:i], s[i+1:]
+
+	if j := strings.Index(value, ".."); j >= 0 {
+		begin, err1 := strconv.ParseInt(value[:j], 10, 64)
+		end, err2 := strconv.ParseInt(value[j+2:], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid index range %q, expected integers", value)
+		}
+		return &agg.IndexFilter{Bin: bin, Begin: begin, End: end}, nil
+	}
+
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return &agg.IndexFilter{Bin: bin, Value: n}, nil
+	}
+	return &agg.IndexFilter{Bin: bin, Value: value}, nil
+}
+
+func runQuery(args []string) error {
+	var cfg config
+	var src querySource
+	var pf policyFlags
+	var lf queryLogFlags
+	fs := newFlagSet("query", &cfg)
+	src.flags(fs)
+	pf.flags(fs)
+	lf.flags(fs)
+	format := formatFlag(fs)
+	progress := fs.Bool("progress", false, "print the partial aggregate of each node to stderr as it arrives")
+	fs.Parse(args)
+
+	if _, err := aggfmt.Lookup(*format); err != nil {
+		return err
+	}
+
+	q, err := src.load(&cfg, fs.Args())
+	if err != nil {
+		return err
+	}
+	if q.Namespace == "" {
+		return fmt.Errorf("no namespace given")
+	}
+	if q.Policy, err = pf.policy(); err != nil {
+		return err
+	}
+
+	queryLog, err := lf.setup()
+	if err != nil {
+		return err
+	}
+	defer queryLog.Close()
+
+	client, err := cfg.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	var rows []agg.Row
+	if *progress {
+		rows, err = q.ExecutePartials(ctx, client, printPartial)
+	} else {
+		rows, err = q.ExecuteContext(ctx, client)
+	}
+	if err != nil {
+		return err
+	}
+
+	return aggfmt.Write(os.Stdout, *format, q, rows)
+}
+
+// printPartial prints the progress of a query to stderr.
+func printPartial(p *agg.Partial) {
+	fmt.Fprintf(os.Stderr, "[%d/%d] node %s (%s): %d records, %d groups in %v\n",
+		p.Done, p.Nodes, p.Node, p.Host, p.Records, len(p.Rows), p.Elapsed.Round(time.Millisecond))
+}
+
+func formatFlag(fs *flag.FlagSet) *string {
+	return fs.String("format", env("AGG_FORMAT", "table"), fmt.Sprintf("output format, one of %s (AGG_FORMAT)", strings.Join(aggfmt.Names(), ", ")))
+}
+
+func runExplain(args []string) error {
+	var cfg config
+	var src querySource
+	fs := newFlagSet("explain", &cfg)
+	src.flags(fs)
+	asJSON := fs.Bool("json", false, "print the plan as JSON")
+	fs.Parse(args)
+
+	q, err := src.load(&cfg, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	plan := q.Explain()
+	if !*asJSON {
+		fmt.Print(plan)
+		return nil
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plan)
+}
+
+func runValidate(args []string) error {
+	var cfg config
+	var src querySource
+	fs := newFlagSet("validate", &cfg)
+	src.flags(fs)
+	fs.Parse(args)
+
+	if _, err := src.load(&cfg, fs.Args()); err != nil {
+		return err
+	}
+
+	fmt.Println("ok")
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+)
+
+// queryLogFlags are the flags logging the aggregations, as JSON lines.
+type queryLogFlags struct {
+	file     string
+	slow     time.Duration
+	slowOnly bool
+	redact   bool
+}
+
+func (lf *queryLogFlags) flags(fs *flag.FlagSet) {
+	fs.StringVar(&lf.file, "query-log", env("AGG_QUERY_LOG", ""), "file the aggregations are logged to, - for stderr, none when empty (AGG_QUERY_LOG)")
+	fs.DurationVar(&lf.slow, "slow-query", 0, "duration from which an aggregation is logged as slow, 0 for none")
+	fs.BoolVar(&lf.slowOnly, "slow-only", false, "only log the slow and failed aggregations")
+	fs.BoolVar(&lf.redact, "redact", false, "replace the literals of the expressions and filters logged with ?")
+}
+
+// setup sets the query log of the flags, and returns the log file to
+// close once done.
+func (lf *queryLogFlags) setup() (io.Closer, error) {
+	var w io.WriteCloser
+	switch lf.file {
+	case "":
+		return ioutil.NopCloser(nil), nil
+	case "-":
+		w = nopWriteCloser{os.Stderr}
+	default:
+		f, err := os.OpenFile(lf.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	agg.SetQueryLog(agg.QueryLogOptions{
+		Log:           agg.NewJSONQueryLog(w),
+		SlowThreshold: lf.slow,
+		SlowOnly:      lf.slowOnly,
+		Redact:        lf.redact,
+	})
+	return w, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
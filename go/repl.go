@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	aero "github.com/aerospike/aerospike-client-go"
+	"github.com/peterh/liner"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggfmt"
+)
+
+const replHelp = `Enter a SQL statement ending with ;, or a JSON payload, run on the current
+namespace and set. Meta-commands:
+
+  \namespace <name>   switch namespace (\n)
+  \set <name>         switch set (\s)
+  \format [name]      show or switch the output format
+  \timing [on|off]    toggle printing the duration of queries
+  \bins               show the bins sampled from the current set
+  \help               show this help (\?)
+  \quit               exit (\q, Ctrl-D)
+`
+
+var (
+	metaCommands = []string{`\namespace`, `\set`, `\format`, `\timing`, `\bins`, `\help`, `\quit`}
+
+	sqlWords = []string{
+		"select", "from", "union", "all", "join", "left", "inner", "outer", "on", "where", "group", "by", "rollup", "cube", "grouping", "sets",
+		"filter", "as", "and", "or", "not", "is", "null", "like", "between", "in",
+		"count", "sum", "min", "max", "lower", "upper", "length", "substr",
+		"abs", "floor", "ceil", "time_bucket", "date_trunc", "source_set",
+	}
+)
+
+// replSession is the state of an interactive session.
+type replSession struct {
+	client *aero.Client
+	policy *aero.QueryPolicy
+	out    io.Writer
+
+	namespace string
+	set       string
+	format    string
+	timing    bool
+
+	sampleSize int
+	bins       map[string][]string // sampled bins, by namespace.set
+}
+
+func runRepl(args []string) error {
+	var cfg config
+	var pf policyFlags
+	fs := newFlagSet("repl", &cfg)
+	pf.flags(fs)
+	format := formatFlag(fs)
+	sampleSize := fs.Int("sample", 100, "number of records sampled to complete bin names")
+	fs.Parse(args)
+
+	if _, err := aggfmt.Lookup(*format); err != nil {
+		return err
+	}
+	policy, err := pf.policy()
+	if err != nil {
+		return err
+	}
+
+	client, err := cfg.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	s := &replSession{
+		client:     client,
+		policy:     policy,
+		out:        os.Stdout,
+		namespace:  cfg.namespace,
+		set:        cfg.set,
+		format:     *format,
+		sampleSize: *sampleSize,
+		bins:       map[string][]string{},
+	}
+	return s.run()
+}
+
+func (s *replSession) run() error {
+	line := liner.NewLiner()
+	defer line.Close()
+
+	line.SetCtrlCAborts(true)
+	line.SetMultiLineMode(true)
+	line.SetWordCompleter(s.complete)
+
+	historyFile := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		historyFile = filepath.Join(home, ".aggctl_history")
+		if f, err := os.Open(historyFile); err == nil {
+			line.ReadHistory(f)
+			f.Close()
+		}
+	}
+
+	fmt.Fprintln(s.out, `aggctl repl, type \help for help`)
+
+	var input []string
+	for {
+		prompt := fmt.Sprintf("%s.%s> ", s.namespace, s.set)
+		if len(input) > 0 {
+			prompt = strings.Repeat(" ", len(prompt)-4) + "..> "
+		}
+
+		text, err := line.Prompt(prompt)
+		if err == liner.ErrPromptAborted {
+			// Ctrl-C discards the statement being entered
+			input = nil
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				fmt.Fprintln(s.out)
+				break
+			}
+			return err
+		}
+
+		if len(input) == 0 && strings.TrimSpace(text) == "" {
+			continue
+		}
+		input = append(input, text)
+
+		stmt := strings.TrimSpace(strings.Join(input, "\n"))
+		if !isComplete(stmt) {
+			continue
+		}
+		input = nil
+
+		line.AppendHistory(stmt)
+
+		err = s.exec(stmt)
+		if err == errQuit {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(s.out, "error:", err)
+		}
+	}
+
+	if historyFile != "" {
+		if f, err := os.Create(historyFile); err == nil {
+			line.WriteHistory(f)
+			f.Close()
+		}
+	}
+	return nil
+}
+
+var errQuit = errors.New("quit")
+
+// isComplete reports whether stmt can be run: meta-commands are a single
+// line, SQL statements end with a semicolon and payloads with the brace
+// closing the first one.
+func isComplete(stmt string) bool {
+	switch {
+	case strings.HasPrefix(stmt, `\`):
+		return true
+	case strings.HasPrefix(stmt, "{"):
+		return closesPayload(stmt)
+	default:
+		return strings.HasSuffix(stmt, ";")
+	}
+}
+
+func closesPayload(stmt string) bool {
+	depth := 0
+	inString, escaped := false, false
+	for _, r := range stmt {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && r == '\\':
+			escaped = true
+		case r == '"':
+			inString = !inString
+		case inString:
+		case r == '{':
+			depth++
+		case r == '}':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+func (s *replSession) exec(stmt string) error {
+	if strings.HasPrefix(stmt, `\`) {
+		return s.meta(strings.Fields(stmt))
+	}
+
+	var q *agg.Query
+	var err error
+	if strings.HasPrefix(stmt, "{") {
+		if s.set == "" {
+			return fmt.Errorf(`no set selected, use \set <name>`)
+		}
+		q, err = agg.ParsePayload([]byte(stmt), s.namespace, s.set)
+	} else {
+		q, err = agg.ParseSQL(strings.TrimSuffix(stmt, ";"))
+		if err == nil && q.Namespace == "" {
+			q.Namespace = s.namespace
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if q.Namespace == "" {
+		return fmt.Errorf(`no namespace selected, use \namespace <name>`)
+	}
+	if err := q.CheckSyntax(); err != nil {
+		return err
+	}
+
+	// Ctrl-C cancels the query, the prompt is not reading the terminal
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	q.Policy = s.policy
+	start := time.Now()
+	rows, err := q.ExecuteContext(ctx, s.client)
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	if err := aggfmt.Write(s.out, s.format, q, rows); err != nil {
+		return err
+	}
+	if s.timing {
+		fmt.Fprintf(s.out, "Time: %v\n", elapsed.Round(time.Microsecond))
+	}
+	return nil
+}
+
+func (s *replSession) meta(args []string) error {
+	arg := ""
+	if len(args) > 1 {
+		arg = args[1]
+	}
+
+	switch args[0] {
+	case `\namespace`, `\n`:
+		if arg == "" {
+			return fmt.Errorf(`usage: \namespace <name>`)
+		}
+		s.namespace = arg
+	case `\set`, `\s`:
+		s.set = arg
+	case `\format`:
+		if arg == "" {
+			fmt.Fprintf(s.out, "format is %s, one of %s\n", s.format, strings.Join(aggfmt.Names(), ", "))
+			return nil
+		}
+		if _, err := aggfmt.Lookup(arg); err != nil {
+			return err
+		}
+		s.format = arg
+	case `\timing`:
+		switch arg {
+		case "":
+			s.timing = !s.timing
+		case "on":
+			s.timing = true
+		case "off":
+			s.timing = false
+		default:
+			return fmt.Errorf(`usage: \timing [on|off]`)
+		}
+		fmt.Fprintf(s.out, "timing is %s\n", map[bool]string{true: "on", false: "off"}[s.timing])
+	case `\bins`:
+		bins, err := s.sampleBins()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(s.out, strings.Join(bins, " "))
+	case `\help`, `\?`:
+		fmt.Fprint(s.out, replHelp)
+	case `\quit`, `\q`:
+		return errQuit
+	default:
+		return fmt.Errorf(`unknown command %s, type \help for help`, args[0])
+	}
+	return nil
+}
+
+// sampleBins returns the names of the bins of the first records of the
+// current set, scanning it the first time.
+func (s *replSession) sampleBins() ([]string, error) {
+	if s.namespace == "" || s.set == "" {
+		return nil, nil
+	}
+
+	key := s.namespace + "." + s.set
+	if bins, exists := s.bins[key]; exists {
+		return bins, nil
+	}
+
+	recordset, err := s.client.ScanAll(nil, s.namespace, s.set)
+	if err != nil {
+		return nil, err
+	}
+	defer recordset.Close()
+
+	seen := map[string]bool{}
+	n := 0
+	for result := range recordset.Results() {
+		if result.Err != nil {
+			return nil, result.Err
+		}
+
+		for bin := range result.Record.Bins {
+			seen[bin] = true
+		}
+
+		if n++; n >= s.sampleSize {
+			break
+		}
+	}
+
+	bins := make([]string, 0, len(seen))
+	for bin := range seen {
+		bins = append(bins, bin)
+	}
+	sort.Strings(bins)
+
+	s.bins[key] = bins
+	return bins, nil
+}
+
+// complete completes meta-commands, formats, SQL keywords and functions,
+// and the bins sampled from the current set.
+func (s *replSession) complete(line string, pos int) (head string, completions []string, tail string) {
+	head, tail = line[:pos], line[pos:]
+
+	start := strings.LastIndexFunc(head, func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '\\')
+	}) + 1
+	word := head[start:]
+	head = head[:start]
+
+	var candidates []string
+	switch {
+	case strings.HasPrefix(line, `\format `):
+		candidates = aggfmt.Names()
+	case strings.HasPrefix(word, `\`):
+		candidates = metaCommands
+	case strings.HasPrefix(line, `\`):
+		return
+	default:
+		bins, _ := s.sampleBins()
+		candidates = append(append(candidates, bins...), sqlWords...)
+	}
+
+	for _, c := range candidates {
+		if strings.HasPrefix(strings.ToLower(c), strings.ToLower(word)) {
+			completions = append(completions, c)
+		}
+	}
+	return head, completions, tail
+}
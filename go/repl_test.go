@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsComplete(t *testing.T) {
+	for _, tc := range []struct {
+		stmt     string
+		complete bool
+	}{
+		{`\set users`, true},
+		{`\format`, true},
+		{"select name, count(*)\nfrom users", false},
+		{"select name, count(*)\nfrom users\ngroup by name;", true},
+		{`{"fields": {"n": {"func": "count", "expr": "1"}}`, false},
+		{"{\"fields\": {\"n\": {\"func\": \"count\", \"expr\": \"1\"}}\n}", true},
+		// braces in strings do not count
+		{`{"filter": "string.find(rec['name'], '}') ~= nil"`, false},
+		{`{"filter": "string.find(rec['name'], '{') ~= nil"}`, true},
+		// nor escaped quotes
+		{`{"filter": "rec['name'] == \"}\""`, false},
+		{`{"filter": "rec['name'] == \"{\""}`, true},
+		{`{"filter": "rec['path'] == '\\'"}`, true},
+	} {
+		if got := isComplete(tc.stmt); got != tc.complete {
+			t.Errorf("isComplete(%q) = %v, want %v", tc.stmt, got, tc.complete)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	s := &replSession{
+		namespace: "test",
+		set:       "users",
+		bins:      map[string][]string{"test.users": {"age", "country", "name"}},
+	}
+
+	for _, tc := range []struct {
+		line        string
+		pos         int
+		head        string
+		completions []string
+		tail        string
+	}{
+		{`\fo`, 3, ``, []string{`\format`}, ``},
+		{`\s`, 2, ``, []string{`\set`}, ``},
+		{`\format t`, 9, `\format `, []string{"table", "tsv"}, ``},
+		{`\format n`, 9, `\format `, []string{"ndjson"}, ``},
+		{`\set u`, 6, `\set `, nil, ``},
+		{"select na", 9, "select ", []string{"name"}, ""},
+		{"SELECT COU", 10, "SELECT ", []string{"country", "count"}, ""},
+		{"select co from users", 9, "select ", []string{"country", "count"}, " from users"},
+		{"select name\nfrom users gr", 25, "select name\nfrom users ", []string{"group", "grouping"}, ""},
+	} {
+		head, completions, tail := s.complete(tc.line, tc.pos)
+		if head != tc.head || !reflect.DeepEqual(completions, tc.completions) || tail != tc.tail {
+			t.Errorf("complete(%q, %d) = %q, %q, %q, want %q, %q, %q", tc.line, tc.pos, head, completions, tail, tc.head, tc.completions, tc.tail)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggserve"
+)
+
+func runServe(args []string) error {
+	var cfg config
+	var pf policyFlags
+	var lf queryLogFlags
+	fs := newFlagSet("serve", &cfg)
+	pf.flags(fs)
+	lf.flags(fs)
+	addr := fs.String("addr", env("AGG_ADDR", ":8080"), "address to listen on (AGG_ADDR)")
+	timeout := fs.Duration("timeout", aggserve.DefaultTimeout, "timeout of the queries which ask for none")
+	maxTimeout := fs.Duration("max-timeout", aggserve.DefaultMaxTimeout, "longest timeout a query may ask for")
+	grace := fs.Duration("grace", 30*time.Second, "time the queries running are given to finish on shutdown")
+	callerHeader := fs.String("caller-header", env("AGG_CALLER_HEADER", ""), "header naming the caller of the queries logged, their remote address when not sent (AGG_CALLER_HEADER)")
+	fs.Parse(args)
+
+	policy, err := pf.policy()
+	if err != nil {
+		return err
+	}
+
+	queryLog, err := lf.setup()
+	if err != nil {
+		return err
+	}
+	defer queryLog.Close()
+
+	client, err := cfg.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// checked by the readiness endpoint, when found
+	udf, _ := readUDF(&cfg)
+
+	srv := aggserve.NewServer(aggserve.NewClusterBackend(client, udf), aggserve.Options{
+		Namespace:    cfg.namespace,
+		Timeout:      *timeout,
+		MaxTimeout:   *maxTimeout,
+		Policy:       policy,
+		CallerHeader: *callerHeader,
+	})
+	httpSrv := &http.Server{Addr: *addr, Handler: srv}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	done := make(chan error, 1)
+	go func() {
+		<-sig
+		log.Printf("shutting down, waiting %v for the queries running", *grace)
+		srv.Drain()
+
+		ctx, cancel := context.WithTimeout(context.Background(), *grace)
+		defer cancel()
+
+		if err := httpSrv.Shutdown(ctx); err != nil {
+			// closing their connections cancels the queries still running
+			httpSrv.Close()
+			done <- fmt.Errorf("queries still running after %v were canceled", *grace)
+			return
+		}
+		done <- nil
+	}()
+
+	log.Printf("serving queries on %s", *addr)
+	if err := httpSrv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-done
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	aero "github.com/aerospike/aerospike-client-go"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+)
+
+const udfFileName = agg.UDFModule + ".lua"
+
+func runRegister(args []string) error {
+	var cfg config
+	fs := newFlagSet("register", &cfg)
+	fs.Parse(args)
+
+	luaFile, err := readUDF(&cfg)
+	if err != nil {
+		return err
+	}
+
+	client, err := cfg.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	if err := agg.RegisterUDF(ctx, client, luaFile); err != nil {
+		return err
+	}
+
+	fmt.Printf("registered %s (%s)\n", udfFileName, agg.UDFHash(luaFile))
+	return nil
+}
+
+func runStatus(args []string) error {
+	var cfg config
+	fs := newFlagSet("status", &cfg)
+	fs.Parse(args)
+
+	client, err := cfg.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	udfs, err := client.ListUDF(nil)
+	if err != nil {
+		return err
+	}
+
+	var registered *aero.UDF
+	for _, udf := range udfs {
+		if udf.Filename == udfFileName {
+			registered = udf
+			break
+		}
+	}
+
+	if registered == nil {
+		fmt.Printf("%s is not registered\n", udfFileName)
+		return nil
+	}
+	fmt.Printf("%s is registered (%s)\n", udfFileName, registered.Hash)
+
+	// compare with the local copy, which the client runs the final reduce with
+	luaFile, err := readUDF(&cfg)
+	if err != nil {
+		fmt.Printf("local copy: %v\n", err)
+		return nil
+	}
+
+	if hash := agg.UDFHash(luaFile); hash != registered.Hash {
+		fmt.Printf("local copy differs (%s), run `aggctl register` to update it\n", hash)
+	} else {
+		fmt.Println("local copy is up to date")
+	}
+	return nil
+}
+
+func readUDF(cfg *config) ([]byte, error) {
+	dir, err := cfg.luaPath()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filepath.Join(dir, udfFileName))
+}
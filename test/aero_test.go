@@ -1,11 +1,14 @@
 package main_test
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"path/filepath"
 
 	aero "github.com/aerospike/aerospike-client-go"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
 )
 
 func aeroClient(host string, port int, user, password, currentPath string) (*aero.Client, error) {
@@ -52,11 +55,10 @@ func aeroQuery(client *aero.Client, nsName, setName string, payload map[string]i
 	stm := aero.NewStatement(nsName, setName)
 
 	recordset, err := client.QueryAggregate(nil, stm, "aggAPI", "select_agg_records", aero.NewValue(payload))
-	defer recordset.Close()
-
 	if err != nil {
 		return nil, err
 	}
+	defer recordset.Close()
 
 	res := []map[string]interface{}{}
 	for result := range recordset.Results() {
@@ -84,6 +86,23 @@ func aeroQuery(client *aero.Client, nsName, setName string, payload map[string]i
 	return res, nil
 }
 
+// aeroRows converts the rows of agg.Query.Execute like aeroQuery does.
+func aeroRows(rows []agg.Row) []map[string]interface{} {
+	res := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		res[i] = map[string]interface{}{}
+		for k, v := range row {
+			switch v := v.(type) {
+			case int64, int, float64:
+				res[i][k] = toInt64(v)
+			case string:
+				res[i][k] = v
+			}
+		}
+	}
+	return res
+}
+
 func genAeroData(client *aero.Client, ns, set string, data []map[string]interface{}) error {
 	err := client.Truncate(nil, ns, set, nil)
 	if err != nil {
@@ -113,16 +132,26 @@ func aeroSetupDB(client *aero.Client, currentPath string) error {
 		return err
 	}
 
-	regTask, err := client.RegisterUDF(nil, luaFile, "aggAPI.lua", aero.LUA)
+	return agg.RegisterUDF(context.Background(), client, luaFile)
+}
+
+// newLocal returns an in process backend holding recs in the test set.
+func newLocal(recs []map[string]interface{}) (*agg.Local, error) {
+	path := *currentPath
+	if path == "" {
+		path = ".."
+	}
+	udf, err := ioutil.ReadFile(filepath.Join(path, "aggAPI.lua"))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// wait until UDF is created
-	err = <-regTask.OnComplete()
+	local, err := agg.NewLocal(udf)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return nil
+	for _, rec := range recs {
+		local.Put(*ns, *set, aero.BinMap(rec))
+	}
+	return local, nil
 }
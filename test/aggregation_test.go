@@ -1,12 +1,10 @@
 package main_test
 
 import (
-	"fmt"
-	"sort"
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
-	"github.com/onsi/gomega/types"
 )
 
 var _ = Describe("Aggregation Tests", func() {
@@ -29,7 +27,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror))
+				Expect(aeror).To(MatchQueryResults(sqlr))
 			})
 
 			It("Should calculate MIN correctly", func() {
@@ -46,7 +44,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror))
+				Expect(aeror).To(MatchQueryResults(sqlr))
 			})
 
 			It("Should calculate MAX correctly", func() {
@@ -63,7 +61,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror))
+				Expect(aeror).To(MatchQueryResults(sqlr))
 			})
 
 			It("Should calculate COUNT correctly", func() {
@@ -80,7 +78,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror))
+				Expect(aeror).To(MatchQueryResults(sqlr))
 			})
 
 			It("Should calculate multiple functions correctly", func() {
@@ -100,7 +98,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror))
+				Expect(aeror).To(MatchQueryResults(sqlr))
 			})
 		})
 
@@ -121,7 +119,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror))
+				Expect(aeror).To(MatchQueryResults(sqlr))
 			})
 
 			It("Should calculate MIN correctly", func() {
@@ -139,7 +137,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror))
+				Expect(aeror).To(MatchQueryResults(sqlr))
 			})
 
 			It("Should calculate MAX correctly", func() {
@@ -157,7 +155,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror))
+				Expect(aeror).To(MatchQueryResults(sqlr))
 			})
 
 			It("Should calculate COUNT correctly", func() {
@@ -175,7 +173,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror))
+				Expect(aeror).To(MatchQueryResults(sqlr))
 			})
 
 			It("Should calculate multiple functions correctly", func() {
@@ -196,7 +194,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror))
+				Expect(aeror).To(MatchQueryResults(sqlr))
 			})
 
 		})
@@ -225,7 +223,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror, "name", "sum(age)"))
+				Expect(aeror).To(MatchQueryResults(sqlr, "name"))
 			})
 
 			It("Should calculate MIN correctly", func() {
@@ -246,7 +244,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror, "name", "min(age)"))
+				Expect(aeror).To(MatchQueryResults(sqlr, "name"))
 			})
 
 			It("Should calculate MAX correctly", func() {
@@ -267,7 +265,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror, "name", "max(age)"))
+				Expect(aeror).To(MatchQueryResults(sqlr, "name"))
 			})
 
 			It("Should calculate COUNT correctly", func() {
@@ -288,7 +286,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror, "name", "count(age)"))
+				Expect(aeror).To(MatchQueryResults(sqlr, "name"))
 			})
 
 			It("Should calculate multiple functions correctly", func() {
@@ -312,7 +310,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror, "name", "sum(age+1)", "count(age)", "min(age*5)", "max(age+salary)"))
+				Expect(aeror).To(MatchQueryResults(sqlr, "name"))
 			})
 		})
 
@@ -337,7 +335,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror, "name", "sum(age)"))
+				Expect(aeror).To(MatchQueryResults(sqlr, "name"))
 			})
 
 			It("Should calculate MIN correctly", func() {
@@ -359,7 +357,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror, "name", "min(age)"))
+				Expect(aeror).To(MatchQueryResults(sqlr, "name"))
 			})
 
 			It("Should calculate MAX correctly", func() {
@@ -381,7 +379,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror, "name", "max(age)"))
+				Expect(aeror).To(MatchQueryResults(sqlr, "name"))
 			})
 
 			It("Should calculate COUNT correctly", func() {
@@ -403,7 +401,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror, "name", "count(age)"))
+				Expect(aeror).To(MatchQueryResults(sqlr, "name"))
 			})
 
 			It("Should calculate multiple functions correctly", func() {
@@ -428,7 +426,7 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror, "name", "sum(age+1)", "count(age)", "min(age*5)", "max(age+salary)"))
+				Expect(aeror).To(MatchQueryResults(sqlr, "name"))
 			})
 
 			It("Should calculate multiple functions correctly with multiple group by fields", func() {
@@ -455,83 +453,234 @@ var _ = Describe("Aggregation Tests", func() {
 				aeror, err := aeroQuery(client, *ns, *set, payload)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(sqlr).To(MatchQueryResults(aeror, "name", "lastname", "sum(age+1)", "count(age)", "min(age*5)", "max(age+salary)"))
+				Expect(aeror).To(MatchQueryResults(sqlr, "name", "lastname"))
 			})
 		})
 
 	})
 
-})
+	Context("Aggregates with GROUP BY expressions", func() {
+
+		It("Should group by a computed numeric expression", func() {
+			sql := "select (age/10)*10 as band, count(age), sum(salary) from test group by band"
+			payload := map[string]interface{}{
+				"fields": map[string]interface{}{
+					"count(age)":  map[string]string{"func": "count", "expr": "rec['age'] and 1"},
+					"sum(salary)": map[string]string{"func": "sum", "expr": "rec['salary']"},
+				},
+				"group_by_fields": []interface{}{
+					map[string]string{"alias": "band", "expr": "math.floor(rec['age'] / 10) * 10"},
+				},
+			}
 
-func MatchQueryResults(expected interface{}, fieldNames ...string) types.GomegaMatcher {
-	return &queryResultMatcher{
-		fieldNames: fieldNames,
-		expected:   expected,
-	}
-}
+			sqlr, err := sqlQuery(sqlDB, sql)
+			Expect(err).ToNot(HaveOccurred())
 
-type queryResultMatcher struct {
-	fieldNames []string
-	expected   interface{}
-}
+			aeror, err := aeroQuery(client, *ns, *set, payload)
+			Expect(err).ToNot(HaveOccurred())
 
-func (matcher *queryResultMatcher) Match(actual interface{}) (success bool, err error) {
-	a := actual.([]map[string]interface{})
-	b := matcher.expected.([]map[string]interface{})
-
-	if len(matcher.fieldNames) > 0 {
-		sort.Slice(a, func(i, j int) bool {
-			for _, fname := range matcher.fieldNames {
-				switch a[i][fname].(type) {
-				case int64:
-					if a[i][fname].(int64) == a[j][fname].(int64) {
-						continue
-					}
-					return a[i][fname].(int64) < a[j][fname].(int64)
-				case string:
-					if a[i][fname].(string) == a[j][fname].(string) {
-						continue
-					}
-					return a[i][fname].(string) < a[j][fname].(string)
-				default:
-					panic(fmt.Sprintf("Invalid value: %#v", a[i][fname]))
-				}
+			Expect(aeror).To(MatchQueryResults(sqlr, "band"))
+		})
+
+		It("Should group by a mix of fields and string expressions", func() {
+			sql := "select name, lower(lastname) as lname, count(age), max(age) from test where age > 20 group by name, lname"
+			payload := map[string]interface{}{
+				"fields": map[string]interface{}{
+					"name":       "name",
+					"count(age)": map[string]string{"func": "count", "expr": "rec['age'] and 1"},
+					"max(age)":   map[string]string{"func": "max", "expr": "rec['age']"},
+				},
+				"filter": "rec['age'] > 20",
+				"group_by_fields": []interface{}{
+					"name",
+					map[string]string{"alias": "lname", "expr": "string.lower(rec['lastname'])"},
+				},
+			}
+
+			sqlr, err := sqlQuery(sqlDB, sql)
+			Expect(err).ToNot(HaveOccurred())
+
+			aeror, err := aeroQuery(client, *ns, *set, payload)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(aeror).To(MatchQueryResults(sqlr, "name", "lname"))
+		})
+	})
+
+	Context("Aggregates with FILTER clauses", func() {
+
+		It("Should calculate filtered aggregates with no group by", func() {
+			sql := `select count(*) as "count(*)", count(*) filter (where age > 20) as "count_over_20", sum(salary) filter (where name like 'A%') as "sum_a" from test`
+			payload := map[string]interface{}{
+				"fields": map[string]interface{}{
+					"count(*)":      map[string]string{"func": "count", "expr": "1"},
+					"count_over_20": map[string]string{"func": "count", "expr": "1", "filter": "rec['age'] > 20"},
+					"sum_a":         map[string]string{"func": "sum", "expr": "rec['salary']", "filter": "string.sub(rec['name'], 1, 1) == 'A'"},
+				},
+			}
+
+			sqlr, err := sqlQuery(sqlDB, sql)
+			Expect(err).ToNot(HaveOccurred())
+
+			aeror, err := aeroQuery(client, *ns, *set, payload)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(aeror).To(MatchQueryResults(sqlr))
+		})
+
+		It("Should calculate filtered aggregates with group by and a global filter", func() {
+			sql := `select name, min(age) filter (where salary > 5000) as "min_rich", max(age) filter (where salary <= 5000) as "max_poor", count(age) from test where age > 10 group by name`
+			q := agg.NewQuery(*ns, *set).
+				Select("name", "name").
+				AddField(agg.Field{Alias: "min_rich", Func: agg.FuncMin, Expr: "rec['age']", Filter: "rec['salary'] > 5000"}).
+				AddField(agg.Field{Alias: "max_poor", Func: agg.FuncMax, Expr: "rec['age']", Filter: "rec['salary'] <= 5000"}).
+				Count("count(age)", "rec['age'] and 1").
+				Where("rec['age'] > 10").
+				GroupByFields("name")
+
+			sqlr, err := sqlQuery(sqlDB, sql)
+			Expect(err).ToNot(HaveOccurred())
+
+			aeror, err := aeroQuery(client, *ns, *set, q.Payload())
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(aeror).To(MatchQueryResults(sqlr, "name"))
+		})
+	})
+
+	Context("Aggregates with GROUPING SETS", func() {
+
+		It("Should calculate explicit grouping sets correctly", func() {
+			sql := `select name, lastname, count(age), sum(salary), 0 as __grouping_id from test where age > 20 group by name, lastname
+				union all select name, null, count(age), sum(salary), 1 from test where age > 20 group by name
+				union all select null, null, count(age), sum(salary), 3 from test where age > 20`
+			q := agg.NewQuery(*ns, *set).
+				Select("name", "name").
+				Select("lastname", "lastname").
+				Count("count(age)", "rec['age'] and 1").
+				Sum("sum(salary)", "rec['salary']").
+				Where("rec['age'] > 20").
+				GroupByFields("name", "lastname").
+				WithGroupingSets([]string{"name", "lastname"}, []string{"name"}, []string{})
+
+			sqlr, err := sqlQuery(sqlDB, sql)
+			Expect(err).ToNot(HaveOccurred())
+
+			aeror, err := aeroQuery(client, *ns, *set, q.Payload())
+			Expect(err).ToNot(HaveOccurred())
+
+			for id, fieldNames := range map[int64][]string{0: {"name", "lastname"}, 1: {"name"}, 3: {}} {
+				Expect(withGroupingID(aeror, id)).To(MatchQueryResults(withGroupingID(sqlr, id), fieldNames...))
 			}
-			return false
 		})
 
-		sort.Slice(b, func(i, j int) bool {
-			for _, fname := range matcher.fieldNames {
-				switch b[i][fname].(type) {
-				case int64:
-					if b[i][fname].(int64) == b[j][fname].(int64) {
-						continue
-					}
-					return b[i][fname].(int64) < b[j][fname].(int64)
-				case string:
-					if b[i][fname].(string) == b[j][fname].(string) {
-						continue
-					}
-					return b[i][fname].(string) < b[j][fname].(string)
-				default:
-					panic(fmt.Sprintf("Invalid value: %#v", b[i][fname]))
+		It("Should calculate CUBE correctly", func() {
+			sql := `select name, (age/10)*10 as band, max(salary), 0 as __grouping_id from test group by name, band
+				union all select name, null, max(salary), 1 from test group by name
+				union all select null, (age/10)*10 as band, max(salary), 2 from test group by band
+				union all select null, null, max(salary), 3 from test`
+			q := agg.NewQuery(*ns, *set).
+				Select("name", "name").
+				Max("max(salary)", "rec['salary']").
+				GroupByFields("name").
+				GroupByExpr("band", "math.floor(rec['age'] / 10) * 10").
+				Cube()
+
+			sqlr, err := sqlQuery(sqlDB, sql)
+			Expect(err).ToNot(HaveOccurred())
+
+			aeror, err := aeroQuery(client, *ns, *set, q.Payload())
+			Expect(err).ToNot(HaveOccurred())
+
+			for id, fieldNames := range map[int64][]string{0: {"name", "band"}, 1: {"name"}, 2: {"band"}, 3: {}} {
+				Expect(withGroupingID(aeror, id)).To(MatchQueryResults(withGroupingID(sqlr, id), fieldNames...))
+			}
+		})
+	})
+
+	Context("Aggregates with max_groups", func() {
+
+		It("Should fail over the limit", func() {
+			payload := map[string]interface{}{
+				"fields": map[string]interface{}{
+					"name":       "name",
+					"count(age)": map[string]string{"func": "count", "expr": "rec['age'] and 1"},
+				},
+				"group_by_fields": []string{"name"},
+				"max_groups":      5,
+			}
+
+			// the UDF returns a single group, keyed and tagged __max_groups
+			aeror, err := aeroQuery(client, *ns, *set, payload)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aeror).To(Equal([]map[string]interface{}{{"__max_groups": int64(5)}}))
+
+			q := agg.NewQuery(*ns, *set).
+				Select("name", "name").
+				Count("count(age)", "rec['age'] and 1").
+				GroupByFields("name").
+				WithMaxGroups(5)
+
+			_, err = q.Execute(client)
+			Expect(err).To(Equal(&agg.TooManyGroupsError{MaxGroups: 5}))
+		})
+
+		It("Should accumulate the groups over the limit into others", func() {
+			sql := "select count(age), sum(salary) from test"
+			q := agg.NewQuery(*ns, *set).
+				Select("name", "name").
+				Count("count(age)", "rec['age'] and 1").
+				Sum("sum(salary)", "rec['salary']").
+				GroupByFields("name").
+				WithMaxGroups(5).
+				WithOthers()
+
+			sqlr, err := sqlQuery(sqlDB, sql)
+			Expect(err).ToNot(HaveOccurred())
+
+			// the groups kept are whole, none is split with the others
+			byName, err := sqlQuery(sqlDB, "select name, count(age), sum(salary) from test group by name")
+			Expect(err).ToNot(HaveOccurred())
+			expected := map[interface{}]map[string]interface{}{}
+			for _, row := range byName {
+				expected[row["name"]] = row
+			}
+
+			rows, err := q.Execute(client)
+			Expect(err).ToNot(HaveOccurred())
+
+			groups, others := 0, 0
+			total := map[string]interface{}{"count(age)": int64(0), "sum(salary)": int64(0)}
+			for _, row := range aeroRows(rows) {
+				if _, exists := row[agg.OthersColumn]; exists {
+					others++
+					Expect(row).ToNot(HaveKey("name"))
+				} else {
+					groups++
+					Expect([]map[string]interface{}{row}).To(MatchQueryResults([]map[string]interface{}{expected[row["name"]]}))
+				}
+
+				for k := range total {
+					total[k] = total[k].(int64) + row[k].(int64)
 				}
 			}
-			return false
+
+			Expect(groups).To(Equal(5))
+			Expect(others).To(Equal(1))
+			Expect([]map[string]interface{}{total}).To(MatchQueryResults(sqlr))
 		})
+	})
 
-	}
+})
 
-	if fmt.Sprintf("%#v", a) == fmt.Sprintf("%#v", b) {
-		return true, nil
+// withGroupingID returns the rows of the grouping set with the given id
+func withGroupingID(rows []map[string]interface{}, id int64) []map[string]interface{} {
+	res := []map[string]interface{}{}
+	for _, r := range rows {
+		if r[agg.GroupingIDColumn] == id {
+			res = append(res, r)
+		}
 	}
-	return false, nil
-}
-
-func (matcher *queryResultMatcher) FailureMessage(actual interface{}) (message string) {
-	return fmt.Sprintf("Expected\n\t%#v\nto match\n\t%#v", actual, matcher.expected)
-}
 
-func (matcher *queryResultMatcher) NegatedFailureMessage(actual interface{}) (message string) {
-	return fmt.Sprintf("Expected\n\t%#v\nnot to match\n\t%#v", actual, matcher.expected)
+	return res
 }
@@ -0,0 +1,114 @@
+//go:build arrow
+// +build arrow
+
+package main_test
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggarrow"
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggfmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Arrow Tests", func() {
+
+	q := agg.NewQuery("test", "test").
+		Select("name", "name").
+		Count("n", "1").
+		Sum("total", "rec['salary']").
+		Max("oldest", "rec['age']").
+		GroupByFields("name")
+
+	rows := []agg.Row{
+		{"name": "Eva", "n": int64(3), "total": 2.5, "oldest": int64(40)},
+		{"name": nil, "n": int64(1), "total": int64(7)},
+	}
+
+	It("Should type the columns after the query", func() {
+		schema := aggarrow.Schema(q, rows)
+		Expect(schema.Fields()).To(Equal([]arrow.Field{
+			{Name: "name", Type: arrow.BinaryTypes.String, Nullable: true},
+			{Name: "n", Type: arrow.PrimitiveTypes.Int64},
+			{Name: "total", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+			{Name: "oldest", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+		}))
+	})
+
+	It("Should write Arrow IPC files", func() {
+		var buf bytes.Buffer
+		Expect(aggfmt.Write(&buf, "arrow", q, rows)).To(Succeed())
+
+		r, err := ipc.NewFileReader(bytes.NewReader(buf.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		defer r.Close()
+
+		Expect(r.NumRecords()).To(Equal(1))
+		rec, err := r.Record(0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rec.NumRows()).To(BeEquivalentTo(2))
+
+		name := rec.Column(0).(*array.String)
+		Expect(name.Value(0)).To(Equal("Eva"))
+		Expect(name.IsNull(1)).To(BeTrue())
+		Expect(rec.Column(2).(*array.Float64).Value(1)).To(Equal(7.0))
+		Expect(rec.Column(3).(*array.Int64).IsNull(1)).To(BeTrue())
+	})
+
+	It("Should write Parquet files", func() {
+		var buf bytes.Buffer
+		Expect(aggfmt.Write(&buf, "parquet", q, rows)).To(Succeed())
+
+		pf, err := file.NewParquetReader(bytes.NewReader(buf.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		defer pf.Close()
+
+		fr, err := pqarrow.NewFileReader(pf, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+		Expect(err).ToNot(HaveOccurred())
+
+		table, err := fr.ReadTable(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		defer table.Release()
+
+		Expect(table.NumRows()).To(BeEquivalentTo(2))
+		Expect(table.Schema().Field(1).Nullable).To(BeFalse())
+		Expect(table.Column(1).Data().Chunk(0).(*array.Int64).Int64Values()).To(Equal([]int64{3, 1}))
+	})
+
+	It("Should match the results of sqlite", func() {
+		sqlr, err := sqlQuery(sqlDB, "select name, count(age) as n from test group by name")
+		Expect(err).ToNot(HaveOccurred())
+
+		q := agg.NewQuery(*ns, *set).
+			Select("name", "name").
+			Count("n", "rec['age'] and 1").
+			GroupByFields("name")
+		rows, err := q.ExecuteContext(context.Background(), client)
+		Expect(err).ToNot(HaveOccurred())
+
+		rec := aggarrow.NewRecord(memory.DefaultAllocator, q, rows)
+		defer rec.Release()
+		Expect(rec.NumRows()).To(BeEquivalentTo(len(sqlr)))
+
+		var n int64
+		for _, v := range rec.Column(1).(*array.Int64).Int64Values() {
+			n += v
+		}
+		var want int64
+		for _, row := range sqlr {
+			want += row["n"].(int64)
+		}
+		Expect(n).To(Equal(want))
+	})
+})
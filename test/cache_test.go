@@ -0,0 +1,115 @@
+package main_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache Tests", func() {
+
+	query := func(expr string) *agg.Query {
+		return agg.NewQuery(*ns, *set).
+			Select("name", "name").
+			Sum("sum(salary)", expr).
+			GroupByFields("name")
+	}
+
+	It("Should normalize payloads", func() {
+		p1, err := agg.NormalizePayload(agg.NewQuery(*ns, *set).
+			Select("name", "name").
+			Count("count(age)", " rec['age']  and\n1 ").
+			Where("rec['name'] == 'a  b'").
+			GroupByFields("name", "age").
+			Payload())
+		Expect(err).ToNot(HaveOccurred())
+
+		p2, err := agg.NormalizePayload(agg.NewQuery(*ns, *set).
+			Count("count(age)", "rec['age'] and 1").
+			Select("name", "name").
+			Where("rec['name']  ==  'a  b'").
+			GroupByFields("age", "name").
+			Payload())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(p1)).To(Equal(string(p2)))
+		Expect(string(p1)).To(ContainSubstring("'a  b'"))
+	})
+
+	It("Should keep the code following a comment", func() {
+		normalize := func(expr string) string {
+			p, err := agg.NormalizePayload(query(expr).Payload())
+			Expect(err).ToNot(HaveOccurred())
+			return string(p)
+		}
+
+		commented := normalize("rec['salary'] -- the salary, doubled\n* 2")
+		Expect(commented).To(Equal(normalize("rec['salary'] * 2")))
+		Expect(commented).ToNot(Equal(normalize("rec['salary']")))
+
+		Expect(normalize("rec['salary'] --[[ twice\nover ]] * 2")).To(Equal(commented))
+		Expect(normalize("rec['salary'] .. '-- not  a comment'")).To(ContainSubstring("'-- not  a comment'"))
+	})
+
+	It("Should cache results", func() {
+		sqlr, err := sqlQuery(sqlDB, "select name, sum(salary) from test group by name")
+		Expect(err).ToNot(HaveOccurred())
+
+		cache := agg.NewCache(agg.CacheOptions{TTL: time.Minute})
+		ctx := context.Background()
+
+		rows, err := cache.Execute(ctx, client, query("rec['salary']"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aeroRows(rows)).To(MatchQueryResults(sqlr, "name"))
+
+		rows, err = cache.Execute(ctx, client, query("  rec['salary'] "))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aeroRows(rows)).To(MatchQueryResults(sqlr, "name"))
+		Expect(cache.Stats()).To(Equal(agg.CacheStats{Hits: 1, Misses: 1, Entries: 1, Rows: len(rows)}))
+
+		cache.Invalidate(*ns, *set)
+		_, err = cache.Execute(ctx, client, query("rec['salary']"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cache.Stats().Misses).To(BeEquivalentTo(2))
+	})
+
+	It("Should run identical concurrent queries once", func() {
+		cache := agg.NewCache(agg.CacheOptions{})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				_, err := cache.Execute(context.Background(), client, query("rec['salary']"))
+				Expect(err).ToNot(HaveOccurred())
+			}()
+		}
+		wg.Wait()
+
+		stats := cache.Stats()
+		Expect(stats.Misses).To(BeEquivalentTo(1))
+		Expect(stats.Hits + stats.Coalesced).To(BeEquivalentTo(9))
+	})
+
+	It("Should evict results over the limits", func() {
+		cache := agg.NewCache(agg.CacheOptions{MaxEntries: 1})
+		ctx := context.Background()
+
+		_, err := cache.Execute(ctx, client, query("rec['salary']"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = cache.Execute(ctx, client, query("rec['salary'] * 2"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = cache.Execute(ctx, client, query("rec['salary']"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(cache.Stats().Misses).To(BeEquivalentTo(3))
+		Expect(cache.Stats().Entries).To(Equal(1))
+	})
+})
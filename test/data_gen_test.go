@@ -4,16 +4,24 @@ import (
 	"math/rand"
 )
 
-func randomRecords(count, nameVariety int) []map[string]interface{} {
+// baseTimestamp is the earliest generated event time, events span the following week
+const baseTimestamp int64 = 1760054400000 // 2025-10-10T00:00:00Z
+
+// seededRecords returns the same records for the same seed, for the
+// failures of the specs to be reproduced with -seed.
+func seededRecords(seed int64, count, nameVariety int) []map[string]interface{} {
+	r := rand.New(rand.NewSource(seed))
+
 	res := make([]map[string]interface{}, count)
 	for i := 0; i < count; i++ {
-		nameIdx := rand.Intn(len(names[:nameVariety]))
+		nameIdx := r.Intn(len(names[:nameVariety]))
 		res[i] = map[string]interface{}{
 			"id":       i,
 			"name":     names[nameIdx],
-			"lastname": lastnames[rand.Intn(len(lastnames))],
-			"age":      rand.Intn(50),
-			"salary":   3000 + rand.Intn(50)*100,
+			"lastname": lastnames[r.Intn(len(lastnames))],
+			"age":      r.Intn(50),
+			"salary":   3000 + r.Intn(50)*100,
+			"ts":       baseTimestamp + r.Int63n(7*24*3600*1000),
 		}
 	}
 
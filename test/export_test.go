@@ -0,0 +1,94 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggprom"
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggserve"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Exporter Tests", func() {
+
+	var backend *aggserve.LocalBackend
+
+	BeforeEach(func() {
+		local, err := newLocal(records)
+		Expect(err).ToNot(HaveOccurred())
+		backend = aggserve.NewLocalBackend(local)
+	})
+
+	export := func(config string) (string, error) {
+		cfg, err := aggprom.ParseConfig([]byte(config))
+		Expect(err).ToNot(HaveOccurred())
+
+		exporter, err := aggprom.NewExporter(backend, cfg)
+		Expect(err).ToNot(HaveOccurred())
+
+		err = exporter.Refresh(context.Background())
+
+		var buf bytes.Buffer
+		Expect(exporter.WriteMetrics(&buf)).To(Succeed())
+		return buf.String(), err
+	}
+
+	It("Should export the aggregates as gauges labeled by group", func() {
+		sqlr, err := sqlQuery(sqlDB, "select name, count(*) as n, sum(salary) as payroll from test group by name")
+		Expect(err).ToNot(HaveOccurred())
+
+		metrics, err := export(fmt.Sprintf(`
+namespace: %s
+queries:
+  - name: users
+    sql: select name, count(*) as n, sum(salary) as payroll from %s group by name
+    labels: {name: first_name}
+`, *ns, *set))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(metrics).To(ContainSubstring("# TYPE agg_users_n gauge\n"))
+		for _, row := range sqlr {
+			Expect(metrics).To(ContainSubstring(fmt.Sprintf("agg_users_n{first_name=%q} %d\n", row["name"], row["n"])))
+			Expect(metrics).To(ContainSubstring(fmt.Sprintf("agg_users_payroll{first_name=%q} %d\n", row["name"], row["payroll"])))
+		}
+		Expect(metrics).To(ContainSubstring(fmt.Sprintf("agg_query_groups{query=\"users\"} %d\n", len(sqlr))))
+		Expect(metrics).To(ContainSubstring("agg_query_runs_total{query=\"users\"} 1\n"))
+		Expect(metrics).To(ContainSubstring("agg_query_errors_total{query=\"users\"} 0\n"))
+		Expect(metrics).To(MatchRegexp(`agg_query_duration_seconds\{query="users"\} [0-9.e-]+\n`))
+	})
+
+	It("Should count the errors of the queries", func() {
+		metrics, err := export(fmt.Sprintf(`
+namespace: %s
+prefix: test
+queries:
+  - name: groups
+    set: %s
+    payload: {fields: {name: name, n: {func: count, expr: "1"}}, group_by_fields: [name], max_groups: 1}
+`, *ns, *set))
+		Expect(err).To(HaveOccurred())
+
+		Expect(metrics).To(ContainSubstring("test_query_errors_total{query=\"groups\"} 1\n"))
+		Expect(metrics).ToNot(ContainSubstring("test_groups_n{"))
+		Expect(metrics).ToNot(ContainSubstring("test_query_last_success_timestamp_seconds{"))
+	})
+
+	It("Should reject invalid configurations", func() {
+		for _, config := range []string{
+			"queries: [{name: users-by-name, sql: select count(*) from test.test}]",
+			"queries: [{name: users, sql: select name from test.test}]",
+			"queries: [{name: users, sql: select count(*) from test.test group by name}]",
+			"queries: [{name: users, sql: select name, count(*) from test.test group by name, labels: {age: a}}]",
+			"queries: [{name: users, sql: select count(*) from test.test}, {name: users, sql: select count(*) from test.test}]",
+		} {
+			cfg, err := aggprom.ParseConfig([]byte(config))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = aggprom.NewExporter(backend, cfg)
+			Expect(err).To(HaveOccurred(), config)
+		}
+	})
+})
@@ -0,0 +1,89 @@
+package main_test
+
+import (
+	"bytes"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggfmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Formatter Tests", func() {
+
+	columns := []string{"name", "count", "avg(age)", "tags"}
+	rows := []agg.Row{
+		{"name": "Eva", "count": int64(3), "avg(age)": 2.5, "tags": []interface{}{"a", 1}},
+		{"name": "Jürgen", "count": int64(12345678901234)},
+	}
+
+	format := func(name string) string {
+		f, err := aggfmt.Lookup(name)
+		Expect(err).ToNot(HaveOccurred())
+
+		var buf bytes.Buffer
+		Expect(f.Format(&buf, columns, rows)).To(Succeed())
+		return buf.String()
+	}
+
+	It("Should write aligned tables", func() {
+		Expect(format("table")).To(Equal(
+			"name             count  avg(age)  tags\n" +
+				"------  --------------  --------  -------\n" +
+				"Eva                  3       2.5  [\"a\",1]\n" +
+				"Jürgen  12345678901234      NULL  NULL\n" +
+				"(2 rows)\n"))
+	})
+
+	It("Should write JSON", func() {
+		Expect(format("json")).To(Equal(`[
+  {
+    "name": "Eva",
+    "count": 3,
+    "avg(age)": 2.5,
+    "tags": ["a",1]
+  },
+  {
+    "name": "Jürgen",
+    "count": 12345678901234,
+    "avg(age)": null,
+    "tags": null
+  }
+]
+`))
+	})
+
+	It("Should write NDJSON", func() {
+		Expect(format("ndjson")).To(Equal(
+			`{"name":"Eva","count":3,"avg(age)":2.5,"tags":["a",1]}` + "\n" +
+				`{"name":"Jürgen","count":12345678901234,"avg(age)":null,"tags":null}` + "\n"))
+	})
+
+	It("Should write CSV and TSV", func() {
+		Expect(format("csv")).To(Equal(
+			"name,count,avg(age),tags\n" +
+				"Eva,3,2.5,\"[\"\"a\"\",1]\"\n" +
+				"Jürgen,12345678901234,,\n"))
+		Expect(format("tsv")).To(Equal(
+			"name\tcount\tavg(age)\ttags\n" +
+				"Eva\t3\t2.5\t\"[\"\"a\"\",1]\"\n" +
+				"Jürgen\t12345678901234\t\t\n"))
+	})
+
+	It("Should write columns in query order", func() {
+		q := agg.NewQuery("test", "test").
+			Count("z", "1").
+			Select("a", "a").
+			GroupByFields("a")
+
+		var buf bytes.Buffer
+		Expect(aggfmt.Write(&buf, "csv", q, []agg.Row{{"a": "x", "z": int64(2)}})).To(Succeed())
+		Expect(buf.String()).To(Equal("z,a\n2,x\n"))
+	})
+
+	It("Should reject unknown formats", func() {
+		_, err := aggfmt.Lookup("xml")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,261 @@
+package main_test
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	aero "github.com/aerospike/aerospike-client-go"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// differ runs generated queries on sqlite and on the backends of the
+// aggregations, returning an error when their rows differ.
+type differ struct {
+	db    *sqlx.DB
+	local *agg.Local
+
+	// lookup are the records of the lookup set the queries may join
+	lookup []map[string]interface{}
+
+	// client runs the payloads on the cluster too, when not nil
+	client *aero.Client
+
+	// seed, count and variety are the arguments of seededRecords which
+	// returned the records
+	seed           int64
+	count, variety int
+}
+
+// lookupTable is the sqlite table of the lookup set, in the set named
+// after the set of the records followed by "_" and it.
+const lookupTable = "lookup"
+
+// lookupRecords returns the records of the lookup set, keyed by the names
+// of seededRecords: every fourth name has none and every other no bonus,
+// so that the joins return NULLs.
+func lookupRecords(variety int) []map[string]interface{} {
+	var res []map[string]interface{}
+	for i, name := range names[:variety] {
+		if i%4 == 3 {
+			continue
+		}
+		rec := map[string]interface{}{"tname": name, "team": fmt.Sprintf("team_%d", i%3)}
+		if i%2 == 0 {
+			rec["bonus"] = 100 * (1 + i%5)
+		}
+		res = append(res, rec)
+	}
+	return res
+}
+
+// newDiffer returns a differ over the records of seededRecords, which db
+// and client hold. It writes the lookup set to db, and runs the payloads
+// joining it on the cluster with the lookup map inline.
+func newDiffer(db *sqlx.DB, client *aero.Client, seed int64, count, variety int) (*differ, error) {
+	local, err := newLocal(seededRecords(seed, count, variety))
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := lookupRecords(variety)
+	db.MustExec("DROP TABLE IF EXISTS " + lookupTable)
+	db.MustExec("CREATE TABLE " + lookupTable + " (tname TEXT PRIMARY KEY, team TEXT NOT NULL, bonus INTEGER)")
+	for _, rec := range lookup {
+		db.MustExec("INSERT INTO "+lookupTable+" (tname, team, bonus) VALUES (?, ?, ?)", rec["tname"], rec["team"], rec["bonus"])
+		local.Put(*ns, *set+"_"+lookupTable, aero.BinMap(rec))
+	}
+
+	return &differ{db: db, local: local, lookup: lookup, client: client, seed: seed, count: count, variety: variety}, nil
+}
+
+// query returns the query of the choices.
+func (d *differ) query(data []byte) *genQuery {
+	return generateQuery(&choices{data: data, names: d.variety}, d.lookup)
+}
+
+// sql returns the SQL of q for sqlite.
+func (d *differ) sql(q *genQuery) string {
+	return q.SQL("test", lookupTable)
+}
+
+// check runs the query of the choices.
+func (d *differ) check(data []byte) error {
+	q := d.query(data)
+
+	expected, err := sqlQuery(d.db, d.sql(q))
+	if err != nil {
+		return fmt.Errorf("sqlite: %v", err)
+	}
+
+	// unlike aeroRows, the rows keep the fractions of the ratios
+	compare := func(backend string, result []agg.Row, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s: %v", backend, err)
+		}
+		rows := make([]map[string]interface{}, len(result))
+		for i, row := range result {
+			rows[i] = row
+		}
+		rows = q.normalize(rows)
+
+		m := MatchQueryResults(expected, q.groupAliases()...)
+		if ok, _ := m.Match(rows); !ok {
+			return fmt.Errorf("%s: %s", backend, m.FailureMessage(rows))
+		}
+		return nil
+	}
+
+	ctx := context.Background()
+	rows, err := d.local.Aggregate(ctx, *ns, *set, q.Payload())
+	if err := compare("payload in process", rows, err); err != nil {
+		return err
+	}
+
+	parsed, err := agg.ParseSQL(q.SQL(*ns+"."+*set, *set+"_"+lookupTable))
+	if err == nil {
+		rows, err = d.local.Execute(ctx, parsed)
+	}
+	if err := compare("SQL in process", rows, err); err != nil {
+		return err
+	}
+
+	if d.client != nil {
+		rows, err := agg.AggregateContext(ctx, d.client, *ns, *set, q.Payload())
+		if err := compare("payload on the cluster", rows, err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// normalize returns rows as sqlite returns them: the UDF has no row for an
+// aggregation without groups over no records, nor values for the counts of
+// no records.
+func (q *genQuery) normalize(rows []map[string]interface{}) []map[string]interface{} {
+	if len(q.groups) == 0 && len(rows) == 0 {
+		rows = []map[string]interface{}{{}}
+	}
+
+	for _, row := range rows {
+		for _, a := range q.aggregates {
+			if _, exists := row[a.alias]; !exists && a.fn == "count" {
+				row[a.alias] = int64(0)
+			}
+		}
+	}
+	return rows
+}
+
+// shrink returns the simplest choices for which fails still returns true,
+// removing chunks of them and lowering each of them in turn, like the Go
+// fuzzer minimizes its inputs.
+func shrink(data []byte, fails func([]byte) bool) []byte {
+	for changed := true; changed; {
+		changed = false
+
+		for size := len(data) / 2; size > 0; size /= 2 {
+			for i := 0; i+size <= len(data); {
+				candidate := append(append([]byte{}, data[:i]...), data[i+size:]...)
+				if fails(candidate) {
+					data, changed = candidate, true
+				} else {
+					i += size
+				}
+			}
+		}
+
+		for i := range data {
+			for _, v := range []byte{0, data[i] / 2, data[i] - 1} {
+				if v >= data[i] {
+					continue
+				}
+				candidate := append([]byte{}, data...)
+				candidate[i] = v
+				if fails(candidate) {
+					data, changed = candidate, true
+					break
+				}
+			}
+		}
+	}
+	return data
+}
+
+// reproducer describes the failure of the choices, shrunk.
+func (d *differ) reproducer(data []byte) string {
+	data = shrink(data, func(data []byte) bool {
+		return d.check(data) != nil
+	})
+
+	q := d.query(data)
+	payload, _ := json.Marshal(q.Payload())
+	return fmt.Sprintf("%v\n\nrecords: -seed %d -r %d -v %d\nchoices: %s\nsql: %s\npayload: %s", d.check(data), d.seed, d.count, d.variety, hex.EncodeToString(data), d.sql(q), payload)
+}
+
+var _ = Describe("Fuzz Tests", func() {
+
+	It("Should return the rows of sqlite for random queries", func() {
+		d, err := newDiffer(sqlDB, client, *seed, *recordCount, *nameVariety)
+		Expect(err).ToNot(HaveOccurred())
+
+		for i := 0; i < *randomQueries; i++ {
+			data := make([]byte, 64)
+			rand.Read(data)
+
+			if err := d.check(data); err != nil {
+				Fail(d.reproducer(data))
+			}
+		}
+	})
+})
+
+// FuzzQueries compares the rows of the generated queries run in process
+// and by sqlite, over seeded records, without a cluster:
+//
+//	go test -run '^$' -fuzz FuzzQueries -lua ..
+//
+// The records and the differ are set up once: an input only runs its
+// query, in process over few records, as the UDF hashes every group key
+// of every record in Lua. The executions minimizing new inputs are not
+// counted; -fuzzminimizetime 100x bounds them.
+func FuzzQueries(f *testing.F) {
+	const seed, count, variety = 1, 40, 20
+
+	db, err := sqlite3db("file:fuzz.db?cache=shared&mode=memory")
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := genSqlData(db, seededRecords(seed, count, variety)); err != nil {
+		f.Fatal(err)
+	}
+
+	d, err := newDiffer(db, nil, seed, count, variety)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add([]byte{})
+	f.Add([]byte{0, 3, 1, 1, 2, 1, 0, 1, 1, 2, 2, 1, 3, 0, 2})
+	// a left join grouped by team, NULL for some names, with a modulo, a
+	// ratio, a filter on the bonus and a LIKE
+	f.Add([]byte{86, 3, 25, 0, 241, 19, 0, 0, 171, 0, 0, 0, 0, 169, 0, 0, 0, 49, 0, 0, 0, 0, 0, 19, 0, 0, 0, 0, 0, 9, 121, 0, 0, 0, 0, 0, 0, 0, 14, 109, 116, 0, 0, 0, 229, 0, 125})
+	f.Add([]byte("random aggregations of the records of the set"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := d.check(data); err != nil {
+			t.Fatalf("%v\nsql: %s", err, d.sql(d.query(data)))
+		}
+	})
+}
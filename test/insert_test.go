@@ -0,0 +1,104 @@
+package main_test
+
+import (
+	"time"
+
+	aero "github.com/aerospike/aerospike-client-go"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Insert Tests", func() {
+
+	target := *set + "_summary"
+
+	// scanTarget returns the records of the target set, deleting them
+	scanTarget := func() []agg.Row {
+		recordset, err := client.ScanAll(nil, *ns, target)
+		Expect(err).ToNot(HaveOccurred())
+
+		var rows []agg.Row
+		for res := range recordset.Results() {
+			Expect(res.Err).ToNot(HaveOccurred())
+			rows = append(rows, agg.Row(res.Record.Bins))
+
+			_, err := client.Delete(nil, res.Record.Key)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		return rows
+	}
+
+	It("Should write the groups into a set", func() {
+		sqlr, err := sqlQuery(sqlDB, "select name, count(age) as n, sum(salary) as total from test group by name")
+		Expect(err).ToNot(HaveOccurred())
+
+		ins, err := agg.ParseInsert("insert into " + target + " select name, count(age) as n, sum(salary) as total from " + *set + " group by name")
+		Expect(err).ToNot(HaveOccurred())
+		ins.Query.Namespace = *ns
+		ins.WithTTL(time.Hour).WithConcurrency(7)
+
+		n, err := ins.Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(len(sqlr)))
+
+		// the records are keyed by group values
+		rows, err := ins.Query.Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+		key, err := aero.NewKey(*ns, target, ins.Query.GroupKey(rows[0]))
+		Expect(err).ToNot(HaveOccurred())
+		rec, err := client.Get(nil, key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rec.Bins["name"]).To(Equal(rows[0]["name"]))
+		Expect(rec.Expiration).To(BeNumerically("<=", 3600))
+
+		// running it again updates the same records
+		n, err = ins.Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(len(sqlr)))
+
+		Expect(aeroRows(scanTarget())).To(MatchQueryResults(sqlr, "name"))
+	})
+
+	It("Should upsert or replace the records", func() {
+		upsert, err := agg.ParseInsert("insert into " + target + " select name, count(age) as n from " + *set + " group by name")
+		Expect(err).ToNot(HaveOccurred())
+		upsert.Query.Namespace = *ns
+
+		replace, err := agg.ParseInsert("insert or replace into " + target + " select name, max(age) as oldest from " + *set + " group by name")
+		Expect(err).ToNot(HaveOccurred())
+		replace.Query.Namespace = *ns
+		Expect(replace.Mode).To(Equal(agg.InsertReplace))
+
+		_, err = upsert.Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = replace.Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, row := range scanTarget() {
+			Expect(row).ToNot(HaveKey("n"))
+			Expect(row).To(HaveKey("oldest"))
+		}
+	})
+
+	It("Should run inserts through the SQL driver", func() {
+		sqlr, err := sqlQuery(sqlDB, "select name, count(age) from test group by name")
+		Expect(err).ToNot(HaveOccurred())
+
+		res, err := aggDB.Exec("insert into "+target+" select name, count(age) as n from "+*set+" where age > ? group by name", -1)
+		Expect(err).ToNot(HaveOccurred())
+
+		n, err := res.RowsAffected()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(BeEquivalentTo(len(sqlr)))
+		Expect(scanTarget()).To(HaveLen(len(sqlr)))
+	})
+
+	It("Should reject columns which are not bin names", func() {
+		ins, err := agg.ParseInsert("insert into " + target + " select name, count(age) filter (where age > 30) from " + *set + " group by name")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ins.Validate()).ToNot(Succeed())
+	})
+})
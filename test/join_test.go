@@ -0,0 +1,152 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	aero "github.com/aerospike/aerospike-client-go"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Join Tests", func() {
+
+	// every fourth name has no team, to tell inner and left joins apart
+	teamsSet := *set + "_teams"
+	var teams []map[string]interface{}
+
+	BeforeEach(func() {
+		seen := map[string]bool{}
+		var names []string
+		for _, rec := range records {
+			name := rec["name"].(string)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		teams = nil
+		for i, name := range names {
+			if i%4 != 3 {
+				teams = append(teams, map[string]interface{}{"id": i, "name": name, "team": fmt.Sprintf("team_%d", i%3)})
+			}
+		}
+		Expect(genAeroData(client, *ns, teamsSet, teams)).To(Succeed())
+
+		sqlDB.MustExec("DROP TABLE IF EXISTS teams")
+		sqlDB.MustExec("CREATE TABLE teams (name TEXT PRIMARY KEY, team TEXT NOT NULL)")
+		for _, t := range teams {
+			sqlDB.MustExec("INSERT INTO teams (name, team) VALUES (?, ?)", t["name"], t["team"])
+		}
+	})
+
+	AfterEach(func() {
+		client.Truncate(nil, *ns, teamsSet, nil)
+		sqlDB.MustExec("DROP TABLE IF EXISTS teams")
+	})
+
+	It("Should inner join a lookup set", func() {
+		sqlr, err := sqlQuery(sqlDB, "select t.team as team, count(*) as n, sum(salary) as payroll, max(age) as oldest from test join teams t on t.name = test.name where age > 20 group by t.team")
+		Expect(err).ToNot(HaveOccurred())
+
+		q, err := agg.ParseSQL(fmt.Sprintf("select t.team as team, count(*) as n, sum(salary) as payroll, max(age) as oldest from %s.%s join %s t on t.name = name where age > 20 group by t.team", *ns, *set, teamsSet))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(q.Joins).To(HaveLen(1))
+		Expect(q.Joins[0].Bins).To(Equal([]string{"name", "team"}))
+
+		rows, err := q.Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aeroRows(rows)).To(MatchQueryResults(sqlr, "team"))
+	})
+
+	It("Should left join a lookup set", func() {
+		sqlr, err := sqlQuery(sqlDB, "select count(*) as n, count(t.team) as teamed from test left join teams as t on test.name = t.name")
+		Expect(err).ToNot(HaveOccurred())
+
+		q, err := agg.ParseSQL(fmt.Sprintf("select count(*) as n, count(t.team) as teamed from %s.%s left join %s as t on name = t.name", *ns, *set, teamsSet))
+		Expect(err).ToNot(HaveOccurred())
+
+		rows, err := q.Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aeroRows(rows)).To(MatchQueryResults(sqlr))
+		Expect(rows[0]["teamed"]).To(BeNumerically("<", rows[0]["n"]))
+	})
+
+	It("Should look the records up in the expressions", func() {
+		q := agg.NewQuery(*ns, *set).
+			Join("teams", teamsSet, "name", "team").
+			Count("n", "1").
+			GroupByExpr("team", "dim['teams'][rec['name']]['team'] or 'none'")
+
+		rows, err := q.ExecutePartials(context.Background(), client, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		counts := map[interface{}]int64{}
+		var total int64
+		for _, row := range rows {
+			counts[row["team"]] = row["n"].(int64)
+			total += row["n"].(int64)
+		}
+		Expect(counts).To(HaveLen(4))
+		Expect(counts).To(HaveKey("none"))
+		Expect(total).To(Equal(int64(len(records))))
+	})
+
+	It("Should enforce the size limits of the joins", func() {
+		q := agg.NewQuery(*ns, *set).
+			Join("teams", teamsSet, "name").
+			Count("n", "dim['teams'][rec['name']]['team']")
+
+		q.Joins[0].MaxRecords = len(teams) - 1
+		_, err := q.Execute(client)
+		Expect(err).To(Equal(&agg.JoinTooLargeError{Join: "teams", MaxRecords: len(teams) - 1}))
+
+		q.Joins[0].MaxRecords = 0
+		q.Joins[0].MaxBytes = 64
+		_, err = q.Execute(client)
+		Expect(err).To(Equal(&agg.JoinTooLargeError{Join: "teams", MaxBytes: 64}))
+
+		q.Joins[0].MaxBytes = -1
+		_, err = q.Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Should join in process", func() {
+		local, err := newLocal(records)
+		Expect(err).ToNot(HaveOccurred())
+		for _, t := range teams {
+			local.Put(*ns, teamsSet, aero.BinMap(t))
+		}
+
+		sqlr, err := sqlQuery(sqlDB, "select t.team as team, count(*) as n, min(age) as youngest from test join teams t on t.name = test.name group by t.team")
+		Expect(err).ToNot(HaveOccurred())
+
+		q, err := agg.ParseSQL(fmt.Sprintf("select t.team as team, count(*) as n, min(age) as youngest from %s.%s join %s t on t.name = name group by t.team", *ns, *set, teamsSet))
+		Expect(err).ToNot(HaveOccurred())
+
+		rows, err := local.Execute(context.Background(), q)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aeroRows(rows)).To(MatchQueryResults(sqlr, "team"))
+	})
+
+	It("Should reject invalid joins", func() {
+		for _, sql := range []string{
+			fmt.Sprintf("select count(*) from %s.%s join %s t on t.name = ?", *ns, *set, teamsSet),
+			fmt.Sprintf("select count(*) from %s.%s join %s t on name = lastname", *ns, *set, teamsSet),
+			fmt.Sprintf("select count(*) from %s.%s join %s t on t.name = name join %s t on t.name = lastname", *ns, *set, teamsSet, teamsSet),
+			fmt.Sprintf("select t.team, count(*) from %s.%s join %s t on t.name = name", *ns, *set, teamsSet),
+		} {
+			_, err := agg.ParseSQL(sql)
+			Expect(err).To(HaveOccurred(), sql)
+		}
+
+		err := agg.NewQuery(*ns, *set).Join("teams", teamsSet, "").Count("n", "1").Validate()
+		Expect(err).To(MatchError("join `teams` has no key bin"))
+	})
+})
@@ -0,0 +1,476 @@
+package main_test
+
+import (
+	"fmt"
+	"strings"
+)
+
+// choices are the decisions a random query is generated from. The fuzzer
+// mutates them and shrinking removes or lowers them: a missing choice is
+// 0, always the simplest option, so shorter choices make simpler queries.
+type choices struct {
+	data []byte
+	pos  int
+
+	// names is the number of unique names of the records, see seededRecords
+	names int
+
+	// joined is set when the query joins the lookup set, whose columns are
+	// then available
+	joined bool
+}
+
+// intn returns the next choice, in [0, n).
+func (c *choices) intn(n int) int {
+	if c.pos >= len(c.data) {
+		return 0
+	}
+	b := c.data[c.pos]
+	c.pos++
+	return int(b) % n
+}
+
+// numColumns can be aggregated: the sums of their products stay exact with
+// the 53 bits significands of Lua numbers. ts is only compared.
+var (
+	numColumns = []string{"age", "salary", "id"}
+	strColumns = []string{"name", "lastname"}
+)
+
+// genExpr is a generated expression, rendered both in SQL and in Lua.
+// nulls are the Lua operands which may be nil, for which SQL returns NULL.
+type genExpr struct {
+	sql   string
+	lua   string
+	nulls []string
+}
+
+// value returns the Lua of the expression, nil when an operand is.
+func (e genExpr) value() string {
+	if len(e.nulls) == 0 {
+		return e.lua
+	}
+	return "(" + notNil(e.nulls) + " and " + e.lua + " or nil)"
+}
+
+// genPred is a generated condition: in Lua, isTrue and isFalse are both
+// false when an operand is NULL, as SQL conditions on NULL are unknown.
+type genPred struct {
+	sql     string
+	isTrue  string
+	isFalse string
+}
+
+// predicate returns the condition cmp of Lua on the operands of exprs.
+func predicate(sql, cmp string, exprs ...genExpr) genPred {
+	var nulls []string
+	for _, e := range exprs {
+		nulls = append(nulls, e.nulls...)
+	}
+	if len(nulls) == 0 {
+		return genPred{sql: sql, isTrue: "(" + cmp + ")", isFalse: "not (" + cmp + ")"}
+	}
+	guard := notNil(nulls)
+	return genPred{sql: sql, isTrue: "(" + guard + " and " + cmp + ")", isFalse: "(" + guard + " and not (" + cmp + "))"}
+}
+
+func notNil(nulls []string) string {
+	checks := make([]string, len(nulls))
+	for i, n := range nulls {
+		checks[i] = n + " ~= nil"
+	}
+	return strings.Join(checks, " and ")
+}
+
+func column(name string) genExpr {
+	return genExpr{sql: name, lua: fmt.Sprintf("rec['%s']", name)}
+}
+
+// lookupColumn is a bin of the record of the lookup set joined by name,
+// NULL for the names without one, see lookupRecords.
+func lookupColumn(bin string) genExpr {
+	lua := fmt.Sprintf("dim['t'][rec['name']]['%s']", bin)
+	return genExpr{sql: "t." + bin, lua: lua, nulls: []string{lua}}
+}
+
+// numColumn returns a number column, bonus being NULL for half the names.
+func numColumn(c *choices) genExpr {
+	n := len(numColumns)
+	if c.joined {
+		n++
+	}
+	if i := c.intn(n); i < len(numColumns) {
+		return column(numColumns[i])
+	}
+	return lookupColumn("bonus")
+}
+
+// strColumn returns a string column, team being NULL for some records.
+func strColumn(c *choices) genExpr {
+	n := len(strColumns)
+	if c.joined {
+		n++
+	}
+	if i := c.intn(n); i < len(strColumns) {
+		return column(strColumns[i])
+	}
+	return lookupColumn("team")
+}
+
+func literal(s string) genExpr {
+	return genExpr{sql: "'" + s + "'", lua: "'" + s + "'"}
+}
+
+func number(n int) genExpr {
+	s := fmt.Sprint(n)
+	return genExpr{sql: s, lua: s}
+}
+
+// genNum returns an integer expression of at most two operators, so the
+// largest product of a record, salary * salary * salary, sums exactly. The
+// operands are never negative.
+func genNum(c *choices, ops int) genExpr {
+	if ops == 0 || c.intn(3) == 0 {
+		switch c.intn(3) {
+		case 0:
+			return numColumn(c)
+		case 1:
+			return number(c.intn(100))
+		default:
+			e := numColumn(c)
+			return genExpr{sql: "abs(" + e.sql + " - 40)", lua: "math.abs(" + e.lua + " - 40)", nulls: e.nulls}
+		}
+	}
+
+	left := genNum(c, ops-1)
+	op := []string{"+", "-", "*", "%"}[c.intn(4)]
+	if op == "%" {
+		// truncated like SQL's, by a divisor which is never 0
+		right := number(2 + c.intn(8))
+		return genExpr{sql: "(" + left.sql + " % " + right.sql + ")", lua: "math.fmod(" + left.lua + ", " + right.lua + ")", nulls: left.nulls}
+	}
+	right := genNum(c, 0)
+	return genExpr{sql: "(" + left.sql + " " + op + " " + right.sql + ")", lua: "(" + left.lua + " " + op + " " + right.lua + ")", nulls: append(append([]string{}, left.nulls...), right.nulls...)}
+}
+
+// genRatio returns a number expression, a floating point division of an
+// operand of genNum a fifth of the time: its sums have no cancellation,
+// so they are within floatTolerance whatever their order.
+func genRatio(c *choices) genExpr {
+	if c.intn(5) != 1 {
+		return genNum(c, 2)
+	}
+	e, divisor := genNum(c, 0), 1+c.intn(9)
+	return genExpr{sql: fmt.Sprintf("(%s * 1.0 / %d)", e.sql, divisor), lua: fmt.Sprintf("(%s / %d)", e.lua, divisor), nulls: e.nulls}
+}
+
+// genStr returns a string expression.
+func genStr(c *choices) genExpr {
+	e := strColumn(c)
+	switch c.intn(4) {
+	case 1:
+		return genExpr{sql: "lower(" + e.sql + ")", lua: "string.lower(" + e.lua + ")", nulls: e.nulls}
+	case 2:
+		return genExpr{sql: "upper(" + e.sql + ")", lua: "string.upper(" + e.lua + ")", nulls: e.nulls}
+	case 3:
+		// SQL's substr takes a length, Lua's string.sub an end
+		start, length := 1+c.intn(3), 1+c.intn(3)
+		return genExpr{
+			sql:   fmt.Sprintf("substr(%s, %d, %d)", e.sql, start, length),
+			lua:   fmt.Sprintf("string.sub(%s, %d, %d)", e.lua, start, start+length-1),
+			nulls: e.nulls,
+		}
+	}
+	return e
+}
+
+// strValue returns a string the string columns may be equal to.
+func strValue(c *choices) string {
+	if c.intn(2) == 0 {
+		return names[c.intn(c.names)]
+	}
+	return lastnames[c.intn(len(lastnames))]
+}
+
+// genStrValue returns a string literal the string columns may be equal to.
+func genStrValue(c *choices) genExpr {
+	return literal(strValue(c))
+}
+
+// genLike returns a LIKE pattern matching some of the strings of
+// strValue, in any case, and the anchored Lua pattern, in lower case, it
+// matches the lowered strings with.
+func genLike(c *choices) (string, string) {
+	v := strValue(c)
+
+	var like string
+	switch c.intn(3) {
+	case 0:
+		like = v[:1+c.intn(3)] + "%"
+	case 1:
+		like = "%" + v[len(v)-2:]
+	default:
+		like = v[:1] + "_" + v[2:]
+	}
+
+	switch c.intn(3) {
+	case 1:
+		like = strings.ToUpper(like)
+	case 2:
+		like = strings.ToLower(like)
+	}
+
+	pattern := strings.NewReplacer("%", ".*", "_", ".").Replace(strings.ToLower(like))
+	return like, "^" + pattern + "$"
+}
+
+var comparisons = []struct{ sql, lua string }{
+	{"=", "=="}, {"<>", "~="}, {"<", "<"}, {"<=", "<="}, {">", ">"}, {">=", ">="},
+}
+
+// genCond returns a condition, of at most depth nested and, or and not.
+func genCond(c *choices, depth int) genPred {
+	if depth > 0 {
+		switch c.intn(5) {
+		case 1:
+			p := genCond(c, depth-1)
+			return genPred{sql: "not (" + p.sql + ")", isTrue: p.isFalse, isFalse: p.isTrue}
+		case 2, 3:
+			left, right := genCond(c, depth-1), genCond(c, depth-1)
+			if c.intn(2) == 0 {
+				return genPred{
+					sql:     "(" + left.sql + " and " + right.sql + ")",
+					isTrue:  "(" + left.isTrue + " and " + right.isTrue + ")",
+					isFalse: "(" + left.isFalse + " or " + right.isFalse + ")",
+				}
+			}
+			return genPred{
+				sql:     "(" + left.sql + " or " + right.sql + ")",
+				isTrue:  "(" + left.isTrue + " or " + right.isTrue + ")",
+				isFalse: "(" + left.isFalse + " and " + right.isFalse + ")",
+			}
+		}
+	}
+
+	switch c.intn(6) {
+	case 1:
+		e, v := genStr(c), genStrValue(c)
+		cmp := comparisons[c.intn(len(comparisons))]
+		return predicate(e.sql+" "+cmp.sql+" "+v.sql, e.lua+" "+cmp.lua+" "+v.lua, e)
+	case 2:
+		e := genNum(c, 1)
+		lo := c.intn(50)
+		hi := lo + c.intn(5000)
+		return predicate(
+			fmt.Sprintf("%s between %d and %d", e.sql, lo, hi),
+			fmt.Sprintf("%s >= %d and %s <= %d", e.lua, lo, e.lua, hi),
+			e)
+	case 3:
+		e := strColumn(c)
+		values := []genExpr{genStrValue(c), genStrValue(c)}
+		return predicate(
+			fmt.Sprintf("%s in (%s, %s)", e.sql, values[0].sql, values[1].sql),
+			fmt.Sprintf("%s == %s or %s == %s", e.lua, values[0].lua, e.lua, values[1].lua),
+			e)
+	case 4:
+		// the events of the first days of the week
+		ts := baseTimestamp + int64(c.intn(7))*24*3600*1000
+		cmp := comparisons[2+c.intn(4)]
+		return predicate(fmt.Sprintf("ts %s %d", cmp.sql, ts), fmt.Sprintf("rec['ts'] %s %d", cmp.lua, ts))
+	case 5:
+		e := genStr(c)
+		like, pattern := genLike(c)
+		return predicate(e.sql+" like '"+like+"'", "string.find(string.lower("+e.lua+"), '"+pattern+"') ~= nil", e)
+	}
+
+	e := genRatio(c)
+	cmp := comparisons[c.intn(len(comparisons))]
+	v := number(c.intn(50))
+	return predicate(e.sql+" "+cmp.sql+" "+v.sql, e.lua+" "+cmp.lua+" "+v.lua, e)
+}
+
+// genAggregate is an aggregate of a generated query.
+type genAggregate struct {
+	alias  string
+	fn     string
+	expr   genExpr // nil sql for count(*)
+	filter *genPred
+}
+
+// genGroup is a group by entry of a generated query: a bin, or an
+// expression returned as alias.
+type genGroup struct {
+	alias string
+	bin   string
+	expr  genExpr
+}
+
+// genQuery is a random aggregation, rendered in SQL for sqlite and the SQL
+// compiler, and as a payload.
+type genQuery struct {
+	aggregates []genAggregate
+	groups     []genGroup
+	filter     *genPred
+
+	// join is "join" or "left join" when the query joins the lookup set,
+	// as t, on the name of the records
+	join string
+
+	// lookup is the lookup map of the join, by name
+	lookup map[interface{}]interface{}
+}
+
+// generateQuery returns the query of the choices, joining the records of
+// lookup when it chooses to.
+func generateQuery(c *choices, lookup []map[string]interface{}) *genQuery {
+	q := &genQuery{}
+
+	if join := c.intn(3); join > 0 && len(lookup) > 0 {
+		q.join = []string{"", "join", "left join"}[join]
+		q.lookup = map[interface{}]interface{}{}
+		for _, rec := range lookup {
+			q.lookup[rec["tname"]] = rec
+		}
+		c.joined = true
+	}
+
+	for i, n := 0, 1+c.intn(4); i < n; i++ {
+		a := genAggregate{alias: fmt.Sprintf("a%d", i), fn: []string{"count", "sum", "min", "max"}[c.intn(4)]}
+		if a.fn != "count" || c.intn(2) == 1 {
+			a.expr = genRatio(c)
+		}
+		if c.intn(4) == 1 {
+			f := genCond(c, 1)
+			a.filter = &f
+		}
+		q.aggregates = append(q.aggregates, a)
+	}
+
+	seen := map[string]bool{}
+	for i, n := 0, c.intn(3); i < n; i++ {
+		g := genGroup{alias: fmt.Sprintf("g%d", i)}
+		switch c.intn(4) {
+		case 0:
+			g = genGroup{bin: []string{"name", "lastname", "age"}[c.intn(3)]}
+			g.alias = g.bin
+		case 1:
+			g.expr = genStr(c)
+		case 2:
+			e := genStr(c)
+			g.expr = genExpr{sql: "length(" + e.sql + ")", lua: "string.len(" + e.lua + ")", nulls: e.nulls}
+		default:
+			// sqlite reads a number in a group by as a column position
+			if g.expr = genNum(c, 1); g.expr.sql == g.expr.lua {
+				g.expr = column(numColumns[c.intn(len(numColumns))])
+			}
+		}
+
+		key := g.bin + g.expr.sql
+		if !seen[key] {
+			seen[key] = true
+			q.groups = append(q.groups, g)
+		}
+	}
+
+	if c.intn(3) != 0 {
+		f := genCond(c, 2)
+		q.filter = &f
+	}
+
+	return q
+}
+
+// SQL returns the query on table, joining lookup.
+func (q *genQuery) SQL(table, lookup string) string {
+	var cols, groupBy []string
+	for _, g := range q.groups {
+		if g.bin != "" {
+			cols = append(cols, g.bin)
+			groupBy = append(groupBy, g.bin)
+		} else {
+			cols = append(cols, g.expr.sql+" as "+g.alias)
+			groupBy = append(groupBy, g.expr.sql)
+		}
+	}
+
+	for _, a := range q.aggregates {
+		col := a.fn + "(*)"
+		if a.expr.sql != "" {
+			col = a.fn + "(" + a.expr.sql + ")"
+		}
+		if a.filter != nil {
+			col += " filter (where " + a.filter.sql + ")"
+		}
+		cols = append(cols, col+" as "+a.alias)
+	}
+
+	sql := "select " + strings.Join(cols, ", ") + " from " + table
+	if q.join != "" {
+		sql += " " + q.join + " " + lookup + " t on t.tname = name"
+	}
+	if q.filter != nil {
+		sql += " where " + q.filter.sql
+	}
+	if len(groupBy) > 0 {
+		sql += " group by " + strings.Join(groupBy, ", ")
+	}
+	return sql
+}
+
+// Payload returns the select_agg_records payload of the query.
+func (q *genQuery) Payload() map[string]interface{} {
+	fields := map[string]interface{}{}
+	for _, a := range q.aggregates {
+		def := map[string]interface{}{"func": a.fn, "expr": "1"}
+		if a.expr.lua != "" {
+			def["expr"] = a.expr.value()
+			if a.fn == "count" {
+				def["expr"] = "(" + a.expr.value() + ") ~= nil and 1 or nil"
+			}
+		}
+		if a.filter != nil {
+			def["filter"] = a.filter.isTrue
+		}
+		fields[a.alias] = def
+	}
+
+	payload := map[string]interface{}{"fields": fields}
+
+	if len(q.groups) > 0 {
+		groupBy := make([]interface{}, len(q.groups))
+		for i, g := range q.groups {
+			if g.bin != "" {
+				fields[g.bin] = g.bin
+				groupBy[i] = g.bin
+			} else {
+				groupBy[i] = map[string]interface{}{"alias": g.alias, "expr": g.expr.value()}
+			}
+		}
+		payload["group_by_fields"] = groupBy
+	}
+
+	var filters []string
+	if q.join == "join" {
+		filters = append(filters, "dim['t'][rec['name']]['tname'] ~= nil")
+	}
+	if q.filter != nil {
+		filters = append(filters, q.filter.isTrue)
+	}
+	if len(filters) > 0 {
+		payload["filter"] = strings.Join(filters, " and ")
+	}
+	if q.join != "" {
+		payload["dims"] = map[string]interface{}{"t": q.lookup}
+	}
+
+	return payload
+}
+
+// groupAliases returns the columns identifying the groups of the results.
+func (q *genQuery) groupAliases() []string {
+	aliases := make([]string, len(q.groups))
+	for i, g := range q.groups {
+		aliases[i] = g.alias
+	}
+	return aliases
+}
@@ -0,0 +1,336 @@
+package main_test
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"time"
+
+	aero "github.com/aerospike/aerospike-client-go"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Query Builder Tests", func() {
+
+	It("Should build the payload", func() {
+		q := agg.NewQuery("test", "test").
+			Select("name", "name").
+			Count("count(age)", "rec['age'] and 1").
+			Sum("sum(salary)", "rec['salary']").
+			AddField(agg.Field{Alias: "max(age) over 20", Func: agg.FuncMax, Expr: "rec['age']", Filter: "rec['age'] > 20"}).
+			Where("rec['age'] > 5").
+			GroupByFields("name").
+			GroupByExpr("band", "math.floor(rec['age'] / 10) * 10")
+
+		Expect(q.Validate()).To(Succeed())
+		Expect(q.Payload()).To(Equal(map[string]interface{}{
+			"fields": map[string]interface{}{
+				"name":             "name",
+				"count(age)":       map[string]string{"func": "count", "expr": "rec['age'] and 1"},
+				"sum(salary)":      map[string]string{"func": "sum", "expr": "rec['salary']"},
+				"max(age) over 20": map[string]string{"func": "max", "expr": "rec['age']", "filter": "rec['age'] > 20"},
+			},
+			"filter": "rec['age'] > 5",
+			"group_by_fields": []interface{}{
+				"name",
+				map[string]string{"alias": "band", "expr": "math.floor(rec['age'] / 10) * 10"},
+			},
+		}))
+	})
+
+	It("Should build ROLLUP and CUBE grouping sets", func() {
+		q := agg.NewQuery("test", "test").GroupByFields("a", "b")
+
+		Expect(q.Rollup().GroupingSets).To(Equal([][]string{{"a", "b"}, {"a"}, {}}))
+		Expect(q.Cube().GroupingSets).To(Equal([][]string{{"a", "b"}, {"a"}, {"b"}, {}}))
+	})
+
+	It("Should return the grouping id of rows", func() {
+		Expect(agg.Row{"name": "Eva"}.Grouping()).To(Equal(int64(0)))
+		Expect(agg.Row{agg.GroupingIDColumn: float64(3)}.Grouping()).To(Equal(int64(3)))
+	})
+
+	It("Should reject invalid queries", func() {
+		Expect(agg.NewQuery("test", "test").Validate()).ToNot(Succeed())
+		Expect(agg.NewQuery("test", "test").AddField(agg.Field{Alias: "avg(age)", Func: "avg", Expr: "rec['age']"}).Validate()).ToNot(Succeed())
+		Expect(agg.NewQuery("test", "test").Select("age", "age").Sum("age", "rec['age']").Validate()).ToNot(Succeed())
+		Expect(agg.NewQuery("test", "test").AddField(agg.Field{Alias: "age", Bin: "age", Filter: "rec['age'] > 1"}).Validate()).ToNot(Succeed())
+		Expect(agg.NewQuery("test", "test").Select("age", "age").GroupByFields("age").WithGroupingSets([]string{"name"}).Validate()).ToNot(Succeed())
+	})
+
+	It("Should parse JSON and YAML payloads in order", func() {
+		yamlPayload := `
+fields:
+  name: name
+  max(age): {func: max, expr: "rec['age']", filter: "rec['age'] > 20"}
+  count(*): {func: count, expr: "1"}
+filter: rec['age'] > 5
+group_by_fields:
+  - name
+  - {alias: band, expr: "math.floor(rec['age'] / 10) * 10"}
+grouping_sets: [[name, band], []]
+`
+		jsonPayload := `{
+  "fields": {
+    "name": "name",
+    "max(age)": {"func": "max", "expr": "rec['age']", "filter": "rec['age'] > 20"},
+    "count(*)": {"func": "count", "expr": "1"}
+  },
+  "filter": "rec['age'] > 5",
+  "group_by_fields": ["name", {"alias": "band", "expr": "math.floor(rec['age'] / 10) * 10"}],
+  "grouping_sets": [["name", "band"], []]
+}`
+
+		expected := agg.NewQuery("test", "test").
+			Select("name", "name").
+			AddField(agg.Field{Alias: "max(age)", Func: agg.FuncMax, Expr: "rec['age']", Filter: "rec['age'] > 20"}).
+			Count("count(*)", "1").
+			Where("rec['age'] > 5").
+			GroupByFields("name").
+			GroupByExpr("band", "math.floor(rec['age'] / 10) * 10").
+			WithGroupingSets([]string{"name", "band"}, []string{})
+
+		for _, payload := range []string{yamlPayload, jsonPayload} {
+			q, err := agg.ParsePayload([]byte(payload), "test", "test")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(q).To(Equal(expected))
+			Expect(q.ColumnNames()).To(Equal([]string{"name", "max(age)", "count(*)", "band"}))
+		}
+
+		q, err := agg.ParsePayload([]byte(`{"fields": {"a": "a"}, "max_groups": 10, "on_max_groups": "others"}`), "test", "test")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(q.MaxGroups).To(Equal(10))
+		Expect(q.Others).To(BeTrue())
+		Expect(q.Payload()).To(HaveKeyWithValue("max_groups", 10))
+		Expect(q.Payload()).To(HaveKeyWithValue("on_max_groups", "others"))
+
+		_, err = agg.ParsePayload([]byte(`{"fields": {"a": "a"}, "order_by": ["a"]}`), "test", "test")
+		Expect(err).To(HaveOccurred())
+		_, err = agg.ParsePayload([]byte(`{"fields": {"a": "a"}, "on_max_groups": "drop"}`), "test", "test")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should report Lua syntax errors", func() {
+		Expect(agg.NewQuery("test", "test").Sum("s", "rec['age'] * 2").Where("rec['age'] > 1").CheckSyntax()).To(Succeed())
+		Expect(agg.NewQuery("test", "test").Sum("s", "rec['age'] *").CheckSyntax()).ToNot(Succeed())
+		Expect(agg.NewQuery("test", "test").Sum("s", "1").Where("rec['age'] >").CheckSyntax()).ToNot(Succeed())
+	})
+
+	It("Should explain queries", func() {
+		q := agg.NewQuery("test", "users").
+			Select("name", "name").
+			Count("count(*)", "1").
+			AddField(agg.Field{Alias: "sum(salary)", Func: agg.FuncSum, Expr: "rec['salary']", Filter: `rec["age"] > 30`}).
+			Where("rec.age > 25").
+			GroupByFields("name").
+			IndexRange("age", 26, 100)
+
+		plan := q.Explain()
+		Expect(plan.Bins).To(Equal([]string{"age", "name", "salary"}))
+		Expect(plan.Index.String()).To(Equal("age BETWEEN 26 AND 100"))
+		Expect(plan.Chunks).To(HaveLen(4))
+		Expect(plan.Steps[0]).To(Equal(agg.Step{Location: agg.OnServer, Description: "secondary index lookup on test.users where age BETWEEN 26 AND 100"}))
+		Expect(plan.Steps[len(plan.Steps)-1].Location).To(Equal(agg.OnClient))
+
+		stm := q.Statement()
+		Expect(stm.BinNames).To(Equal([]string{"age", "name", "salary"}))
+		Expect(stm.Filter).ToNot(BeNil())
+
+		// dynamic bin access reads all bins
+		q = agg.NewQuery("test", "users").Sum("s", "rec['a' .. 'ge']")
+		bins, ok := q.Bins()
+		Expect(ok).To(BeFalse())
+		Expect(bins).To(BeNil())
+		Expect(q.Explain().Bins).To(BeNil())
+		Expect(q.Statement().BinNames).To(BeEmpty())
+		Expect(q.Explain().Index).To(BeNil())
+	})
+
+	It("Should push index filters into the statement", func() {
+		idxTask, err := client.CreateIndex(nil, *ns, *set, *set+"_age_idx", "age", aero.NUMERIC)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(<-idxTask.OnComplete()).To(Succeed())
+		defer client.DropIndex(nil, *ns, *set, *set+"_age_idx")
+
+		sql := "select name, count(age), sum(salary) from test where age between 30 and 40 group by name"
+		sqlr, err := sqlQuery(sqlDB, sql)
+		Expect(err).ToNot(HaveOccurred())
+
+		q := agg.NewQuery(*ns, *set).
+			Select("name", "name").
+			Count("count(age)", "rec['age'] and 1").
+			Sum("sum(salary)", "rec['salary']").
+			GroupByFields("name").
+			IndexRange("age", 30, 40)
+
+		rows, err := q.Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aeroRows(rows)).To(MatchQueryResults(sqlr, "name"))
+	})
+
+	It("Should stop when the context is done", func() {
+		q := agg.NewQuery(*ns, *set).
+			Select("name", "name").
+			Count("count(age)", "rec['age'] and 1").
+			GroupByFields("name")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := q.ExecuteContext(ctx, client)
+		Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+
+		ctx, cancel = context.WithTimeout(context.Background(), time.Microsecond)
+		defer cancel()
+
+		_, err = q.ExecuteContext(ctx, client)
+		Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+
+		var canceled *agg.CanceledError
+		Expect(errors.As(err, &canceled)).To(BeTrue())
+
+		// the client is still usable
+		rows, err := q.ExecuteContext(context.Background(), client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rows).ToNot(BeEmpty())
+	})
+
+	It("Should stop an aggregation running when the context is done", func() {
+		// slow enough for the nodes to be still running when canceled
+		q := agg.NewQuery(*ns, *set).
+			Count("n", "1").
+			Where("(function() local n = 0 for i = 1, 1000000 do n = n + i end return n > 0 end)()")
+
+		goroutines := runtime.NumGoroutine()
+
+		// not a deadline, which the client would time out on by itself
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(200*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, err := q.ExecuteContext(ctx, client)
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+
+		var canceled *agg.CanceledError
+		Expect(errors.As(err, &canceled)).To(BeTrue())
+		Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		Expect(canceled.Progress.Elapsed).To(BeNumerically(">=", 200*time.Millisecond))
+
+		// the recordset is closed, stopping the commands to the nodes
+		Eventually(runtime.NumGoroutine, 30*time.Second, 100*time.Millisecond).Should(BeNumerically("<=", goroutines))
+
+		// and the client is still usable
+		Expect(client.IsConnected()).To(BeTrue())
+		rows, err := agg.NewQuery(*ns, *set).Count("n", "1").ExecuteContext(context.Background(), client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rows).To(Equal([]agg.Row{{"n": int64(len(records))}}))
+	})
+
+	It("Should report the nodes done when canceled", func() {
+		if len(client.GetNodes()) < 2 {
+			Skip("the cluster has a single node")
+		}
+
+		q := agg.NewQuery(*ns, *set).
+			Select("name", "name").
+			Count("n", "1").
+			GroupByFields("name")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		_, err := q.ExecutePartials(ctx, client, func(*agg.Partial) { cancel() })
+
+		var canceled *agg.CanceledError
+		Expect(errors.As(err, &canceled)).To(BeTrue())
+		Expect(canceled.Progress.Done).To(Equal(1))
+		Expect(canceled.Progress.Nodes).To(Equal(len(client.GetNodes())))
+		Expect(canceled.Progress.Records).To(BeNumerically(">", 0))
+		Expect(canceled.Progress.Rows).ToNot(BeEmpty())
+	})
+
+	It("Should run with policy presets", func() {
+		_, err := agg.NewPolicy("fast")
+		Expect(err).To(HaveOccurred())
+
+		policy, err := agg.NewPolicy(agg.PolicyInteractive)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(policy.TotalTimeout).To(Equal(30 * time.Second))
+		Expect(policy.FailOnClusterChange).To(BeTrue())
+
+		sql := "select name, count(age) from test group by name"
+		sqlr, err := sqlQuery(sqlDB, sql)
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, preset := range agg.PolicyPresets() {
+			policy, err := agg.NewPolicy(preset)
+			Expect(err).ToNot(HaveOccurred())
+			policy.MaxConcurrentNodes = 1
+
+			q := agg.NewQuery(*ns, *set).
+				Select("name", "name").
+				Count("count(age)", "rec['age'] and 1").
+				GroupByFields("name").
+				WithPolicy(policy)
+
+			rows, err := q.Execute(client)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aeroRows(rows)).To(MatchQueryResults(sqlr, "name"))
+		}
+	})
+
+	It("Should return the partial aggregate of each node", func() {
+		sql := "select name, count(age), sum(salary), min(age), max(age) from test group by name"
+		sqlr, err := sqlQuery(sqlDB, sql)
+		Expect(err).ToNot(HaveOccurred())
+
+		var total int64
+		Expect(sqlDB.QueryRow("select count(*) from test").Scan(&total)).To(Succeed())
+
+		q := agg.NewQuery(*ns, *set).
+			Select("name", "name").
+			Count("count(age)", "rec['age'] and 1").
+			Sum("sum(salary)", "rec['salary']").
+			Min("min(age)", "rec['age']").
+			Max("max(age)", "rec['age']").
+			GroupByFields("name")
+
+		var partials []*agg.Partial
+		rows, err := q.ExecutePartials(context.Background(), client, func(p *agg.Partial) {
+			partials = append(partials, p)
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aeroRows(rows)).To(MatchQueryResults(sqlr, "name"))
+
+		Expect(partials).To(HaveLen(len(client.GetNodes())))
+		var records int64
+		for i, p := range partials {
+			Expect(p.Node).ToNot(BeEmpty())
+			Expect(p.Done).To(Equal(i + 1))
+			records += p.Records
+		}
+		Expect(records).To(Equal(total))
+	})
+
+	It("Should merge the min and max of strings of the nodes", func() {
+		sql := "select lastname, min(name), max(name) from test group by lastname"
+		sqlr, err := sqlQuery(sqlDB, sql)
+		Expect(err).ToNot(HaveOccurred())
+
+		q := agg.NewQuery(*ns, *set).
+			Select("lastname", "lastname").
+			Min("min(name)", "rec['name']").
+			Max("max(name)", "rec['name']").
+			GroupByFields("lastname")
+
+		nodes := 0
+		rows, err := q.ExecutePartials(context.Background(), client, func(*agg.Partial) { nodes++ })
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nodes).To(Equal(len(client.GetNodes())))
+		Expect(aeroRows(rows)).To(MatchQueryResults(sqlr, "lastname"))
+	})
+})
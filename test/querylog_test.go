@@ -0,0 +1,176 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggserve"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Query Log Tests", func() {
+
+	var (
+		mu     sync.Mutex
+		logged []*agg.QueryLog
+	)
+
+	setLog := func(opts agg.QueryLogOptions) {
+		opts.Log = func(ql *agg.QueryLog) {
+			mu.Lock()
+			defer mu.Unlock()
+			logged = append(logged, ql)
+		}
+		agg.SetQueryLog(opts)
+	}
+
+	BeforeEach(func() {
+		logged = nil
+		setLog(agg.QueryLogOptions{})
+	})
+
+	AfterEach(func() {
+		agg.SetQueryLog(agg.QueryLogOptions{})
+	})
+
+	query := func() *agg.Query {
+		return agg.NewQuery(*ns, *set).
+			Select("name", "name").
+			Count("n", "1").
+			GroupByFields("name")
+	}
+
+	It("Should log the aggregations with their caller", func() {
+		ctx := agg.WithCaller(context.Background(), "dashboard/users")
+		rows, err := query().ExecuteContext(ctx, client)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(logged).To(HaveLen(1))
+		ql := logged[0]
+		Expect(ql.Caller).To(Equal("dashboard/users"))
+		Expect(ql.Namespace).To(Equal(*ns))
+		Expect(ql.Set).To(Equal(*set))
+		Expect(ql.Groups).To(Equal(len(rows)))
+		Expect(ql.Outcome).To(Equal(agg.OutcomeOK))
+		Expect(ql.Err).To(BeEmpty())
+		Expect(ql.Duration).To(BeNumerically(">", 0))
+		Expect(ql.Slow).To(BeFalse())
+
+		expected, err := agg.NormalizePayload(query().WithMaxGroups(agg.DefaultMaxGroups).Payload())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ql.Payload).To(MatchJSON(expected))
+	})
+
+	It("Should log the outcome of the failed aggregations", func() {
+		_, tooMany := query().WithMaxGroups(1).Execute(client)
+		Expect(tooMany).To(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := query().ExecuteContext(ctx, client)
+		Expect(err).To(HaveOccurred())
+
+		Expect(logged).To(HaveLen(2))
+		Expect(logged[0].Outcome).To(Equal(agg.OutcomeTooManyGroups))
+		Expect(logged[0].Err).To(Equal(tooMany.Error()))
+		Expect(logged[1].Outcome).To(Equal(agg.OutcomeCanceled))
+	})
+
+	It("Should log the slow aggregations only", func() {
+		setLog(agg.QueryLogOptions{SlowThreshold: time.Hour, SlowOnly: true})
+		_, err := query().Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = query().WithMaxGroups(1).Execute(client)
+		Expect(err).To(HaveOccurred())
+
+		Expect(logged).To(HaveLen(1))
+		Expect(logged[0].Outcome).To(Equal(agg.OutcomeTooManyGroups))
+
+		setLog(agg.QueryLogOptions{SlowThreshold: time.Nanosecond, SlowOnly: true})
+		_, err = query().Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(logged).To(HaveLen(2))
+		Expect(logged[1].Slow).To(BeTrue())
+	})
+
+	It("Should redact the literals of the filters", func() {
+		setLog(agg.QueryLogOptions{Redact: true})
+		q := query().
+			Where(`rec['age'] > 30 and rec["name"] ~= 'Eva'`).
+			AddField(agg.Field{Alias: "seniors", Func: agg.FuncCount, Expr: "1", Filter: "rec.age >= 65.5"})
+		_, err := q.Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(logged).To(HaveLen(1))
+		var payload map[string]interface{}
+		Expect(json.Unmarshal(logged[0].Payload, &payload)).To(Succeed())
+		Expect(payload["filter"]).To(Equal(`rec['age'] > ? and rec["name"] ~= ?`))
+		Expect(payload["fields"].(map[string]interface{})["seniors"]).To(HaveKeyWithValue("filter", "rec.age >= ?"))
+		Expect(string(logged[0].Payload)).ToNot(ContainSubstring("Eva"))
+
+		// the fingerprint is that of the payload run
+		setLog(agg.QueryLogOptions{})
+		_, err = q.Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(logged[1].Fingerprint).To(Equal(logged[0].Fingerprint))
+	})
+
+	It("Should write the log as JSON lines", func() {
+		var buf bytes.Buffer
+		agg.SetQueryLog(agg.QueryLogOptions{Log: agg.NewJSONQueryLog(&buf)})
+
+		for i := 0; i < 2; i++ {
+			_, err := query().Execute(client)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		Expect(lines).To(HaveLen(2))
+		for _, line := range lines {
+			var m map[string]interface{}
+			Expect(json.Unmarshal([]byte(line), &m)).To(Succeed())
+			Expect(m).To(HaveKeyWithValue("namespace", *ns))
+			Expect(m).To(HaveKeyWithValue("outcome", agg.OutcomeOK))
+			Expect(m).To(HaveKey("payload"))
+		}
+	})
+
+	It("Should log the caller of the queries served", func() {
+		local, err := newLocal(records)
+		Expect(err).ToNot(HaveOccurred())
+
+		server := httptest.NewServer(aggserve.NewServer(aggserve.NewLocalBackend(local), aggserve.Options{
+			Namespace:    *ns,
+			CallerHeader: "X-Caller",
+		}))
+		defer server.Close()
+
+		post := func(caller string) {
+			req, err := http.NewRequest(http.MethodPost, server.URL+"/query", strings.NewReader(`{"sql": "select count(*) from `+*set+`"}`))
+			Expect(err).ToNot(HaveOccurred())
+			if caller != "" {
+				req.Header.Set("X-Caller", caller)
+			}
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		}
+		post("grafana")
+		post("")
+
+		Expect(logged).To(HaveLen(2))
+		Expect(logged[0].Caller).To(Equal("grafana"))
+		Expect(logged[1].Caller).To(HavePrefix("127.0.0.1:"))
+	})
+})
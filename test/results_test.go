@@ -0,0 +1,420 @@
+package main_test
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/types"
+)
+
+// floatTolerance is the relative difference under which two floats are
+// equal: sqlite and Lua sum floats in different orders.
+const floatTolerance = 1e-9
+
+// MatchQueryResults succeeds when the rows, []map[string]interface{}, are
+// those expected in any order. The groups of the rows are identified by
+// fieldNames, the group by columns. Without them, the columns of the
+// expected rows not named after an aggregate, like `count(age)`, identify
+// the groups, and a single expected row is compared as a whole. Integers
+// and integral floats are equal, other floats are equal within
+// floatTolerance, []byte are strings, and a nil value is a missing
+// column, as the UDF returns no nil values.
+func MatchQueryResults(expected interface{}, fieldNames ...string) types.GomegaMatcher {
+	return &queryResultMatcher{
+		fieldNames: fieldNames,
+		expected:   expected,
+	}
+}
+
+type queryResultMatcher struct {
+	fieldNames []string
+	expected   interface{}
+
+	// diff describes the differences of the last match
+	diff resultDiff
+}
+
+func (matcher *queryResultMatcher) Match(actual interface{}) (success bool, err error) {
+	a, ok := actual.([]map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("MatchQueryResults expects rows, not %T", actual)
+	}
+	b, ok := matcher.expected.([]map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("MatchQueryResults expects rows, not %T", matcher.expected)
+	}
+
+	keys := matcher.fieldNames
+	if len(keys) == 0 && len(b) > 1 {
+		keys = groupColumns(b)
+	}
+
+	matcher.diff = diffRows(normalizeRows(b), normalizeRows(a), keys)
+	return matcher.diff.empty(), nil
+}
+
+func (matcher *queryResultMatcher) FailureMessage(actual interface{}) (message string) {
+	return fmt.Sprintf("Expected the rows to match, but\n%s", matcher.diff)
+}
+
+func (matcher *queryResultMatcher) NegatedFailureMessage(actual interface{}) (message string) {
+	return fmt.Sprintf("Expected the rows not to match, but they are the same %d rows", len(actual.([]map[string]interface{})))
+}
+
+// aggregateColumn matches the default names of the aggregate columns.
+var aggregateColumn = regexp.MustCompile(`^(count|sum|min|max)\(`)
+
+// groupColumns returns the columns of the rows which are not named after
+// an aggregate.
+func groupColumns(rows []map[string]interface{}) []string {
+	var keys []string
+	for _, col := range rowColumns(rows...) {
+		if !aggregateColumn.MatchString(col) {
+			keys = append(keys, col)
+		}
+	}
+	return keys
+}
+
+// normalizeRows returns copies of the rows without nil values, numbers
+// being int64 when integral and float64 otherwise, and []byte strings.
+func normalizeRows(rows []map[string]interface{}) []map[string]interface{} {
+	res := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		res[i] = make(map[string]interface{}, len(row))
+		for k, v := range row {
+			if v = normalizeValue(v); v != nil {
+				res[i][k] = v
+			}
+		}
+	}
+	return res
+}
+
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case float32:
+		return normalizeValue(float64(v))
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			return int64(v)
+		}
+		return v
+	}
+
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	}
+	return v
+}
+
+// equalValues compares normalized values.
+func equalValues(a, b interface{}) bool {
+	af, aok := toFloat(a)
+	bf, bok := toFloat(b)
+	if aok && bok {
+		if _, isInt := a.(int64); isInt {
+			if _, isInt := b.(int64); isInt {
+				return a == b
+			}
+		}
+		return math.Abs(af-bf) <= floatTolerance*math.Max(math.Abs(af), math.Abs(bf))
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// compareValues orders normalized values: missing ones, then numbers, then
+// strings, then the others by their rendering.
+func compareValues(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int64, float64:
+			return 1
+		case string:
+			return 2
+		}
+		return 3
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+
+	switch a := a.(type) {
+	case nil:
+		return 0
+	case int64, float64:
+		af, _ := toFloat(a)
+		bf, _ := toFloat(b)
+		switch {
+		case equalValues(a, b):
+			return 0
+		case af < bf:
+			return -1
+		}
+		return 1
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	return strings.Compare(fmt.Sprintf("%#v", a), fmt.Sprintf("%#v", b))
+}
+
+// rowColumns returns the sorted columns of the rows.
+func rowColumns(rows ...map[string]interface{}) []string {
+	seen := map[string]bool{}
+	var cols []string
+	for _, row := range rows {
+		for k := range row {
+			if !seen[k] {
+				seen[k] = true
+				cols = append(cols, k)
+			}
+		}
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+// sortRows sorts the rows by the key columns, then by all of them.
+func sortRows(rows []map[string]interface{}, keys []string) {
+	cols := append(append([]string{}, keys...), rowColumns(rows...)...)
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, col := range cols {
+			if c := compareValues(rows[i][col], rows[j][col]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// renderRow renders the columns of the row, all of them when cols is nil.
+func renderRow(row map[string]interface{}, cols []string) string {
+	if cols == nil {
+		cols = rowColumns(row)
+	}
+	parts := make([]string, len(cols))
+	for i, col := range cols {
+		parts[i] = col + ": " + renderValue(row[col])
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+func renderValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return fmt.Sprintf("%q", v)
+	}
+	return fmt.Sprint(v)
+}
+
+// resultDiff are the differences between the expected and the actual rows.
+type resultDiff struct {
+	keys     []string
+	rows     int
+	missing  []map[string]interface{}
+	extra    []map[string]interface{}
+	mismatch [][2]map[string]interface{}
+}
+
+func (d resultDiff) empty() bool {
+	return len(d.missing) == 0 && len(d.extra) == 0 && len(d.mismatch) == 0
+}
+
+func (d resultDiff) String() string {
+	var sb strings.Builder
+	keyed := "compared as a whole"
+	if len(d.keys) > 0 {
+		keyed = "keyed by " + strings.Join(d.keys, ", ")
+	}
+	fmt.Fprintf(&sb, "%d missing, %d extra and %d mismatched of %d expected rows, %s:\n", len(d.missing), len(d.extra), len(d.mismatch), d.rows, keyed)
+
+	for _, row := range d.missing {
+		fmt.Fprintf(&sb, "  missing  %s\n", renderRow(row, nil))
+	}
+	for _, row := range d.extra {
+		fmt.Fprintf(&sb, "  extra    %s\n", renderRow(row, nil))
+	}
+	for _, pair := range d.mismatch {
+		expected, actual := pair[0], pair[1]
+		var diffs []string
+		for _, col := range rowColumns(expected, actual) {
+			if !equalValues(expected[col], actual[col]) {
+				diffs = append(diffs, fmt.Sprintf("%s: expected %s, got %s", col, renderValue(expected[col]), renderValue(actual[col])))
+			}
+		}
+		group := renderRow(expected, d.keys)
+		if len(d.keys) == 0 {
+			group = renderRow(expected, nil)
+		}
+		fmt.Fprintf(&sb, "  mismatch %s\n           %s\n", group, strings.Join(diffs, "\n           "))
+	}
+	return sb.String()
+}
+
+// diffRows matches the expected rows with the actual ones by their key
+// columns. Without keys, the rows which are not equal to any other are
+// paired by the number of columns they share, the closest first.
+func diffRows(expected, actual []map[string]interface{}, keys []string) resultDiff {
+	sortRows(expected, keys)
+	sortRows(actual, keys)
+	d := resultDiff{keys: keys, rows: len(expected)}
+
+	sameKey := func(a, b map[string]interface{}) bool {
+		for _, k := range keys {
+			if !equalValues(a[k], b[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	equalRows := func(a, b map[string]interface{}) bool {
+		for _, col := range rowColumns(a, b) {
+			if !equalValues(a[col], b[col]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// equal rows first, so duplicated groups pair up with their twins
+	matched := make([]bool, len(actual))
+	var unmatched []map[string]interface{}
+	for _, e := range expected {
+		found := false
+		for i, a := range actual {
+			if !matched[i] && equalRows(e, a) {
+				matched[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			unmatched = append(unmatched, e)
+		}
+	}
+
+	for _, e := range unmatched {
+		best, bestShared := -1, 0
+		for i, a := range actual {
+			if matched[i] {
+				continue
+			}
+			if len(keys) > 0 {
+				if sameKey(e, a) {
+					best = i
+					break
+				}
+				continue
+			}
+			shared := 0
+			for _, col := range rowColumns(e, a) {
+				if equalValues(e[col], a[col]) {
+					shared++
+				}
+			}
+			if shared > bestShared {
+				best, bestShared = i, shared
+			}
+		}
+
+		if best < 0 {
+			d.missing = append(d.missing, e)
+			continue
+		}
+		matched[best] = true
+		d.mismatch = append(d.mismatch, [2]map[string]interface{}{e, actual[best]})
+	}
+
+	for i, a := range actual {
+		if !matched[i] {
+			d.extra = append(d.extra, a)
+		}
+	}
+	return d
+}
+
+var _ = Describe("Result Matcher", func() {
+
+	It("Should match rows in any order and numbers of any type", func() {
+		expected := []map[string]interface{}{
+			{"name": "a", "n": int64(2), "avg": 1.5},
+			{"name": "b", "n": 3, "avg": nil},
+		}
+		actual := []map[string]interface{}{
+			{"name": []byte("b"), "n": 3.0},
+			{"name": "a", "n": int32(2), "avg": 1.5 + 1e-12},
+		}
+		Expect(actual).To(MatchQueryResults(expected))
+		Expect(actual).To(MatchQueryResults(expected, "name"))
+	})
+
+	It("Should describe the missing, extra and mismatched groups", func() {
+		expected := []map[string]interface{}{
+			{"name": "a", "n": int64(2)},
+			{"name": "b", "n": int64(3)},
+			{"name": "c", "n": int64(4)},
+		}
+		actual := []map[string]interface{}{
+			{"name": "a", "n": int64(2)},
+			{"name": "b", "n": 3.5},
+			{"name": "d", "n": int64(1)},
+		}
+
+		m := MatchQueryResults(expected, "name")
+		Expect(m.Match(actual)).To(BeFalse())
+		Expect(m.FailureMessage(actual)).To(Equal(`Expected the rows to match, but
+1 missing, 1 extra and 1 mismatched of 3 expected rows, keyed by name:
+  missing  {n: 4, name: "c"}
+  extra    {n: 1, name: "d"}
+  mismatch {name: "b"}
+           n: expected 3, got 3.5
+`))
+
+		m = MatchQueryResults(expected)
+		Expect(m.Match(actual)).To(BeFalse())
+		Expect(m.FailureMessage(actual)).To(ContainSubstring("keyed by n, name:\n  missing  {n: 3, name: \"b\"}"))
+	})
+
+	It("Should key the groups by the columns which are not aggregates", func() {
+		expected := []map[string]interface{}{
+			{"name": "a", "band": int64(20), "count(age)": int64(2), "sum(age)": int64(45)},
+			{"name": "a", "band": int64(30), "count(age)": int64(1), "sum(age)": int64(31)},
+		}
+		actual := []map[string]interface{}{
+			{"name": "a", "band": int64(20), "count(age)": int64(2), "sum(age)": int64(45)},
+			{"name": "a", "band": int64(30), "count(age)": int64(1), "sum(age)": int64(32)},
+		}
+
+		m := MatchQueryResults(expected)
+		Expect(m.Match(actual)).To(BeFalse())
+		Expect(m.FailureMessage(actual)).To(Equal(`Expected the rows to match, but
+0 missing, 0 extra and 1 mismatched of 2 expected rows, keyed by band, name:
+  mismatch {band: 30, name: "a"}
+           sum(age): expected 31, got 32
+`))
+	})
+})
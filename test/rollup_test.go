@@ -0,0 +1,119 @@
+package main_test
+
+import (
+	"context"
+
+	aero "github.com/aerospike/aerospike-client-go"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rollup Tests", func() {
+
+	It("Should maintain aggregates incrementally", func() {
+		sql := "select name, count(age), sum(salary), min(age), max(age) from test where age > 20 group by name"
+		sqlr, err := sqlQuery(sqlDB, sql)
+		Expect(err).ToNot(HaveOccurred())
+
+		q := agg.NewQuery(*ns, *set).
+			Select("name", "name").
+			Count("count(age)", "rec['age'] and 1").
+			Sum("sum(salary)", "rec['salary']").
+			Min("min(age)", "rec['age']").
+			Max("max(age)", "rec['age']").
+			Where("rec['age'] ~= nil and rec['age'] > 20").
+			GroupByFields("name")
+
+		rollupSet := *set + "_rollup"
+		rollup := agg.NewRollup(q, *ns, rollupSet)
+
+		// groupRecords returns the number of records of the rollup's set
+		groupRecords := func() int {
+			recordset, err := client.ScanAll(nil, *ns, rollupSet)
+			Expect(err).ToNot(HaveOccurred())
+
+			n := 0
+			for res := range recordset.Results() {
+				Expect(res.Err).ToNot(HaveOccurred())
+				n++
+			}
+			return n
+		}
+		defer func() {
+			recordset, err := client.ScanAll(nil, *ns, rollupSet)
+			Expect(err).ToNot(HaveOccurred())
+			for res := range recordset.Results() {
+				Expect(res.Err).ToNot(HaveOccurred())
+				client.Delete(nil, res.Record.Key)
+			}
+		}()
+
+		// the groups are read by key
+		var keys []string
+		for _, row := range sqlr {
+			keys = append(keys, rollup.Key(agg.Row(row)))
+		}
+
+		rows, err := rollup.Rows(client, keys...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rows).To(BeEmpty())
+
+		recordset, err := client.ScanAll(nil, *ns, *set)
+		Expect(err).ToNot(HaveOccurred())
+		applied := map[string]bool{}
+		var first *aero.Record
+		for res := range recordset.Results() {
+			Expect(res.Err).ToNot(HaveOccurred())
+			groups, err := rollup.Apply(client, res.Record.Key, res.Record.Bins)
+			Expect(err).ToNot(HaveOccurred())
+			for _, k := range groups {
+				applied[k] = true
+			}
+			if first == nil && len(groups) > 0 {
+				first = res.Record
+			}
+		}
+		Expect(applied).To(HaveLen(len(keys)))
+		for _, k := range keys {
+			Expect(applied).To(HaveKey(k))
+		}
+
+		// applying the same write again is a no-op
+		_, err = rollup.Apply(client, first.Key, first.Bins)
+		Expect(err).ToNot(HaveOccurred())
+
+		rows, err = rollup.Rows(client, keys...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aeroRows(rows)).To(MatchQueryResults(sqlr, "name"))
+		Expect(groupRecords()).To(Equal(len(rows)))
+
+		rc, err := rollup.Reconcile(context.Background(), client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rc.OK()).To(BeTrue())
+
+		// a record applied but not written
+		key, err := aero.NewKey(*ns, *set, "__rollup_test")
+		Expect(err).ToNot(HaveOccurred())
+		groups, err := rollup.Apply(client, key, aero.BinMap{"name": "__rollup_test", "age": 30, "salary": 1})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(groups).To(Equal([]string{rollup.Key(agg.Row{"name": "__rollup_test"})}))
+		rc, err = rollup.Reconcile(context.Background(), client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rc.Mismatches).To(HaveLen(1))
+		Expect(rc.Mismatches[0].Scanned).To(BeNil())
+
+		Expect(rollup.Rebuild(context.Background(), client)).To(Succeed())
+		rc, err = rollup.Reconcile(context.Background(), client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rc.OK()).To(BeTrue())
+		Expect(groupRecords()).To(Equal(len(rows)))
+
+		// another payload cannot use the same set
+		other := agg.NewRollup(agg.NewQuery(*ns, *set).Count("count(*)", "1"), *ns, rollupSet)
+		_, err = other.Rows(client, keys...)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,134 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggserve"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Serve Tests", func() {
+
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		local, err := newLocal(records)
+		Expect(err).ToNot(HaveOccurred())
+
+		server = httptest.NewServer(aggserve.NewServer(aggserve.NewLocalBackend(local), aggserve.Options{Namespace: *ns}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// post sends a query, and returns the status and the decoded body
+	post := func(body string) (int, map[string]interface{}) {
+		res, err := http.Post(server.URL+"/query", "application/json", strings.NewReader(body))
+		Expect(err).ToNot(HaveOccurred())
+		defer res.Body.Close()
+
+		var m map[string]interface{}
+		Expect(json.NewDecoder(res.Body).Decode(&m)).To(Succeed())
+		return res.StatusCode, m
+	}
+
+	rows := func(m map[string]interface{}) []map[string]interface{} {
+		var res []map[string]interface{}
+		for _, row := range m["rows"].([]interface{}) {
+			r := row.(map[string]interface{})
+			for k, v := range r {
+				if f, ok := v.(float64); ok && f == float64(int64(f)) {
+					r[k] = int64(f)
+				}
+			}
+			res = append(res, r)
+		}
+		return res
+	}
+
+	It("Should run SQL statements", func() {
+		sqlr, err := sqlQuery(sqlDB, "select name, count(age), max(age) from test where age > 20 group by name")
+		Expect(err).ToNot(HaveOccurred())
+
+		status, m := post(`{"sql": "select name, count(age), max(age) from ` + *set + ` where age > ? group by name", "args": [20]}`)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(m["columns"]).To(Equal([]interface{}{"name", "count(age)", "max(age)"}))
+		Expect(rows(m)).To(MatchQueryResults(sqlr, "name"))
+	})
+
+	It("Should run payloads", func() {
+		sqlr, err := sqlQuery(sqlDB, "select sum(salary) as total from test")
+		Expect(err).ToNot(HaveOccurred())
+
+		status, m := post(`{"set": "` + *set + `", "payload": {"fields": {"total": {"func": "sum", "expr": "rec['salary']"}}}}`)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(rows(m)).To(MatchQueryResults(sqlr))
+	})
+
+	It("Should reject invalid requests", func() {
+		for _, body := range []string{
+			`{}`,
+			`{"sql": "select count(*) from test", "payload": {"fields": {}}}`,
+			`{"sql": "select count(*) from test where"}`,
+			`{"set": "test", "payload": {"fields": {"n": {"func": "count", "expr": "1 +"}}}}`,
+			`{"sql": "select count(*) from test", "timeout": "-1s"}`,
+			`{"sql": "select count(*) from test", "policy": "fast"}`,
+			`{"query": "select count(*) from test"}`,
+		} {
+			status, m := post(body)
+			Expect(status).To(Equal(http.StatusBadRequest), body)
+			Expect(m).To(HaveKey("error"))
+		}
+
+		res, err := http.Get(server.URL + "/query")
+		Expect(err).ToNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	It("Should map the errors of the queries", func() {
+		status, _ := post(`{"sql": "select count(*) from ` + *set + `", "timeout": "1ns"}`)
+		Expect(status).To(Equal(http.StatusGatewayTimeout))
+
+		status, _ = post(`{"set": "` + *set + `", "payload": {"fields": {"n": {"func": "count", "expr": "1"}}, "group_by_fields": ["name"], "max_groups": 1}}`)
+		Expect(status).To(Equal(http.StatusUnprocessableEntity))
+	})
+
+	It("Should report health and readiness", func() {
+		for _, path := range []string{"/healthz", "/readyz"} {
+			res, err := http.Get(server.URL + path)
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		}
+	})
+
+	It("Should check the UDF is registered on the cluster", func() {
+		udf, err := ioutil.ReadFile(filepath.Join(*currentPath, "aggAPI.lua"))
+		Expect(err).ToNot(HaveOccurred())
+
+		backend := aggserve.NewClusterBackend(client, udf)
+		Expect(backend.Ready(context.Background())).To(Succeed())
+
+		backend.UDF = []byte("-- another version")
+		Expect(backend.Ready(context.Background())).ToNot(Succeed())
+	})
+
+	It("Should fail readiness once draining", func() {
+		srv := aggserve.NewServer(aggserve.NewLocalBackend(nil), aggserve.Options{})
+		srv.Drain()
+
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+	})
+})
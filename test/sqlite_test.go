@@ -29,14 +29,15 @@ CREATE TABLE IF NOT EXISTS test (
     name TEXT NOT NULL,
     lastname TEXT NOT NULL,
     age INTEGER NOT NULL,
-    salary INTEGER NOT NULL
+    salary INTEGER NOT NULL,
+    ts INTEGER NOT NULL
 );
 `
 	db.MustExec(schema)
 
 	tx := db.MustBegin()
 	for i := range data {
-		_, err := tx.NamedExec("INSERT INTO test (id, name, lastname, age, salary) VALUES (:id, :name, :lastname, :age, :salary)", data[i])
+		_, err := tx.NamedExec("INSERT INTO test (id, name, lastname, age, salary, ts) VALUES (:id, :name, :lastname, :age, :salary, :ts)", data[i])
 		if err != nil {
 			return err
 		}
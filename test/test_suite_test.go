@@ -2,13 +2,17 @@ package main_test
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"runtime"
 	"testing"
 
 	aero "github.com/aerospike/aerospike-client-go"
 
+	"github.com/aerospike/aerospike-lua-aggregations/go/aggsql"
+
 	"github.com/jmoiron/sqlx"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -26,11 +30,18 @@ var (
 
 	recordCount = flag.Int("r", 1000, "number of records")
 	nameVariety = flag.Int("v", 100, "number of unique names")
+	seed        = flag.Int64("seed", 0, "seed of the records, random when 0")
+
+	randomQueries = flag.Int("queries", 100, "number of random queries compared to sqlite")
 
 	currentPath = flag.String("lua", "", "Lua Path")
 
 	client *aero.Client
 	sqlDB  *sqlx.DB
+	aggDB  *sqlx.DB
+
+	// records are the records of the set, for the in process backend
+	records []map[string]interface{}
 )
 
 func init_env() {
@@ -64,7 +75,13 @@ func init_env() {
 		log.Fatalln("Error connecting to aerospike cluster:", err)
 	}
 
-	data := randomRecords(*recordCount, *nameVariety)
+	if *seed == 0 {
+		*seed = rand.Int63()
+	}
+	log.Println("Records seed:", *seed)
+
+	data := seededRecords(*seed, *recordCount, *nameVariety)
+	records = data
 
 	/****************************************************************************
 
@@ -98,6 +115,21 @@ func init_env() {
 	if err != nil {
 		log.Fatalln("Error connecting to sqlite3 db:", err)
 	}
+
+	/****************************************************************************
+
+	Connect To Aerospike Through The SQL Driver
+
+	****************************************************************************/
+	dsn := fmt.Sprintf("aerospike://%s:%d/%s", *host, *port, *ns)
+	if *user != "" {
+		dsn = fmt.Sprintf("aerospike://%s:%s@%s:%d/%s", *user, *password, *host, *port, *ns)
+	}
+
+	aggDB, err = sqlx.Open(aggsql.DriverName, dsn)
+	if err != nil {
+		log.Fatalln("Error connecting to the aerospike-agg driver:", err)
+	}
 }
 
 func TestTest(t *testing.T) {
@@ -107,4 +139,5 @@ func TestTest(t *testing.T) {
 
 	defer client.Close()
 	defer sqlDB.Close()
+	defer aggDB.Close()
 }
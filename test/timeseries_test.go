@@ -0,0 +1,209 @@
+package main_test
+
+import (
+	"time"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Time Series Tests", func() {
+
+	Context("Time bucketing in expressions", func() {
+
+		It("Should group by time_bucket correctly", func() {
+			sql := "select (ts/3600000)*3600000 as hour, count(age), sum(salary) from test group by hour"
+			payload := map[string]interface{}{
+				"fields": map[string]interface{}{
+					"count(age)":  map[string]string{"func": "count", "expr": "rec['age'] and 1"},
+					"sum(salary)": map[string]string{"func": "sum", "expr": "rec['salary']"},
+				},
+				"group_by_fields": []interface{}{
+					map[string]string{"alias": "hour", "expr": "time_bucket(rec['ts'], '1h')"},
+				},
+			}
+
+			sqlr, err := sqlQuery(sqlDB, sql)
+			Expect(err).ToNot(HaveOccurred())
+
+			aeror, err := aeroQuery(client, *ns, *set, payload)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(aeror).To(MatchQueryResults(sqlr, "hour"))
+		})
+
+		It("Should group by date_trunc correctly", func() {
+			sql := "select name, (ts/86400000)*86400000 as day, max(age) from test where age > 20 group by name, day"
+			payload := map[string]interface{}{
+				"fields": map[string]interface{}{
+					"name":     "name",
+					"max(age)": map[string]string{"func": "max", "expr": "rec['age']"},
+				},
+				"filter": "rec['age'] > 20",
+				"group_by_fields": []interface{}{
+					"name",
+					map[string]string{"alias": "day", "expr": "date_trunc('day', rec['ts'])"},
+				},
+			}
+
+			sqlr, err := sqlQuery(sqlDB, sql)
+			Expect(err).ToNot(HaveOccurred())
+
+			aeror, err := aeroQuery(client, *ns, *set, payload)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(aeror).To(MatchQueryResults(sqlr, "name", "day"))
+		})
+
+		It("Should filter with date_trunc correctly", func() {
+			sql := "select count(age) from test where (ts/86400000)*86400000 = 1760054400000"
+			payload := map[string]interface{}{
+				"fields": map[string]interface{}{
+					"count(age)": map[string]string{"func": "count", "expr": "rec['age'] and 1"},
+				},
+				"filter": "date_trunc('day', rec['ts']) == 1760054400000",
+			}
+
+			sqlr, err := sqlQuery(sqlDB, sql)
+			Expect(err).ToNot(HaveOccurred())
+
+			aeror, err := aeroQuery(client, *ns, *set, payload)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(aeror).To(MatchQueryResults(sqlr))
+		})
+	})
+
+	Context("Calendar units", func() {
+
+		// dates around the epoch, month and year ends, and leap days
+		calendarSet := *set + "_calendar"
+		dates := []time.Time{
+			time.Date(1900, 2, 28, 23, 0, 0, 0, time.UTC),
+			time.Date(1900, 3, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(1960, 2, 29, 12, 30, 0, 0, time.UTC),
+			time.Date(1969, 12, 28, 8, 0, 0, 0, time.UTC),
+			time.Date(1969, 12, 29, 0, 0, 0, 0, time.UTC),
+			time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC),
+			time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(1970, 1, 4, 23, 59, 59, 0, time.UTC),
+			time.Date(2000, 2, 29, 6, 0, 0, 0, time.UTC),
+			time.Date(2023, 12, 31, 18, 0, 0, 0, time.UTC),
+			time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 2, 29, 10, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		}
+
+		BeforeEach(func() {
+			var recs []map[string]interface{}
+			sqlDB.MustExec("DROP TABLE IF EXISTS calendar")
+			sqlDB.MustExec("CREATE TABLE calendar (id INTEGER PRIMARY KEY, ts INTEGER NOT NULL)")
+			for i, d := range dates {
+				ts := d.Unix() * 1000
+				recs = append(recs, map[string]interface{}{"id": i, "ts": ts})
+				sqlDB.MustExec("INSERT INTO calendar (id, ts) VALUES (?, ?)", i, ts)
+			}
+			Expect(genAeroData(client, *ns, calendarSet, recs)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			client.Truncate(nil, *ns, calendarSet, nil)
+			sqlDB.MustExec("DROP TABLE IF EXISTS calendar")
+		})
+
+		for unit, modifiers := range map[string]string{
+			"month": "'start of month'",
+			"year":  "'start of year'",
+			"week":  "'weekday 0', '-6 days'",
+		} {
+			unit, modifiers := unit, modifiers
+
+			It("Should group by date_trunc('"+unit+"') like sqlite", func() {
+				sql := "select cast(strftime('%s', date(ts/1000, 'unixepoch', " + modifiers + ")) as integer)*1000 as bucket, count(*) as n from calendar group by bucket"
+				payload := map[string]interface{}{
+					"fields": map[string]interface{}{
+						"n": map[string]string{"func": "count", "expr": "1"},
+					},
+					"group_by_fields": []interface{}{
+						map[string]string{"alias": "bucket", "expr": "date_trunc('" + unit + "', rec['ts'])"},
+					},
+				}
+
+				sqlr, err := sqlQuery(sqlDB, sql)
+				Expect(err).ToNot(HaveOccurred())
+
+				aeror, err := aeroQuery(client, *ns, calendarSet, payload)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(aeror).To(MatchQueryResults(sqlr, "bucket"))
+			})
+		}
+
+		It("Should reject intervals which are not positive", func() {
+			for _, interval := range []string{"0", "-5", "'0s'"} {
+				payload := map[string]interface{}{
+					"fields": map[string]interface{}{
+						"n": map[string]string{"func": "count", "expr": "1"},
+					},
+					"group_by_fields": []interface{}{
+						map[string]string{"alias": "bucket", "expr": "time_bucket(rec['ts'], " + interval + ")"},
+					},
+				}
+
+				_, err := aeroQuery(client, *ns, calendarSet, payload)
+				Expect(err).To(HaveOccurred(), interval)
+			}
+		})
+	})
+
+	Context("Filling empty buckets", func() {
+
+		It("Should parse intervals", func() {
+			Expect(agg.ParseInterval("15s")).To(Equal(int64(15000)))
+			Expect(agg.ParseInterval("5m")).To(Equal(int64(300000)))
+			Expect(agg.ParseInterval("hour")).To(Equal(int64(3600000)))
+			Expect(agg.ParseInterval("2d")).To(Equal(int64(2 * 86400000)))
+
+			_, err := agg.ParseInterval("5 fortnights")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should fill missing buckets and order by time", func() {
+			rows := []agg.Row{
+				{"minute": int64(180000), "count": int64(2)},
+				{"minute": int64(60000), "count": int64(1)},
+			}
+
+			tb := agg.TimeBuckets{Column: "minute", From: 0, To: 240000, Interval: 60000, Fill: agg.Row{"count": int64(0)}}
+			res, err := tb.Apply(rows)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(res).To(Equal([]agg.Row{
+				{"minute": int64(0), "count": int64(0)},
+				{"minute": int64(60000), "count": int64(1)},
+				{"minute": int64(120000), "count": int64(0)},
+				{"minute": int64(180000), "count": int64(2)},
+			}))
+		})
+
+		It("Should fill each series separately", func() {
+			rows := []agg.Row{
+				{"name": "Eva", "hour": int64(0), "count": int64(2)},
+				{"name": "Riley", "hour": int64(3600000), "count": int64(1)},
+			}
+
+			tb := agg.TimeBuckets{Column: "hour", From: 0, To: 7200000, Interval: 3600000, Series: []string{"name"}}
+			res, err := tb.Apply(rows)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(res).To(Equal([]agg.Row{
+				{"name": "Eva", "hour": int64(0), "count": int64(2)},
+				{"name": "Riley", "hour": int64(0)},
+				{"name": "Eva", "hour": int64(3600000)},
+				{"name": "Riley", "hour": int64(3600000), "count": int64(1)},
+			}))
+		})
+	})
+})
@@ -0,0 +1,158 @@
+package main_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tracing Tests", func() {
+
+	var exporter *tracetest.InMemoryExporter
+
+	BeforeEach(func() {
+		exporter = tracetest.NewInMemoryExporter()
+		agg.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	})
+
+	AfterEach(func() {
+		agg.SetTracerProvider(nil)
+	})
+
+	// spans returns the recorded spans by name.
+	spans := func() map[string][]tracetest.SpanStub {
+		res := map[string][]tracetest.SpanStub{}
+		for _, span := range exporter.GetSpans() {
+			res[span.Name] = append(res[span.Name], span)
+		}
+		return res
+	}
+
+	attrs := func(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+		res := map[attribute.Key]attribute.Value{}
+		for _, kv := range span.Attributes {
+			res[kv.Key] = kv.Value
+		}
+		return res
+	}
+
+	query := func() *agg.Query {
+		return agg.NewQuery(*ns, *set).
+			Select("name", "name").
+			Count("n", "1").
+			Sum("payroll", "rec['salary']").
+			GroupByFields("name")
+	}
+
+	It("Should trace the registration of the UDF", func() {
+		udf, err := ioutil.ReadFile(filepath.Join(*currentPath, "aggAPI.lua"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(agg.RegisterUDF(context.Background(), client, udf)).To(Succeed())
+
+		register := spans()["agg.register"]
+		Expect(register).To(HaveLen(1))
+		Expect(attrs(register[0])[agg.AttrUDFHash].AsString()).To(Equal(agg.UDFHash(udf)))
+		Expect(register[0].Status.Code).To(Equal(codes.Unset))
+	})
+
+	It("Should trace the steps of a query", func() {
+		rows, err := query().Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+
+		recorded := spans()
+		Expect(recorded["agg.query"]).To(HaveLen(1))
+		root := recorded["agg.query"][0]
+		Expect(root.Parent.IsValid()).To(BeFalse())
+
+		a := attrs(root)
+		Expect(a[agg.AttrNamespace].AsString()).To(Equal(*ns))
+		Expect(a[agg.AttrSet].AsString()).To(Equal(*set))
+		Expect(a[agg.AttrFields].AsInt64()).To(Equal(int64(3)))
+		Expect(a[agg.AttrGroupBy].AsInt64()).To(Equal(int64(1)))
+		Expect(a[agg.AttrGroups].AsInt64()).To(Equal(int64(len(rows))))
+		Expect(a[agg.AttrPayload].AsString()).To(HaveLen(16))
+
+		for _, name := range []string{"agg.dispatch", "agg.receive"} {
+			Expect(recorded[name]).To(HaveLen(1), name)
+			Expect(recorded[name][0].Parent.SpanID()).To(Equal(root.SpanContext.SpanID()), name)
+		}
+		Expect(recorded["agg.decode"]).ToNot(BeEmpty())
+	})
+
+	It("Should trace the nodes of a partial aggregation", func() {
+		rows, err := query().ExecutePartials(context.Background(), client, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		recorded := spans()
+		Expect(recorded["agg.query"]).To(HaveLen(1))
+		root := recorded["agg.query"][0].SpanContext.SpanID()
+
+		nodes := recorded["agg.node"]
+		Expect(nodes).To(HaveLen(len(client.GetNodes())))
+		var total int64
+		for _, node := range nodes {
+			Expect(node.Parent.SpanID()).To(Equal(root))
+			a := attrs(node)
+			Expect(a[agg.AttrNode].AsString()).ToNot(BeEmpty())
+			Expect(a[agg.AttrHost].AsString()).ToNot(BeEmpty())
+			total += a[agg.AttrRecords].AsInt64()
+		}
+		Expect(total).To(Equal(int64(len(records))))
+
+		Expect(recorded["agg.finalize"]).To(HaveLen(1))
+		Expect(attrs(recorded["agg.finalize"][0])[agg.AttrGroups].AsInt64()).To(Equal(int64(len(rows))))
+	})
+
+	It("Should give the same fingerprint to the same payloads", func() {
+		_, err := query().Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = query().Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = query().Count("m", "1").Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+
+		var fingerprints []string
+		for _, span := range spans()["agg.query"] {
+			fingerprints = append(fingerprints, attrs(span)[agg.AttrPayload].AsString())
+		}
+		Expect(fingerprints).To(HaveLen(3))
+		Expect(fingerprints[0]).To(Equal(fingerprints[1]))
+		Expect(fingerprints[0]).ToNot(Equal(fingerprints[2]))
+	})
+
+	It("Should record the errors of the queries", func() {
+		_, err := query().WithMaxGroups(1).Execute(client)
+		Expect(err).To(HaveOccurred())
+
+		root := spans()["agg.query"]
+		Expect(root).To(HaveLen(1))
+		Expect(root[0].Status.Code).To(Equal(codes.Error))
+		Expect(root[0].Events).ToNot(BeEmpty())
+		Expect(root[0].Events[0].Name).To(Equal("exception"))
+	})
+
+	It("Should trace the local aggregations", func() {
+		local, err := newLocal(records)
+		Expect(err).ToNot(HaveOccurred())
+
+		rows, err := local.Execute(context.Background(), query())
+		Expect(err).ToNot(HaveOccurred())
+
+		recorded := spans()
+		Expect(recorded["agg.query"]).To(HaveLen(1))
+		Expect(attrs(recorded["agg.query"][0])[agg.AttrGroups].AsInt64()).To(Equal(int64(len(rows))))
+		Expect(recorded["agg.decode"]).To(HaveLen(1))
+		Expect(attrs(recorded["agg.decode"][0])[agg.AttrRecords].AsInt64()).To(Equal(int64(len(records))))
+	})
+})
@@ -0,0 +1,156 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+
+	aero "github.com/aerospike/aerospike-client-go"
+
+	"github.com/aerospike/aerospike-lua-aggregations/go/agg"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Union Tests", func() {
+
+	// the records are split across two sets, by the parity of their id
+	months := []string{*set + "_2026_09", *set + "_2026_10"}
+
+	BeforeEach(func() {
+		var split [2][]map[string]interface{}
+		for i, rec := range records {
+			split[i%2] = append(split[i%2], rec)
+		}
+		for i, month := range months {
+			Expect(genAeroData(client, *ns, month, split[i])).To(Succeed())
+		}
+	})
+
+	AfterEach(func() {
+		for _, month := range months {
+			client.Truncate(nil, *ns, month, nil)
+		}
+	})
+
+	It("Should aggregate the records of all the sets", func() {
+		sqlr, err := sqlQuery(sqlDB, "select name, count(age), sum(salary), min(age), max(age) from test where age > 20 group by name")
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, from := range []string{
+			fmt.Sprintf("%s.%s union all %s", *ns, months[0], months[1]),
+			fmt.Sprintf(`%s."%s_2026_*"`, *ns, *set),
+		} {
+			q, err := agg.ParseSQL("select name, count(age), sum(salary), min(age), max(age) from " + from + " where age > 20 group by name")
+			Expect(err).ToNot(HaveOccurred())
+
+			rows, err := q.Execute(client)
+			Expect(err).ToNot(HaveOccurred(), from)
+			Expect(aeroRows(rows)).To(MatchQueryResults(sqlr, "name"), from)
+		}
+	})
+
+	It("Should merge the min and max of strings of the sets", func() {
+		sqlr, err := sqlQuery(sqlDB, "select lastname, min(name), max(name) from test group by lastname")
+		Expect(err).ToNot(HaveOccurred())
+
+		q, err := agg.ParseSQL(fmt.Sprintf("select lastname, min(name), max(name) from %s.%s union all %s group by lastname", *ns, months[0], months[1]))
+		Expect(err).ToNot(HaveOccurred())
+
+		rows, err := q.Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aeroRows(rows)).To(MatchQueryResults(sqlr, "lastname"))
+
+		local, err := newLocal(nil)
+		Expect(err).ToNot(HaveOccurred())
+		for i, rec := range records {
+			local.Put(*ns, months[i%2], aero.BinMap(rec))
+		}
+
+		rows, err = local.Execute(context.Background(), q)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aeroRows(rows)).To(MatchQueryResults(sqlr, "lastname"))
+	})
+
+	It("Should return the set of each group", func() {
+		q := agg.NewQuery(*ns, "").
+			FromSets(months...).
+			WithSourceColumn("month").
+			Count("n", "1")
+
+		var partials []*agg.Partial
+		rows, err := q.ExecutePartials(context.Background(), client, func(p *agg.Partial) {
+			partials = append(partials, p)
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(rows).To(HaveLen(2))
+		counts := map[interface{}]int64{}
+		for _, row := range rows {
+			counts[row["month"]] = row["n"].(int64)
+		}
+		Expect(counts).To(Equal(map[interface{}]int64{
+			*ns + "." + months[0]: int64((len(records) + 1) / 2),
+			*ns + "." + months[1]: int64(len(records) / 2),
+		}))
+
+		Expect(partials).To(HaveLen(2 * len(client.GetNodes())))
+		Expect(partials[0].Source).To(Equal(*ns + "." + months[0]))
+		Expect(partials[len(partials)-1].Source).To(Equal(*ns + "." + months[1]))
+	})
+
+	It("Should apply max_groups to the groups of all the sets", func() {
+		q, err := agg.ParseSQL(fmt.Sprintf(`select name, count(*) as n from %s."%s_2026_*" group by name`, *ns, *set))
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = q.WithMaxGroups(1).Execute(client)
+		Expect(err).To(BeAssignableToTypeOf(&agg.TooManyGroupsError{}))
+
+		q.Others = true
+		rows, err := q.Execute(client)
+		Expect(err).ToNot(HaveOccurred())
+
+		var total int64
+		for _, row := range rows {
+			total += row["n"].(int64)
+		}
+		Expect(total).To(Equal(int64(len(records))))
+	})
+
+	It("Should run unions in process", func() {
+		local, err := newLocal(nil)
+		Expect(err).ToNot(HaveOccurred())
+		for i, rec := range records {
+			local.Put(*ns, months[i%2], aero.BinMap(rec))
+		}
+
+		sqlr, err := sqlQuery(sqlDB, "select name, count(*) as n, sum(salary) as payroll from test group by name")
+		Expect(err).ToNot(HaveOccurred())
+
+		q, err := agg.ParseSQL(fmt.Sprintf(`select name, count(*) as n, sum(salary) as payroll from %s."%s_*" group by name`, *ns, *set))
+		Expect(err).ToNot(HaveOccurred())
+
+		rows, err := local.Execute(context.Background(), q)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aeroRows(rows)).To(MatchQueryResults(sqlr, "name"))
+	})
+
+	It("Should reject invalid unions", func() {
+		for _, sql := range []string{
+			fmt.Sprintf("select count(*) from %s.%s union %s", *ns, months[0], months[1]),
+			fmt.Sprintf("select source_set(), count(*) from %s.%s", *ns, *set),
+			fmt.Sprintf("select source_set() + 1, count(*) from %s.%s union all %s", *ns, months[0], months[1]),
+		} {
+			q, err := agg.ParseSQL(sql)
+			if err == nil {
+				err = q.Validate()
+			}
+			Expect(err).To(HaveOccurred(), sql)
+		}
+
+		q, err := agg.ParseSQL(fmt.Sprintf(`select count(*) from %s."%s_1999_*"`, *ns, *set))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = q.Execute(client)
+		Expect(err).To(MatchError(ContainSubstring("no set matches")))
+	})
+})